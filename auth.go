@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// clockSkew is how far the clocks of token issuers may be off.
+const clockSkew = 30 * time.Second
+
+var (
+	ErrUnauthenticated = &Error{Code: CodeUnauthenticated, Message: "authentication required"}
+	ErrInvalidToken    = &Error{Code: CodeUnauthenticated, Message: "invalid token"}
+)
+
+// PrincipalKind is the type of credential a caller authenticated
+// with. Each kind has its own signing key, so that holding the key of
+// one kind does not allow minting tokens of another.
+type PrincipalKind string
+
+const (
+	PrincipalUser     PrincipalKind = "user"
+	PrincipalRobot    PrincipalKind = "robot"
+	PrincipalOperator PrincipalKind = "operator"
+)
+
+var principalKinds = []PrincipalKind{PrincipalUser, PrincipalRobot, PrincipalOperator}
+
+// Principal is the authenticated caller of a request. Subject is the
+// user ID for users, and the name of the robot or operator otherwise.
+type Principal struct {
+	Kind    PrincipalKind `json:"kind"`
+	Subject string        `json:"sub"`
+}
+
+func (principal Principal) String() string {
+	return string(principal.Kind) + ":" + principal.Subject
+}
+
+type principalKey struct{}
+
+// WithPrincipal attaches the authenticated caller to ctx.
+func WithPrincipal(ctx context.Context, principal Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// PrincipalFrom returns the authenticated caller attached to ctx.
+func PrincipalFrom(ctx context.Context) (Principal, bool) {
+	principal, ok := ctx.Value(principalKey{}).(Principal)
+	return principal, ok
+}
+
+// AuthConfig holds the signing keys of each PrincipalKind and the
+// issuer and audience tokens must name, if any. Disabled trusts the
+// claims of bearer tokens without verifying them and lets requests
+// without one through as an operator, for local development only.
+type AuthConfig struct {
+	Disabled bool
+	Keys     map[PrincipalKind][]byte
+	Issuer   string
+	Audience string
+}
+
+// AuthConfigFromEnv reads an AuthConfig from the AUTH_* environment
+// variables. AUTH_USER_KEY, AUTH_ROBOT_KEY and AUTH_OPERATOR_KEY
+// default to a key derived from AUTH_SIGNING_KEY for each kind.
+func AuthConfigFromEnv() AuthConfig {
+	key := os.Getenv("AUTH_SIGNING_KEY")
+	keys := map[PrincipalKind][]byte{}
+	for _, kind := range principalKinds {
+		if kindKey := os.Getenv("AUTH_" + strings.ToUpper(string(kind)) + "_KEY"); kindKey != "" {
+			keys[kind] = []byte(kindKey)
+		} else if key != "" {
+			keys[kind] = deriveKey([]byte(key), kind)
+		}
+	}
+	return AuthConfig{
+		Disabled: getenvBool("AUTH_DISABLED", false),
+		Keys:     keys,
+		Issuer:   os.Getenv("AUTH_ISSUER"),
+		Audience: os.Getenv("AUTH_AUDIENCE"),
+	}
+}
+
+// Authenticator verifies the HS256 JSON Web Tokens callers present
+// as bearer tokens.
+type Authenticator struct {
+	config AuthConfig
+}
+
+func NewAuthenticator(config AuthConfig) (Authenticator, error) {
+	if !config.Disabled && len(config.Keys) == 0 {
+		return Authenticator{}, errors.New("auth: AUTH_SIGNING_KEY is required unless AUTH_DISABLED is set")
+	}
+	return Authenticator{config: config}, nil
+}
+
+// tokenHeader is the JOSE header of a token.
+type tokenHeader struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ,omitempty"`
+}
+
+// tokenClaims are the claims a token may carry. Kind selects the
+// PrincipalKind and so the key the token must be signed with.
+type tokenClaims struct {
+	Subject   string        `json:"sub"`
+	Kind      PrincipalKind `json:"kind"`
+	Issuer    string        `json:"iss,omitempty"`
+	Audience  audience      `json:"aud,omitempty"`
+	IssuedAt  int64         `json:"iat,omitempty"`
+	NotBefore int64         `json:"nbf,omitempty"`
+	ExpiresAt int64         `json:"exp"`
+}
+
+// audience is the aud claim, which is either a string or a list.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(a))
+}
+
+// deriveKey is the signing key of kind derived from a shared key, so
+// that tokens of one kind do not verify as another.
+func deriveKey(key []byte, kind PrincipalKind) []byte {
+	return sign(key, string(kind))
+}
+
+// Authenticate attaches the Principal of every request's bearer token
+// to its context, rejecting requests without a valid one. Requests
+// that already carry a Principal are let through as they are. Only
+// requests to the path templates in queryTokenPaths may pass their
+// token in the query instead, since URLs end up in logs.
+func (authenticator Authenticator) Authenticate(h http.Handler, queryTokenPaths ...string) http.Handler {
+	queryTokenRoutes := mux.NewRouter()
+	for _, path := range queryTokenPaths {
+		queryTokenRoutes.NewRoute().Path(path)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := PrincipalFrom(r.Context()); ok {
+			h.ServeHTTP(w, r)
+			return
+		}
+		token := bearerToken(r, queryTokenRoutes.Match(r, &mux.RouteMatch{}))
+		if authenticator.config.Disabled {
+			principal := Principal{Kind: PrincipalOperator, Subject: "anonymous"}
+			if _, claims, err := parseToken(token); err == nil {
+				principal = Principal{Kind: claims.Kind, Subject: claims.Subject}
+			}
+			h.ServeHTTP(w, r.WithContext(WithPrincipal(r.Context(), principal)))
+			return
+		}
+		if token == "" {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			WriteError(w, ErrUnauthenticated)
+			return
+		}
+		principal, err := authenticator.Verify(token, time.Now())
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			WriteError(w, err)
+			return
+		}
+		h.ServeHTTP(w, r.WithContext(WithPrincipal(r.Context(), principal)))
+	})
+}
+
+// bearerToken returns the token in the Authorization header, or if
+// inQuery in the access_token query parameter for clients such as
+// EventSource that cannot set headers.
+func bearerToken(r *http.Request, inQuery bool) string {
+	const prefix = "Bearer "
+	if header := r.Header.Get("Authorization"); len(header) > len(prefix) && strings.EqualFold(header[:len(prefix)], prefix) {
+		return strings.TrimSpace(header[len(prefix):])
+	}
+	if !inQuery {
+		return ""
+	}
+	return r.URL.Query().Get("access_token")
+}
+
+// Verify checks the signature and claims of token at now and returns
+// the Principal it was issued to.
+func (authenticator Authenticator) Verify(token string, now time.Time) (Principal, error) {
+	parts, claims, err := parseToken(token)
+	if err != nil {
+		return Principal{}, err
+	}
+	key, ok := authenticator.config.Keys[claims.Kind]
+	if !ok {
+		return Principal{}, invalidToken("unknown kind")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(signature, sign(key, parts[0]+"."+parts[1])) {
+		return Principal{}, invalidToken("bad signature")
+	}
+
+	switch {
+	case claims.Subject == "":
+		return Principal{}, invalidToken("missing subject")
+	case claims.ExpiresAt == 0:
+		return Principal{}, invalidToken("missing expiry")
+	case now.Add(-clockSkew).Unix() >= claims.ExpiresAt:
+		return Principal{}, invalidToken("expired")
+	case claims.NotBefore != 0 && now.Add(clockSkew).Unix() < claims.NotBefore:
+		return Principal{}, invalidToken("not yet valid")
+	case authenticator.config.Issuer != "" && claims.Issuer != authenticator.config.Issuer:
+		return Principal{}, invalidToken("wrong issuer")
+	case authenticator.config.Audience != "" && !contains(claims.Audience, authenticator.config.Audience):
+		return Principal{}, invalidToken("wrong audience")
+	}
+	return Principal{Kind: claims.Kind, Subject: claims.Subject}, nil
+}
+
+// Issue signs a token for principal that is valid for ttl from now,
+// for provisioning robots and operators.
+func (authenticator Authenticator) Issue(principal Principal, ttl time.Duration, now time.Time) (string, error) {
+	key, ok := authenticator.config.Keys[principal.Kind]
+	if !ok && !authenticator.config.Disabled {
+		return "", errors.New("auth: no signing key for " + string(principal.Kind))
+	}
+	claims := tokenClaims{
+		Subject:   principal.Subject,
+		Kind:      principal.Kind,
+		Issuer:    authenticator.config.Issuer,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(ttl).Unix(),
+	}
+	if authenticator.config.Audience != "" {
+		claims.Audience = audience{authenticator.config.Audience}
+	}
+	header, err := encodeSegment(tokenHeader{Algorithm: "HS256", Type: "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := encodeSegment(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := header + "." + payload
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sign(key, signed)), nil
+}
+
+// parseToken splits token into its segments and decodes its claims,
+// without verifying them.
+func parseToken(token string) ([]string, tokenClaims, error) {
+	claims := tokenClaims{}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, claims, invalidToken("malformed token")
+	}
+	header := tokenHeader{}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, claims, invalidToken("malformed header")
+	}
+	if header.Algorithm != "HS256" {
+		return nil, claims, invalidToken("unsupported algorithm")
+	}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, claims, invalidToken("malformed claims")
+	}
+	return parts, claims, nil
+}
+
+func sign(key []byte, signed string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(signed))
+	return mac.Sum(nil)
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func encodeSegment(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// invalidToken reports why a token was rejected.
+func invalidToken(reason string) error {
+	e := *ErrInvalidToken
+	e.Details = reason
+	return &e
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testKey = []byte("k1")
+
+func testAuthenticator(t *testing.T, config AuthConfig) Authenticator {
+	t.Helper()
+	config.Keys = map[PrincipalKind][]byte{}
+	for _, kind := range principalKinds {
+		config.Keys[kind] = deriveKey(testKey, kind)
+	}
+	authenticator, err := NewAuthenticator(config)
+	if err != nil {
+		t.Fatalf("NewAuthenticator: %v", err)
+	}
+	return authenticator
+}
+
+// signToken signs claims with key, whatever kind they name.
+func signToken(t *testing.T, claims tokenClaims, key []byte, algorithm string) string {
+	t.Helper()
+	header, err := encodeSegment(tokenHeader{Algorithm: algorithm, Type: "JWT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := encodeSegment(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := header + "." + payload
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sign(key, signed))
+}
+
+func TestVerifyIssued(t *testing.T) {
+	authenticator := testAuthenticator(t, AuthConfig{Issuer: "ros-nueva", Audience: "api"})
+	now := time.Unix(1700000000, 0)
+	for _, principal := range []Principal{
+		{Kind: PrincipalUser, Subject: "u1"},
+		{Kind: PrincipalRobot, Subject: "r"},
+		{Kind: PrincipalOperator, Subject: "o"},
+	} {
+		token, err := authenticator.Issue(principal, time.Hour, now)
+		if err != nil {
+			t.Fatalf("Issue(%s): %v", principal, err)
+		}
+		got, err := authenticator.Verify(token, now.Add(time.Minute))
+		if err != nil {
+			t.Errorf("Verify of a token issued to %s: %v", principal, err)
+		} else if got != principal {
+			t.Errorf("Verify = %s, want %s", got, principal)
+		}
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+	authenticator := testAuthenticator(t, AuthConfig{Issuer: "ros-nueva", Audience: "api"})
+	now := time.Unix(1700000000, 0)
+	valid := tokenClaims{
+		Subject:   "u1",
+		Kind:      PrincipalUser,
+		Issuer:    "ros-nueva",
+		Audience:  audience{"api"},
+		ExpiresAt: now.Add(time.Hour).Unix(),
+	}
+	userKey := deriveKey(testKey, PrincipalUser)
+	with := func(change func(claims *tokenClaims)) tokenClaims {
+		claims := valid
+		change(&claims)
+		return claims
+	}
+	issued, _ := authenticator.Issue(Principal{Kind: PrincipalUser, Subject: "u1"}, time.Hour, now)
+	parts := strings.Split(issued, ".")
+	tampered, _ := encodeSegment(with(func(c *tokenClaims) { c.Subject = "u2" }))
+
+	tests := []struct {
+		name   string
+		token  string
+		reason string
+	}{
+		{"tampered claims", parts[0] + "." + tampered + "." + parts[2], "bad signature"},
+		{"signed with another key", signToken(t, valid, []byte("k2"), "HS256"), "bad signature"},
+		{"signed with the raw key", signToken(t, valid, testKey, "HS256"), "bad signature"},
+		{"user key for a robot", signToken(t, with(func(c *tokenClaims) { c.Kind = PrincipalRobot }), userKey, "HS256"), "bad signature"},
+		{"user key for an operator", signToken(t, with(func(c *tokenClaims) { c.Kind = PrincipalOperator }), userKey, "HS256"), "bad signature"},
+		{"unknown kind", signToken(t, with(func(c *tokenClaims) { c.Kind = "admin" }), userKey, "HS256"), "unknown kind"},
+		{"expired", signToken(t, with(func(c *tokenClaims) { c.ExpiresAt = now.Add(-time.Minute).Unix() }), userKey, "HS256"), "expired"},
+		{"without expiry", signToken(t, with(func(c *tokenClaims) { c.ExpiresAt = 0 }), userKey, "HS256"), "missing expiry"},
+		{"not yet valid", signToken(t, with(func(c *tokenClaims) { c.NotBefore = now.Add(time.Minute).Unix() }), userKey, "HS256"), "not yet valid"},
+		{"without subject", signToken(t, with(func(c *tokenClaims) { c.Subject = "" }), userKey, "HS256"), "missing subject"},
+		{"wrong issuer", signToken(t, with(func(c *tokenClaims) { c.Issuer = "elsewhere" }), userKey, "HS256"), "wrong issuer"},
+		{"wrong audience", signToken(t, with(func(c *tokenClaims) { c.Audience = audience{"web"} }), userKey, "HS256"), "wrong audience"},
+		{"other algorithm", signToken(t, valid, userKey, "none"), "unsupported algorithm"},
+		{"malformed", "not.a-token", "malformed token"},
+	}
+	for _, test := range tests {
+		_, err := authenticator.Verify(test.token, now)
+		e, ok := err.(*Error)
+		if !ok || e.Message != ErrInvalidToken.Message || e.Details != test.reason {
+			t.Errorf("%s: Verify = %v, want an invalid token that is %s", test.name, err, test.reason)
+		}
+	}
+}
+
+func TestVerifyClockSkew(t *testing.T) {
+	authenticator := testAuthenticator(t, AuthConfig{})
+	now := time.Unix(1700000000, 0)
+	claims := tokenClaims{
+		Subject:   "r",
+		Kind:      PrincipalRobot,
+		NotBefore: now.Add(clockSkew / 2).Unix(),
+		ExpiresAt: now.Add(-clockSkew / 2).Unix(),
+	}
+	token := signToken(t, claims, deriveKey(testKey, PrincipalRobot), "HS256")
+	if _, err := authenticator.Verify(token, now); err != nil {
+		t.Errorf("Verify within the clock skew: %v", err)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// publishTimeout bounds how long a Publisher waits for the bus to
+// accept a message.
+const publishTimeout = 10 * time.Second
+
+var ErrPublishTimeout = errors.New("publish timed out")
+
+// Publisher sends messages to the robot over a message bus.
+type Publisher interface {
+	PublishJSON(message interface{}) error
+}
+
+// Subscriber delivers every message the robot sends over a message
+// bus to handle, one at a time.
+type Subscriber interface {
+	Subscribe(handle func(message []byte)) error
+}
+
+// Bus is a message bus connecting the backend and the robot.
+type Bus interface {
+	Publisher
+	Subscriber
+}
+
+// NewBusFromEnv builds the Bus named by BUS, which is one of
+// "local" (the default), "pubnub" or "mqtt".
+func NewBusFromEnv() (Bus, error) {
+	switch bus := getenv("BUS", "local"); bus {
+	case "local":
+		return NewLocalBus(), nil
+	case "pubnub":
+		return NewPubnubManager(PubnubConfigFromEnv())
+	case "mqtt":
+		return NewMQTTBus(MQTTConfigFromEnv())
+	default:
+		return nil, fmt.Errorf("unknown message bus %q", bus)
+	}
+}
+
+// getenv returns the environment variable key, or fallback if it is
+// unset or empty.
+func getenv(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// getenvBool is getenv for boolean variables such as "true" or "1".
+func getenvBool(key string, fallback bool) bool {
+	value, err := strconv.ParseBool(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// localBusHistory is how many of the latest published messages a
+// LocalBus keeps.
+const localBusHistory = 100
+
+// LocalBus is an in-process Bus. It keeps the latest messages
+// published on it and lets callers play the robot through Receive,
+// which makes it convenient for tests and for running without a robot.
+type LocalBus struct {
+	mu       sync.Mutex
+	messages []json.RawMessage
+	handlers []func(message []byte)
+}
+
+func NewLocalBus() *LocalBus {
+	return &LocalBus{}
+}
+
+func (bus *LocalBus) PublishJSON(message interface{}) error {
+	jsonMsg, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	if len(bus.messages) == localBusHistory {
+		bus.messages = append(bus.messages[:0], bus.messages[1:]...)
+	}
+	bus.messages = append(bus.messages, jsonMsg)
+	return nil
+}
+
+// Messages returns the latest messages published, oldest first.
+func (bus *LocalBus) Messages() []json.RawMessage {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	return append([]json.RawMessage{}, bus.messages...)
+}
+
+func (bus *LocalBus) Subscribe(handle func(message []byte)) error {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	bus.handlers = append(bus.handlers, handle)
+	return nil
+}
+
+// Receive delivers message to every subscriber as if the robot had
+// sent it.
+func (bus *LocalBus) Receive(message interface{}) error {
+	jsonMsg, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	bus.mu.Lock()
+	handlers := append([]func(message []byte){}, bus.handlers...)
+	bus.mu.Unlock()
+	for _, handle := range handlers {
+		handle(jsonMsg)
+	}
+	return nil
+}
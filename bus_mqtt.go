@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+var (
+	ErrConnectTimeout   = errors.New("mqtt: connect timed out")
+	ErrSubscribeTimeout = errors.New("mqtt: subscribe timed out")
+)
+
+// MQTTConfig holds the broker and topics of an MQTT bus. Messages
+// to the robot go to Topic, messages from it arrive on StatusTopic.
+type MQTTConfig struct {
+	Broker      string
+	ClientID    string
+	Username    string
+	Password    string
+	Topic       string
+	StatusTopic string
+	QoS         byte
+}
+
+// MQTTConfigFromEnv reads an MQTTConfig from the MQTT_* environment
+// variables.
+func MQTTConfigFromEnv() MQTTConfig {
+	qos, err := strconv.Atoi(os.Getenv("MQTT_QOS"))
+	if err != nil {
+		qos = 1
+	}
+	topic := getenv("MQTT_TOPIC", "unicub")
+	return MQTTConfig{
+		Broker:      os.Getenv("MQTT_BROKER"),
+		ClientID:    getenv("MQTT_CLIENT_ID", "ros-nueva-backend"),
+		Username:    os.Getenv("MQTT_USERNAME"),
+		Password:    os.Getenv("MQTT_PASSWORD"),
+		Topic:       topic,
+		StatusTopic: getenv("MQTT_STATUS_TOPIC", topic+"/status"),
+		QoS:         byte(qos),
+	}
+}
+
+// MQTTBus is a Bus exchanging messages through an MQTT broker. The
+// broker forgets subscriptions when the connection drops, so the bus
+// subscribes again whenever the client reconnects.
+type MQTTBus struct {
+	client      mqtt.Client
+	topic       string
+	statusTopic string
+	qos         byte
+
+	mu       sync.Mutex
+	handlers []func(message []byte)
+}
+
+func NewMQTTBus(config MQTTConfig) (*MQTTBus, error) {
+	if config.Broker == "" {
+		return nil, errors.New("mqtt: broker is required")
+	}
+	bus := &MQTTBus{
+		topic:       config.Topic,
+		statusTopic: config.StatusTopic,
+		qos:         config.QoS,
+	}
+	options := mqtt.NewClientOptions().
+		AddBroker(config.Broker).
+		SetClientID(config.ClientID).
+		SetUsername(config.Username).
+		SetPassword(config.Password).
+		SetAutoReconnect(true).
+		SetOnConnectHandler(bus.resubscribe)
+	bus.client = mqtt.NewClient(options)
+	if token := bus.client.Connect(); !token.WaitTimeout(publishTimeout) {
+		return nil, ErrConnectTimeout
+	} else if token.Error() != nil {
+		return nil, token.Error()
+	}
+	return bus, nil
+}
+
+func (bus *MQTTBus) PublishJSON(message interface{}) error {
+	jsonMsg, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	token := bus.client.Publish(bus.topic, bus.qos, false, jsonMsg)
+	if !token.WaitTimeout(publishTimeout) {
+		return ErrPublishTimeout
+	}
+	return token.Error()
+}
+
+func (bus *MQTTBus) Subscribe(handle func(message []byte)) error {
+	bus.mu.Lock()
+	bus.handlers = append(bus.handlers, handle)
+	first := len(bus.handlers) == 1
+	bus.mu.Unlock()
+	if !first {
+		return nil
+	}
+	token := bus.subscribe()
+	if !token.WaitTimeout(publishTimeout) {
+		return ErrSubscribeTimeout
+	}
+	return token.Error()
+}
+
+// subscribe subscribes to the status topic, handing every message to
+// each handler.
+func (bus *MQTTBus) subscribe() mqtt.Token {
+	return bus.client.Subscribe(bus.statusTopic, bus.qos, func(client mqtt.Client, message mqtt.Message) {
+		bus.mu.Lock()
+		handlers := append([]func(message []byte){}, bus.handlers...)
+		bus.mu.Unlock()
+		for _, handle := range handlers {
+			handle(message.Payload())
+		}
+	})
+}
+
+// resubscribe restores the subscription to the status topic after the
+// client reconnects. It runs on the client's connect callback, which
+// must not block, so the outcome is only logged.
+func (bus *MQTTBus) resubscribe(client mqtt.Client) {
+	bus.mu.Lock()
+	subscribed := len(bus.handlers) > 0
+	bus.mu.Unlock()
+	if !subscribed {
+		return
+	}
+	token := bus.subscribe()
+	go func() {
+		if !token.WaitTimeout(publishTimeout) {
+			log.Printf("mqtt: resubscribing to %s: %v", bus.statusTopic, ErrSubscribeTimeout)
+		} else if err := token.Error(); err != nil {
+			log.Printf("mqtt: resubscribing to %s: %v", bus.statusTopic, err)
+		}
+	}()
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// ErrorCode classifies an Error so clients can branch on it
+// without matching messages.
+type ErrorCode string
+
+const (
+	CodeInvalid          ErrorCode = "invalid"
+	CodeUnauthenticated  ErrorCode = "unauthenticated"
+	CodeForbidden        ErrorCode = "forbidden"
+	CodeNotFound         ErrorCode = "not_found"
+	CodeMethodNotAllowed ErrorCode = "method_not_allowed"
+	CodeConflict         ErrorCode = "conflict"
+	CodeInternal         ErrorCode = "internal"
+)
+
+var statusCodes = map[ErrorCode]int{
+	CodeInvalid:          http.StatusBadRequest,
+	CodeUnauthenticated:  http.StatusUnauthorized,
+	CodeForbidden:        http.StatusForbidden,
+	CodeNotFound:         http.StatusNotFound,
+	CodeMethodNotAllowed: http.StatusMethodNotAllowed,
+	CodeConflict:         http.StatusConflict,
+	CodeInternal:         http.StatusInternalServerError,
+}
+
+var (
+	ErrForbidden    = &Error{Code: CodeForbidden, Message: "access denied"}
+	ErrRouteMissing = &Error{Code: CodeNotFound, Message: "route does not exist"}
+)
+
+// Error is the error envelope returned by every endpoint. Entity and
+// ID name the entity the error is about, if any.
+type Error struct {
+	Code    ErrorCode   `json:"code"`
+	Message string      `json:"message"`
+	Entity  string      `json:"entity,omitempty"`
+	ID      string      `json:"id,omitempty"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Status is the HTTP status code e is reported with.
+func (e *Error) Status() int {
+	if status, ok := statusCodes[e.Code]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+// withID returns a copy of err naming the entity with the given ID.
+// Errors that are not about an entity are returned unchanged.
+func withID(err error, id string) error {
+	e, ok := err.(*Error)
+	if !ok || e.Entity == "" {
+		return err
+	}
+	identified := *e
+	identified.ID = id
+	return &identified
+}
+
+// WriteError writes err in the error envelope with the matching
+// status code. Errors other than *Error are reported as internal.
+func WriteError(w http.ResponseWriter, err error) {
+	e, ok := err.(*Error)
+	if !ok {
+		e = &Error{Code: CodeInternal, Message: err.Error()}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(e.Status())
+	json.NewEncoder(w).Encode(ResponseError{Error: e})
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+)
+
+// Actors recorded on events when no principal is known.
+const (
+	ActorAPI   = "api"
+	ActorRobot = "robot"
+)
+
+// Event types, named after the entity and what happened to it.
+const (
+	EventJourneyCreated   = "journey.created"
+	EventJourneyUpdated   = "journey.updated"
+	EventJourneyStarted   = "journey.started"
+	EventJourneyCompleted = "journey.completed"
+	EventJourneyAborted   = "journey.aborted"
+	EventJourneyDeleted   = "journey.deleted"
+
+	EventTripCreated   = "trip.created"
+	EventTripUpdated   = "trip.updated"
+	EventTripStarted   = "trip.started"
+	EventTripArrived   = "trip.arrived"
+	EventTripFailed    = "trip.failed"
+	EventTripCancelled = "trip.cancelled"
+	EventTripDeleted   = "trip.deleted"
+)
+
+var journeyEvents = map[JourneyState]string{
+	JourneyActive:    EventJourneyStarted,
+	JourneyCompleted: EventJourneyCompleted,
+	JourneyAborted:   EventJourneyAborted,
+}
+
+var tripEvents = map[TripState]string{
+	TripInProgress: EventTripStarted,
+	TripArrived:    EventTripArrived,
+	TripFailed:     EventTripFailed,
+	TripCancelled:  EventTripCancelled,
+}
+
+// Event is an entry in the append-only log of changes to a journey
+// and its trips. Payload is the JSON Merge Patch the change applied
+// to the entity, or null for deletions. Sequence orders the events of
+// a journey; it counts up from the journey's LastSequence in the
+// transaction that records the event.
+type Event struct {
+	ID        string `datastore:"id" json:"id"`
+	JourneyID string `datastore:"journey_id" json:"journey_id"`
+	TripID    string `datastore:"trip_id" json:"trip_id,omitempty"`
+	Type      string `datastore:"type" json:"type"`
+	Actor     string `datastore:"actor" json:"actor"`
+	Timestamp int64  `datastore:"timestamp" json:"timestamp"`
+	Sequence  int64  `datastore:"sequence" json:"sequence"`
+	Payload   string `datastore:"payload,noindex" json:"-"`
+}
+
+// MarshalJSON inlines the payload rather than quoting it.
+func (event Event) MarshalJSON() ([]byte, error) {
+	type plain Event
+	return json.Marshal(struct {
+		plain
+		Payload json.RawMessage `json:"payload"`
+	}{plain(event), json.RawMessage(event.Payload)})
+}
+
+type actorKey struct{}
+
+// WithActor attributes the changes made with ctx to actor.
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// actorOf names who made the changes with ctx: the actor set with
+// WithActor, or else the authenticated principal.
+func actorOf(ctx context.Context) string {
+	if actor, ok := ctx.Value(actorKey{}).(string); ok {
+		return actor
+	}
+	if principal, ok := PrincipalFrom(ctx); ok {
+		return principal.String()
+	}
+	return ActorAPI
+}
+
+// journalStore records every journey and trip written through it as
+// an Event, in the same transaction as the write.
+type journalStore struct {
+	Store
+}
+
+type journalTxKey struct{}
+
+// journalTx holds the sequence counters of the journeys with events
+// recorded in a transaction, and the journeys it wrote, so that the
+// counters can be stored on them before it commits. A nil journey was
+// deleted.
+type journalTx struct {
+	sequences map[string]int64
+	journeys  map[string]*Journey
+}
+
+func (store journalStore) RunInTransaction(ctx context.Context, f func(ctx context.Context) error) error {
+	if _, ok := ctx.Value(journalTxKey{}).(*journalTx); ok {
+		return store.Store.RunInTransaction(ctx, f)
+	}
+	return store.Store.RunInTransaction(ctx, func(ctx context.Context) error {
+		tx := &journalTx{sequences: map[string]int64{}, journeys: map[string]*Journey{}}
+		ctx = context.WithValue(ctx, journalTxKey{}, tx)
+		if err := f(ctx); err != nil {
+			return err
+		}
+		return store.storeSequences(ctx, tx)
+	})
+}
+
+// storeSequences writes the sequence counters of tx to their journeys.
+func (store journalStore) storeSequences(ctx context.Context, tx *journalTx) error {
+	for journeyID, sequence := range tx.sequences {
+		journey, written := tx.journeys[journeyID]
+		if written && journey == nil {
+			continue
+		}
+		if !written {
+			stored, dataErr := store.Store.GetJourney(ctx, journeyID)
+			if dataErr == ErrJourneyMissing {
+				continue
+			} else if dataErr != nil {
+				return dataErr
+			}
+			journey = &stored
+		}
+		journey.LastSequence = sequence
+		if dataErr := store.Store.PutJourney(ctx, *journey); dataErr != nil {
+			return dataErr
+		}
+	}
+	return nil
+}
+
+// nextSequence returns the Sequence of the next event of the journey.
+// Journeys that have no counter yet, including those deleted and
+// those stored before it existed, carry on from their latest event.
+func (store journalStore) nextSequence(ctx context.Context, journeyID string) (int64, error) {
+	tx := ctx.Value(journalTxKey{}).(*journalTx)
+	if sequence, ok := tx.sequences[journeyID]; ok {
+		tx.sequences[journeyID] = sequence + 1
+		return sequence + 1, nil
+	}
+	var last int64
+	journey, dataErr := store.Store.GetJourney(ctx, journeyID)
+	if dataErr != nil && dataErr != ErrJourneyMissing {
+		return 0, dataErr
+	}
+	last = journey.LastSequence
+	if last == 0 {
+		events, dataErr := store.Store.JourneyEvents(ctx, journeyID)
+		if dataErr != nil {
+			return 0, dataErr
+		}
+		if len(events) > 0 {
+			last = events[len(events)-1].Sequence
+		}
+	}
+	tx.sequences[journeyID] = last + 1
+	return last + 1, nil
+}
+
+func (store journalStore) PutJourney(ctx context.Context, journey Journey) error {
+	return store.RunInTransaction(ctx, func(ctx context.Context) error {
+		old, dataErr := store.Store.GetJourney(ctx, journey.ID)
+		if dataErr != nil && dataErr != ErrJourneyMissing {
+			return dataErr
+		}
+		// The counter may have moved on since journey was read.
+		if journey.LastSequence < old.LastSequence {
+			journey.LastSequence = old.LastSequence
+		}
+		if putErr := store.Store.PutJourney(ctx, journey); putErr != nil {
+			return putErr
+		}
+		ctx.Value(journalTxKey{}).(*journalTx).journeys[journey.ID] = &journey
+		if dataErr == ErrJourneyMissing {
+			return store.record(ctx, journey.ID, "", EventJourneyCreated, nil, journey)
+		}
+		eventType := EventJourneyUpdated
+		if state := journey.CurrentState(); state != old.CurrentState() {
+			eventType = journeyEvents[state]
+		}
+		return store.record(ctx, journey.ID, "", eventType, old, journey)
+	})
+}
+
+func (store journalStore) DeleteJourney(ctx context.Context, id string) error {
+	return store.RunInTransaction(ctx, func(ctx context.Context) error {
+		if dataErr := store.Store.DeleteJourney(ctx, id); dataErr != nil {
+			return dataErr
+		}
+		ctx.Value(journalTxKey{}).(*journalTx).journeys[id] = nil
+		return store.record(ctx, id, "", EventJourneyDeleted, nil, nil)
+	})
+}
+
+func (store journalStore) PutTrip(ctx context.Context, trip Trip) error {
+	return store.RunInTransaction(ctx, func(ctx context.Context) error {
+		old, dataErr := store.Store.GetTrip(ctx, trip.ID)
+		if dataErr != nil && dataErr != ErrTripMissing {
+			return dataErr
+		}
+		if putErr := store.Store.PutTrip(ctx, trip); putErr != nil {
+			return putErr
+		}
+		if dataErr == ErrTripMissing {
+			return store.record(ctx, trip.JourneyID, trip.ID, EventTripCreated, nil, trip)
+		}
+		eventType := EventTripUpdated
+		if state := trip.CurrentState(); state != old.CurrentState() {
+			eventType = tripEvents[state]
+		}
+		return store.record(ctx, trip.JourneyID, trip.ID, eventType, old, trip)
+	})
+}
+
+func (store journalStore) DeleteTrip(ctx context.Context, id string) error {
+	return store.RunInTransaction(ctx, func(ctx context.Context) error {
+		trip, dataErr := store.Store.GetTrip(ctx, id)
+		if dataErr != nil {
+			return dataErr
+		}
+		if dataErr := store.Store.DeleteTrip(ctx, id); dataErr != nil {
+			return dataErr
+		}
+		return store.record(ctx, trip.JourneyID, id, EventTripDeleted, nil, nil)
+	})
+}
+
+// record appends the event turning from into to. A nil from is a
+// creation and a nil to a deletion. Writes that change nothing are
+// not recorded.
+func (store journalStore) record(ctx context.Context, journeyID, tripID, eventType string, from, to interface{}) error {
+	var patch interface{}
+	if to != nil {
+		before := map[string]interface{}{}
+		if from != nil {
+			var err error
+			if before, err = toDocument(from); err != nil {
+				return err
+			}
+		}
+		after, err := toDocument(to)
+		if err != nil {
+			return err
+		}
+		diff := diffPatch(before, after)
+		if len(diff) == 0 {
+			return nil
+		}
+		patch = diff
+	}
+	payload, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	id, err := newID()
+	if err != nil {
+		return err
+	}
+	sequence, err := store.nextSequence(ctx, journeyID)
+	if err != nil {
+		return err
+	}
+	return store.AppendEvent(ctx, Event{
+		ID:        id,
+		JourneyID: journeyID,
+		TripID:    tripID,
+		Type:      eventType,
+		Actor:     actorOf(ctx),
+		Timestamp: time.Now().UTC().Unix(),
+		Sequence:  sequence,
+		Payload:   string(payload),
+	})
+}
+
+// rebuildJourney replays the journey's own events among events, in
+// order, into the journey they leave behind. Journeys stored before
+// events were recorded only replay from their first recorded change.
+func rebuildJourney(journeyID string, events []Event) (Journey, error) {
+	var document interface{}
+	for _, event := range events {
+		if event.TripID != "" {
+			continue
+		}
+		if event.Type == EventJourneyDeleted {
+			document = nil
+			continue
+		}
+		var patch interface{}
+		if err := json.Unmarshal([]byte(event.Payload), &patch); err != nil {
+			return Journey{}, err
+		}
+		document = mergePatch(document, patch)
+	}
+	journey := Journey{}
+	if document == nil {
+		return journey, withID(ErrJourneyMissing, journeyID)
+	}
+	encoded, err := json.Marshal(document)
+	if err != nil {
+		return journey, err
+	}
+	return journey, json.Unmarshal(encoded, &journey)
+}
+
+// journeyOwner returns the user the journey belonged to according to
+// its own events among events, or "" if none of them say.
+func journeyOwner(events []Event) string {
+	owner := ""
+	for _, event := range events {
+		if event.TripID != "" {
+			continue
+		}
+		patch := struct {
+			User *string `json:"user_id"`
+		}{}
+		if json.Unmarshal([]byte(event.Payload), &patch) == nil && patch.User != nil {
+			owner = *patch.User
+		}
+	}
+	return owner
+}
+
+// newID returns a random 128-bit identifier in hex.
+func newID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// testJournal returns managers whose journeys and trips are recorded
+// in the journal, with the user u1 and the rooms a, b and c stored.
+func testJournal() (*MemoryStore, JourneyManager, TripManager) {
+	ctx := context.Background()
+	memory := NewMemoryStore()
+	for i, id := range []string{"a", "b", "c"} {
+		memory.PutRoom(ctx, Room{ID: id, Name: id, Pose: Pose{X: 10 * i}})
+	}
+	memory.PutUser(ctx, User{ID: "u1", FirstName: "Ada"})
+	store := journalStore{Store: memory}
+	outbox := Outbox{publisher: NewLocalBus(), transactor: store, commands: store, trips: store, journeys: store}
+	journeys := JourneyManager{outbox: outbox, hub: NewHub(), commands: store, events: store, transactor: store, journeys: store, users: store, trips: store, rooms: store}
+	trips := TripManager{outbox: outbox, transactor: store, trips: store, journeys: store, rooms: store}
+	return memory, journeys, trips
+}
+
+func createTestTrip(t *testing.T, trips TripManager, trip Trip) {
+	t.Helper()
+	if err := trips.transactor.RunInTransaction(context.Background(), func(ctx context.Context) error {
+		return trips.createTrip(ctx, trip)
+	}); err != nil {
+		t.Fatalf("createTrip %s: %v", trip.ID, err)
+	}
+}
+
+func TestOwnsTimeline(t *testing.T) {
+	ctx := context.Background()
+	store, journeys, _ := testJournal()
+	if err := journeys.transactor.RunInTransaction(ctx, func(ctx context.Context) error {
+		return journeys.createJourney(ctx, Journey{ID: "j1", User: "u1", Name: "Tour", State: JourneyPlanned})
+	}); err != nil {
+		t.Fatalf("createJourney: %v", err)
+	}
+	owns := OwnsTimeline(store, store, "journeyid")
+	allowed := func(subject string) bool {
+		r := httptest.NewRequest(http.MethodGet, "/journeys/j1/timeline", nil)
+		r = mux.SetURLVars(r, map[string]string{"journeyid": "j1"})
+		r = r.WithContext(WithPrincipal(r.Context(), Principal{Kind: PrincipalUser, Subject: subject}))
+		return owns(r)
+	}
+
+	if !allowed("u1") || allowed("u2") {
+		t.Errorf("before the deletion u1 allowed %v, u2 allowed %v, want only u1", allowed("u1"), allowed("u2"))
+	}
+	if err := journeys.transactor.RunInTransaction(ctx, func(ctx context.Context) error {
+		_, err := journeys.deleteJourney(ctx, "j1")
+		return err
+	}); err != nil {
+		t.Fatalf("deleteJourney: %v", err)
+	}
+	if !allowed("u1") || allowed("u2") {
+		t.Errorf("after the deletion u1 allowed %v, u2 allowed %v, want only u1", allowed("u1"), allowed("u2"))
+	}
+}
+
+func TestJournalSequences(t *testing.T) {
+	ctx := context.Background()
+	store, journeys, trips := testJournal()
+	for _, id := range []string{"j1", "j2"} {
+		if err := journeys.transactor.RunInTransaction(ctx, func(ctx context.Context) error {
+			return journeys.createJourney(ctx, Journey{ID: id, User: "u1", Name: id, State: JourneyPlanned})
+		}); err != nil {
+			t.Fatalf("createJourney %s: %v", id, err)
+		}
+	}
+	// Interleave the changes to both journeys, several to a journey in
+	// one transaction.
+	for i, id := range []string{"t1", "t2", "t3"} {
+		journeyID := []string{"j1", "j2", "j1"}[i]
+		createTestTrip(t, trips, Trip{ID: id, JourneyID: journeyID, StartRoom: "a", EndRoom: "b", State: TripPlanned})
+	}
+	if err := journeys.transactor.RunInTransaction(ctx, func(ctx context.Context) error {
+		_, err := journeys.endJourney(ctx, "j1", JourneyAborted)
+		return err
+	}); err != nil {
+		t.Fatalf("endJourney: %v", err)
+	}
+
+	for _, id := range []string{"j1", "j2"} {
+		events, _ := store.JourneyEvents(ctx, id)
+		if len(events) < 2 {
+			t.Fatalf("%s has %d events, want its creation and its trips", id, len(events))
+		}
+		for i, event := range events {
+			if event.Sequence != int64(i+1) {
+				t.Errorf("%s event %d (%s) has sequence %d, want %d", id, i, event.Type, event.Sequence, i+1)
+			}
+		}
+		if journey, _ := store.GetJourney(ctx, id); journey.LastSequence != int64(len(events)) {
+			t.Errorf("%s LastSequence = %d, want %d", id, journey.LastSequence, len(events))
+		}
+	}
+}
+
+func TestRebuildJourney(t *testing.T) {
+	ctx := context.Background()
+	store, journeys, trips := testJournal()
+	in := func(f func(ctx context.Context) error) {
+		t.Helper()
+		if err := journeys.transactor.RunInTransaction(ctx, f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	in(func(ctx context.Context) error {
+		return journeys.createJourney(ctx, Journey{ID: "j1", User: "u1", Name: "Tour", State: JourneyPlanned})
+	})
+	createTestTrip(t, trips, Trip{ID: "t1", JourneyID: "j1", StartRoom: "a", EndRoom: "b", State: TripPlanned})
+	createTestTrip(t, trips, Trip{ID: "t2", JourneyID: "j1", StartRoom: "b", EndRoom: "c", State: TripPlanned})
+	in(func(ctx context.Context) error {
+		_, err := journeys.startJourney(ctx, "j1")
+		return err
+	})
+	for _, step := range []func(ctx context.Context, tripID string) (Trip, error){trips.completeTrip, trips.startTrip, trips.completeTrip} {
+		tripID := "t1"
+		if journey, _ := store.GetJourney(ctx, "j1"); journey.LatestTrip != "" {
+			tripID = journey.LatestTrip
+		}
+		in(func(ctx context.Context) error {
+			_, err := step(ctx, tripID)
+			return err
+		})
+	}
+
+	stored, _ := store.GetJourney(ctx, "j1")
+	if stored.CurrentState() != JourneyCompleted {
+		t.Fatalf("journey is %s, want completed", stored.CurrentState())
+	}
+	events, _ := store.JourneyEvents(ctx, "j1")
+	rebuilt, err := rebuildJourney("j1", events)
+	if err != nil {
+		t.Fatalf("rebuildJourney: %v", err)
+	}
+	stored.LastSequence = 0
+	if !reflect.DeepEqual(rebuilt, stored) {
+		t.Errorf("rebuilt journey = %+v, want %+v", rebuilt, stored)
+	}
+
+	in(func(ctx context.Context) error {
+		_, err := journeys.deleteJourney(ctx, "j1")
+		return err
+	})
+	events, _ = store.JourneyEvents(ctx, "j1")
+	if _, err := rebuildJourney("j1", events); err == nil {
+		t.Error("rebuilding a deleted journey succeeded")
+	}
+}
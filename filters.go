@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// IsAdmin allows operators.
+func IsAdmin(r *http.Request) bool {
+	principal, ok := PrincipalFrom(r.Context())
+	return ok && principal.Kind == PrincipalOperator
+}
+
+// IsRobot allows robots.
+func IsRobot(r *http.Request) bool {
+	principal, ok := PrincipalFrom(r.Context())
+	return ok && principal.Kind == PrincipalRobot
+}
+
+// IsSelf allows the user whose ID is in the given path variable.
+func IsSelf(variable string) RequestFilter {
+	return func(r *http.Request) bool {
+		return isUser(r, mux.Vars(r)[variable])
+	}
+}
+
+// IsSelfInBody allows the user whose ID is in the given field of the
+// JSON body, for requests creating something on a user's behalf.
+func IsSelfInBody(field string) RequestFilter {
+	return func(r *http.Request) bool {
+		return isUser(r, bodyField(r, field))
+	}
+}
+
+// IsSelfInQuery allows the user whose ID is in the given query
+// parameter, for listing a user's own entities.
+func IsSelfInQuery(param string) RequestFilter {
+	return func(r *http.Request) bool {
+		return isUser(r, r.URL.Query().Get(param))
+	}
+}
+
+// OwnsJourney allows the user the journey whose ID is in the given
+// path variable belongs to. Missing journeys are not owned by anyone,
+// so that their existence is not revealed.
+func OwnsJourney(journeys JourneyStore, variable string) RequestFilter {
+	return func(r *http.Request) bool {
+		return ownsJourney(r, journeys, mux.Vars(r)[variable])
+	}
+}
+
+// OwnsJourneyInBody allows the user owning the journey whose ID is in
+// the given field of the JSON body.
+func OwnsJourneyInBody(journeys JourneyStore, field string) RequestFilter {
+	return func(r *http.Request) bool {
+		return ownsJourney(r, journeys, bodyField(r, field))
+	}
+}
+
+// OwnsJourneyInQuery allows the user owning the journey whose ID is
+// in the given query parameter.
+func OwnsJourneyInQuery(journeys JourneyStore, param string) RequestFilter {
+	return func(r *http.Request) bool {
+		return ownsJourney(r, journeys, r.URL.Query().Get(param))
+	}
+}
+
+// OwnsTrip allows the user owning the journey of the trip whose ID is
+// in the given path variable.
+func OwnsTrip(trips TripStore, journeys JourneyStore, variable string) RequestFilter {
+	return func(r *http.Request) bool {
+		trip, dataErr := trips.GetTrip(r.Context(), mux.Vars(r)[variable])
+		return dataErr == nil && ownsJourney(r, journeys, trip.JourneyID)
+	}
+}
+
+// OwnsTimeline allows the user owning the journey whose ID is in the
+// given path variable or, once it has been deleted, the user its
+// events record it belonged to, as its timeline outlives it.
+func OwnsTimeline(journeys JourneyStore, events EventStore, variable string) RequestFilter {
+	return func(r *http.Request) bool {
+		journeyID := mux.Vars(r)[variable]
+		if journeyID == "" {
+			return false
+		}
+		journey, dataErr := journeys.GetJourney(r.Context(), journeyID)
+		if dataErr == nil {
+			return isUser(r, journey.User)
+		} else if dataErr != ErrJourneyMissing {
+			return false
+		}
+		journeyEvents, dataErr := events.JourneyEvents(r.Context(), journeyID)
+		return dataErr == nil && isUser(r, journeyOwner(journeyEvents))
+	}
+}
+
+// AnyOf creates a RequestFilter that is the disjunction of filters,
+// the counterpart of Filters.Combine.
+func AnyOf(filters ...RequestFilter) RequestFilter {
+	return func(r *http.Request) bool {
+		for _, filter := range filters {
+			if filter(r) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func isUser(r *http.Request, userID string) bool {
+	principal, ok := PrincipalFrom(r.Context())
+	return ok && principal.Kind == PrincipalUser && userID != "" && principal.Subject == userID
+}
+
+func ownsJourney(r *http.Request, journeys JourneyStore, journeyID string) bool {
+	if journeyID == "" {
+		return false
+	}
+	journey, dataErr := journeys.GetJourney(r.Context(), journeyID)
+	return dataErr == nil && isUser(r, journey.User)
+}
+
+// bodyField returns the string field of the JSON object in the body
+// of r, leaving the body to be read again by the handler.
+func bodyField(r *http.Request, field string) string {
+	body, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return ""
+	}
+	object := map[string]interface{}{}
+	if json.Unmarshal(body, &object) != nil {
+		return ""
+	}
+	value, _ := object[field].(string)
+	return value
+}
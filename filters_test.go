@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRouteFilters(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	store.PutUser(ctx, User{ID: "u1", FirstName: "Ada", Journeys: []string{"j1"}})
+	store.PutUser(ctx, User{ID: "u2", FirstName: "Grace"})
+	store.PutJourney(ctx, Journey{ID: "j1", User: "u1", State: JourneyPlanned, Trips: []string{"t1"}})
+	store.PutTrip(ctx, Trip{ID: "t1", JourneyID: "j1", StartRoom: "r1", EndRoom: "r1", State: TripPlanned})
+	store.PutRoom(ctx, Room{ID: "r1", Name: "Library"})
+	authenticator := testAuthenticator(t, AuthConfig{})
+	handler, err := NewServer(store, NewLocalBus(), authenticator).Handler()
+	if err != nil {
+		t.Fatalf("Handler: %v", err)
+	}
+	tokens := map[string]string{}
+	for _, principal := range []Principal{
+		{Kind: PrincipalUser, Subject: "u1"},
+		{Kind: PrincipalUser, Subject: "u2"},
+		{Kind: PrincipalRobot, Subject: "r"},
+		{Kind: PrincipalOperator, Subject: "o"},
+	} {
+		tokens[principal.Subject], _ = authenticator.Issue(principal, time.Hour, time.Now())
+	}
+
+	tests := []struct {
+		caller, method, path, body string
+		status                     int
+	}{
+		{"", http.MethodGet, "/journeys/j1", "", http.StatusUnauthorized},
+
+		// Journeys and trips are their owner's.
+		{"u1", http.MethodGet, "/journeys/j1", "", http.StatusOK},
+		{"u2", http.MethodGet, "/journeys/j1", "", http.StatusForbidden},
+		{"o", http.MethodGet, "/journeys/j1", "", http.StatusOK},
+		{"u1", http.MethodGet, "/journeys/j9", "", http.StatusForbidden},
+		{"u2", http.MethodGet, "/journeys/j1/commands", "", http.StatusForbidden},
+		{"u2", http.MethodDelete, "/journeys/j1", "", http.StatusForbidden},
+		{"u1", http.MethodGet, "/trips/t1", "", http.StatusOK},
+		{"u2", http.MethodGet, "/trips/t1", "", http.StatusForbidden},
+		{"u2", http.MethodPost, "/trips", `{"journey_id": "j1", "start": "r1", "end": "r1"}`, http.StatusForbidden},
+		{"u2", http.MethodPost, "/journeys", `{"user_id": "u1", "name": "Tour"}`, http.StatusForbidden},
+
+		// Rooms are read by anyone and changed by operators.
+		{"u1", http.MethodGet, "/rooms/r1", "", http.StatusOK},
+		{"u1", http.MethodPost, "/rooms", `{"name": "Lab"}`, http.StatusForbidden},
+		{"r", http.MethodPost, "/rooms", `{"name": "Lab"}`, http.StatusForbidden},
+		{"u1", http.MethodPatch, "/rooms/r1", `{"name": "Lab"}`, http.StatusForbidden},
+		{"u1", http.MethodDelete, "/rooms/r1", "", http.StatusForbidden},
+		{"o", http.MethodPost, "/rooms", `{"name": "Lab"}`, http.StatusCreated},
+
+		// Only the robot reports what it did.
+		{"u1", http.MethodPost, "/robot/events", `{"type": "battery", "version": 1, "payload": {"percent": 50}}`, http.StatusForbidden},
+		{"o", http.MethodPost, "/robot/events", `{"type": "battery", "version": 1, "payload": {"percent": 50}}`, http.StatusForbidden},
+		{"r", http.MethodPost, "/robot/events", `{"type": "battery", "version": 1, "payload": {"percent": 50}}`, http.StatusOK},
+		{"u1", http.MethodPost, "/trips/t1/complete", "", http.StatusForbidden},
+		{"o", http.MethodPost, "/trips/t1/fail", "", http.StatusForbidden},
+		{"r", http.MethodPost, "/trips/t1/complete", "", http.StatusConflict},
+		{"u1", http.MethodGet, "/robot/status", "", http.StatusForbidden},
+		{"r", http.MethodGet, "/robot/status", "", http.StatusOK},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, test.path, strings.NewReader(test.body))
+		if test.caller != "" {
+			r.Header.Set("Authorization", "Bearer "+tokens[test.caller])
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s %s as %q: status %d, want %d", test.method, test.path, test.caller, w.Code, test.status)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// crockford is the Crockford base32 alphabet ULIDs are written in.
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// newULID returns a ULID for now: a millisecond timestamp followed by
+// 80 random bits, so that IDs minted later sort after earlier ones.
+func newULID(now time.Time) (string, error) {
+	id := make([]byte, 16)
+	ms := uint64(now.UnixNano() / int64(time.Millisecond))
+	for i := 5; i >= 0; i-- {
+		id[i] = byte(ms)
+		ms >>= 8
+	}
+	if _, err := rand.Read(id[6:]); err != nil {
+		return "", err
+	}
+	// 26 characters of 5 bits each, the first holding the top 3 bits.
+	hi, lo := binary.BigEndian.Uint64(id[:8]), binary.BigEndian.Uint64(id[8:])
+	encoded := make([]byte, 26)
+	for i := len(encoded) - 1; i >= 0; i-- {
+		encoded[i] = crockford[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(encoded), nil
+}
+
+// entityID returns the ID in the given path variable of r, which
+// clients choose when creating with PUT, or mints a ULID for a POST
+// to the collection.
+func entityID(r *http.Request, variable string) (string, error) {
+	if id := mux.Vars(r)[variable]; id != "" {
+		return id, nil
+	}
+	return newULID(time.Now())
+}
+
+// created answers a create with 201 and the Location of the entity.
+func created(w http.ResponseWriter, location string) {
+	w.Header().Set("Location", location)
+	w.WriteHeader(http.StatusCreated)
+}
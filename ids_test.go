@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestNewULID(t *testing.T) {
+	now := time.Unix(1700000000, 123e6)
+	id, err := newULID(now)
+	if err != nil {
+		t.Fatalf("newULID: %v", err)
+	}
+	if len(id) != 26 {
+		t.Fatalf("ULID %q has %d characters, want 26", id, len(id))
+	}
+	for _, c := range id {
+		if !strings.ContainsRune(crockford, c) {
+			t.Fatalf("ULID %q has %q, which is not Crockford base32", id, c)
+		}
+	}
+	// The first 10 characters hold the 48-bit millisecond timestamp.
+	var ms int64
+	for _, c := range id[:10] {
+		ms = ms<<5 | int64(strings.IndexRune(crockford, c))
+	}
+	if want := now.UnixNano() / int64(time.Millisecond); ms != want {
+		t.Errorf("ULID %q holds %d ms, want %d", id, ms, want)
+	}
+
+	other, _ := newULID(now)
+	if other == id {
+		t.Errorf("two ULIDs for the same time are both %q", id)
+	}
+}
+
+func TestNewULIDSorts(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	previous, _ := newULID(start)
+	for _, step := range []time.Duration{time.Millisecond, time.Second, time.Hour, 24 * 365 * time.Hour} {
+		id, err := newULID(start.Add(step))
+		if err != nil {
+			t.Fatalf("newULID: %v", err)
+		}
+		if id <= previous {
+			t.Errorf("ULID %q minted %s later sorts before %q", id, step, previous)
+		}
+		previous, start = id, start.Add(step)
+	}
+}
+
+func TestEntityID(t *testing.T) {
+	r := mux.SetURLVars(httptest.NewRequest(http.MethodPut, "/users/ada", nil), map[string]string{"userid": "ada"})
+	if id, err := entityID(r, "userid"); err != nil || id != "ada" {
+		t.Errorf("entityID of PUT /users/ada = %q, %v, want ada", id, err)
+	}
+	r = httptest.NewRequest(http.MethodPost, "/users", nil)
+	if id, err := entityID(r, "userid"); err != nil || len(id) != 26 {
+		t.Errorf("entityID of POST /users = %q, %v, want a ULID", id, err)
+	}
+
+	w := httptest.NewRecorder()
+	created(w, "/users/ada")
+	if w.Code != http.StatusCreated || w.Header().Get("Location") != "/users/ada" {
+		t.Errorf("created answered %d at %q, want 201 at /users/ada", w.Code, w.Header().Get("Location"))
+	}
+}
@@ -1,23 +1,38 @@
 package main
 
 import (
-	"reflect"
+	"context"
 	"net/http"
 	"github.com/gorilla/mux"
 	"encoding/json"
-	"appengine"
-	"appengine/datastore"
-	"errors"
 	"time"
+	"fmt"
+
+	"github.com/gorilla/websocket"
 )
 
 var (
-	ErrJourneyAlreadyExists = errors.New("journey already exists")
-	ErrJourneyMissing = errors.New("journey does not exist")
+	ErrJourneyEmpty = &Error{Code: CodeConflict, Entity: "journey", Message: "journey has no trips left to start"}
+	ErrJourneyNotActive = &Error{Code: CodeConflict, Entity: "journey", Message: "journey is not active"}
+	ErrJourneyActive = &Error{Code: CodeConflict, Entity: "journey", Message: "journey is active"}
+	ErrJourneyEnded = &Error{Code: CodeConflict, Entity: "journey", Message: "journey has ended"}
+	ErrJourneyFull = &Error{Code: CodeConflict, Entity: "journey", Message: "journey has too many trips"}
+	ErrJourneyAlreadyExists = &Error{Code: CodeConflict, Entity: "journey", Message: "journey already exists"}
+	ErrJourneyMissing = &Error{Code: CodeNotFound, Entity: "journey", Message: "journey does not exist"}
 )
 
 type JourneyManager struct {
-	pubnubManager *PubnubManager
+	outbox Outbox
+	hub *Hub
+	commands CommandStore
+	events EventStore
+	transactor Transactor
+	journeys JourneyStore
+	users UserStore
+	trips TripStore
+	rooms RoomStore
+	maps MapManager
+	robot *robotStatus
 }
 
 type Journey struct {
@@ -29,27 +44,140 @@ type Journey struct {
 	Trips []string `datastore:"trips" json:"trips"`
 	LatestTrip string `datastore:"latest_trip" json:"latest_trip"`
 	Finished bool `datastore:"finished"`
+	State JourneyState `datastore:"state" json:"state"`
+	AutoAdvance bool `datastore:"auto_advance" json:"auto_advance"`
+	CreatedAt int64 `datastore:"created_at" json:"created_at"`
+	// LastSequence is the Sequence of the journey's latest event.
+	LastSequence int64 `datastore:"last_sequence,noindex" json:"-"`
 }
 
+// JourneyPatchFields lists the fields of a Journey clients may change.
+// Everything else is maintained by the journey's lifecycle.
+var JourneyPatchFields = []string{"name", "auto_advance"}
+
+// JourneyCreateFields lists the fields clients may set when creating
+// a Journey.
+var JourneyCreateFields = append([]string{"user_id"}, JourneyPatchFields...)
+
+// maxJourneyTrips caps the trips of a journey. Aborting or deleting it
+// changes every trip in one transaction, which the datastore limits to
+// 25 entity groups, and the journey and its user take two more.
+const maxJourneyTrips = 20
+
 func (manager JourneyManager) Group() Group {
+	owner := Filters{AnyOf(IsAdmin, OwnsJourney(manager.journeys, "journeyid"))}
+	creator := Filters{AnyOf(IsAdmin, IsSelfInBody("user_id"))}
+	historian := Filters{AnyOf(IsAdmin, OwnsTimeline(manager.journeys, manager.events, "journeyid"))}
+	return Group{
+		Paths: Routes{
+			"": Methods{
+				http.MethodGet: Route{
+					Handler: manager.ListJourneys,
+					Allow: Filters{AnyOf(IsAdmin, IsSelfInQuery("user_id"))},
+				},
+				http.MethodPost: Route{
+					Handler: manager.CreateJourney,
+					Allow: creator,
+				},
+			},
+			"plan": Route{
+				Methods: []string{http.MethodPost},
+				Handler: manager.PlanJourney,
+				Allow: creator,
+			},
+			"{journeyid}": Methods{
+				http.MethodGet: Route{
+					Handler: manager.GetJourney,
+					Allow: owner,
+				},
+				http.MethodPut: Route{
+					Handler: manager.ReplaceJourney,
+					Allow: creator,
+				},
+				http.MethodPatch: Route{
+					Handler: manager.SetJourney,
+					Allow: owner,
+				},
+				http.MethodDelete: Route{
+					Handler: manager.DelJourney,
+					Allow: owner,
+				},
+			},
+			"{journeyid}/start": Route{
+				Methods: []string{http.MethodPost},
+				Handler: manager.StartJourney,
+				Allow: owner,
+			},
+			"{journeyid}/complete": Route{
+				Methods: []string{http.MethodPost},
+				Handler: manager.CompleteJourney,
+				Allow: owner,
+			},
+			"{journeyid}/abort": Route{
+				Methods: []string{http.MethodPost},
+				Handler: manager.AbortJourney,
+				Allow: owner,
+			},
+			"{journeyid}/commands": Route{
+				Methods: []string{http.MethodGet},
+				Handler: manager.GetCommands,
+				Allow: owner,
+			},
+			"{journeyid}/events": Route{
+				Methods: []string{http.MethodGet},
+				Handler: manager.Events,
+				Allow: owner,
+			},
+			"{journeyid}/timeline": Route{
+				Methods: []string{http.MethodGet},
+				Handler: manager.GetTimeline,
+				Allow: historian,
+			},
+			"{journeyid}/rebuild": Route{
+				Methods: []string{http.MethodGet},
+				Handler: manager.RebuildJourney,
+				Allow: historian,
+			},
+		},
+	}
+}
+
+// LegacyGroup serves the action-suffixed paths used by the existing
+// robot and app clients. Each of them answers to any method.
+func (manager JourneyManager) LegacyGroup() Group {
+	owner := Filters{AnyOf(IsAdmin, OwnsJourney(manager.journeys, "journeyid"))}
+	creator := Filters{AnyOf(IsAdmin, IsSelfInBody("user_id"))}
 	return Group{
 		Paths: Routes{
 			"{journeyid}/": Group{
 				Paths: Routes{
 					"get": Route{
 						Handler: manager.GetJourney,
+						Allow: owner,
 					},
 					"create": Route{
 						Handler: manager.CreateJourney,
+						Allow: creator,
 					},
-					"delete": Route{
+					"del": Route{
 						Handler: manager.DelJourney,
+						Allow: owner,
 					},
 					"set": Route{
 						Handler: manager.SetJourney,
+						Allow: owner,
+					},
+					"start": Route{
+						Handler: manager.StartJourney,
+						Allow: owner,
 					},
 					"complete": Route{
 						Handler: manager.CompleteJourney,
+						Allow: owner,
+					},
+					"events": Route{
+						Handler: manager.Events,
+						Allow: owner,
 					},
 				},
 			},
@@ -57,177 +185,488 @@ func (manager JourneyManager) Group() Group {
 	}
 }
 
+// journeyListParams filter journeys by user and state.
+var journeyListParams = []listParam{
+	stringParam("user_id", "user_id"),
+	{name: "state", property: "state", parse: func(value string) (interface{}, error) {
+		switch JourneyState(value) {
+		case JourneyPlanned, JourneyActive, JourneyCompleted, JourneyAborted:
+			return value, nil
+		}
+		return nil, fmt.Errorf("must be one of %s, %s, %s or %s", JourneyPlanned, JourneyActive, JourneyCompleted, JourneyAborted)
+	}},
+}
+
+// ListJourneys serves a page of journeys. Users may only list their
+// own, by passing their ID as user_id.
+func (manager JourneyManager) ListJourneys(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	encoder := json.NewEncoder(w)
+
+	query, queryErr := parseListQuery(r, journeyListParams)
+	if queryErr != nil {
+		WriteError(w, queryErr)
+		return
+	}
+	journeys, next, dataErr := manager.journeys.ListJourneys(ctx, query)
+	if dataErr != nil {
+		WriteError(w, dataErr)
+		return
+	}
+	encoder.Encode(ResponsePage{Items: journeys, NextCursor: next})
+}
+
 func (manager JourneyManager) CreateJourney(w http.ResponseWriter, r *http.Request) {
-	ctx := appengine.NewContext(r)
-	journeyID := mux.Vars(r)["journeyid"]
+	ctx := r.Context()
 	encoder := json.NewEncoder(w)
-	decoder := json.NewDecoder(r.Body)
+
+	journeyID, idErr := entityID(r, "journeyid")
+	if idErr != nil {
+		WriteError(w, idErr)
+		return
+	}
 
 	journey := Journey{}
-	key := datastore.NewKey(ctx, "journey", journeyID, 0, nil)
-	dataErr := datastore.Get(ctx, key, &journey)
-	if dataErr == nil {
-		encoder.Encode(ResponseError{Error: ErrJourneyAlreadyExists.Error()})
+	if bodyErr := readFields(r, &journey, JourneyCreateFields); bodyErr != nil {
+		WriteError(w, bodyErr)
+		return
+	}
+	if validErr := manager.validate(ctx, journey); validErr != nil {
+		WriteError(w, validErr)
 		return
-	} else if dataErr != datastore.ErrNoSuchEntity {
-		encoder.Encode(ResponseError{Error: dataErr.Error()})
+	}
+	journey.ID = journeyID
+	journey.State = JourneyPlanned
+	journey.CreatedAt = time.Now().UTC().Unix()
+	if txErr := manager.transactor.RunInTransaction(ctx, func(ctx context.Context) error {
+		return manager.createJourney(ctx, journey)
+	}); txErr != nil {
+		WriteError(w, txErr)
 		return
 	}
-	decoder.Decode(&journey)
-	user := &User{}
-	userKey := datastore.NewKey(ctx, "user", journey.User, 0, nil)
-	userDataErr := datastore.Get(ctx, userKey, user)
+	created(w, "/journeys/"+journey.ID)
+	encoder.Encode(journey)
+}
+
+// createJourney stores journey and lists it on its user.
+func (manager JourneyManager) createJourney(ctx context.Context, journey Journey) error {
+	_, dataErr := manager.journeys.GetJourney(ctx, journey.ID)
+	if dataErr == nil {
+		return withID(ErrJourneyAlreadyExists, journey.ID)
+	} else if dataErr != ErrJourneyMissing {
+		return dataErr
+	}
+	user, userDataErr := manager.users.GetUser(ctx, journey.User)
 	if userDataErr != nil {
-		if userDataErr != datastore.ErrNoSuchEntity {
-			encoder.Encode(ResponseError{Error: userDataErr.Error()})
-			return
+		return withID(userDataErr, journey.User)
+	}
+	user.Journeys = append(user.Journeys, journey.ID)
+	if dataErr := manager.journeys.PutJourney(ctx, journey); dataErr != nil {
+		return dataErr
+	}
+	return manager.users.PutUser(ctx, user)
+}
+
+// ReplaceJourney creates the journey with the ID in the path or, if
+// there is one, replaces every field clients may set, so that sending
+// the same body again changes nothing. A journey cannot move to
+// another user.
+func (manager JourneyManager) ReplaceJourney(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	journeyID := mux.Vars(r)["journeyid"]
+	encoder := json.NewEncoder(w)
+
+	patch, bodyErr := readReplacement(r, JourneyCreateFields)
+	if bodyErr != nil {
+		WriteError(w, bodyErr)
+		return
+	}
+	journey := Journey{}
+	isNew := false
+	if txErr := manager.transactor.RunInTransaction(ctx, func(ctx context.Context) error {
+		var dataErr error
+		journey, dataErr = manager.journeys.GetJourney(ctx, journeyID)
+		isNew = dataErr == ErrJourneyMissing
+		if isNew {
+			journey = Journey{ID: journeyID, State: JourneyPlanned, CreatedAt: time.Now().UTC().Unix()}
+		} else if dataErr != nil {
+			return withID(dataErr, journeyID)
+		} else if fixedErr := checkFixed(&journey, patch, "user_id"); fixedErr != nil {
+			return fixedErr
+		}
+		if patchErr := applyPatch(&journey, patch); patchErr != nil {
+			return patchErr
+		}
+		if validErr := manager.validate(ctx, journey); validErr != nil {
+			return validErr
 		}
-		encoder.Encode(ResponseError{Error: ErrUserMissing.Error()})
+		if isNew {
+			return manager.createJourney(ctx, journey)
+		}
+		return manager.journeys.PutJourney(ctx, journey)
+	}); txErr != nil {
+		WriteError(w, txErr)
 		return
 	}
-	user.Journeys = append(user.Journeys, journey.ID)
-	journey.ID = journeyID
-	datastore.Put(ctx, key, journey)
-	datastore.Put(ctx, userKey, user)
+	if isNew {
+		created(w, "/journeys/"+journey.ID)
+	}
 	encoder.Encode(journey)
 }
 
 func (manager JourneyManager) GetJourney(w http.ResponseWriter, r *http.Request) {
-	ctx := appengine.NewContext(r)
+	ctx := r.Context()
 	journeyID := mux.Vars(r)["journeyid"]
 	encoder := json.NewEncoder(w)
-	decoder := json.NewDecoder(r.Body)
 
-	journey := Journey{}
-	key := datastore.NewKey(ctx, "journey", journeyID, 0, nil)
-	dataErr := datastore.Get(ctx, key, &journey)
+	journey, dataErr := manager.journeys.GetJourney(ctx, journeyID)
 	if dataErr != nil {
-		if dataErr != datastore.ErrNoSuchEntity {
-			encoder.Encode(ResponseError{Error: dataErr.Error()})
-			return
-		}
-		encoder.Encode(ResponseError{Error: ErrJourneyMissing.Error()})
+		WriteError(w, withID(dataErr, journeyID))
 		return
 	}
-	decoder.Decode(&journey)
 	encoder.Encode(journey)
 }
 
 func (manager JourneyManager) DelJourney(w http.ResponseWriter, r *http.Request) {
-	ctx := appengine.NewContext(r)
-	journeyID := mux.Vars(r)["journeyid"]
 	encoder := json.NewEncoder(w)
 
-	key := datastore.NewKey(ctx, "journey", journeyID, 0, nil)
-	dataErr := datastore.Delete(ctx, key)
-	if dataErr != nil {
-		if dataErr != datastore.ErrInvalidKey {
-			encoder.Encode(ResponseError{Error: dataErr.Error()})
-			return
-		}
-		encoder.Encode(ResponseError{Error: ErrJourneyMissing.Error()})
+	if _, ok := manager.runTransition(w, r, manager.deleteJourney); !ok {
 		return
 	}
 	encoder.Encode(ResponseSuccess{Success: true})
 }
 
+// deleteJourney removes the journey with its trips and unlists it from
+// its user. An active journey has to be aborted first, so the robot is
+// stopped. Its events are kept, as the timeline outlives the journey.
+func (manager JourneyManager) deleteJourney(ctx context.Context, journeyID string) (Journey, error) {
+	journey, dataErr := manager.journeys.GetJourney(ctx, journeyID)
+	if dataErr != nil {
+		return journey, withID(dataErr, journeyID)
+	}
+	if journey.CurrentState() == JourneyActive {
+		return journey, withID(ErrJourneyActive, journeyID)
+	}
+	for _, tripID := range journey.Trips {
+		trip, dataErr := manager.trips.GetTrip(ctx, tripID)
+		if dataErr == ErrTripMissing || (dataErr == nil && trip.JourneyID != journeyID) {
+			continue
+		} else if dataErr != nil {
+			return journey, withID(dataErr, tripID)
+		}
+		if dataErr := manager.trips.DeleteTrip(ctx, tripID); dataErr != nil {
+			return journey, withID(dataErr, tripID)
+		}
+	}
+	user, userDataErr := manager.users.GetUser(ctx, journey.User)
+	if userDataErr == nil {
+		user.Journeys = without(user.Journeys, journeyID)
+		if user.LatestJourney == journeyID {
+			user.LatestJourney = ""
+		}
+		if dataErr := manager.users.PutUser(ctx, user); dataErr != nil {
+			return journey, dataErr
+		}
+	} else if userDataErr != ErrUserMissing {
+		return journey, userDataErr
+	}
+	return journey, manager.journeys.DeleteJourney(ctx, journeyID)
+}
+
 func (manager JourneyManager) SetJourney(w http.ResponseWriter, r *http.Request) {
-	ctx := appengine.NewContext(r)
+	ctx := r.Context()
 	journeyID := mux.Vars(r)["journeyid"]
 	encoder := json.NewEncoder(w)
-	decoder := json.NewDecoder(r.Body)
 
-	journey := &Journey{}
-	key := datastore.NewKey(ctx, "journey", journeyID, 0, nil)
-	dataErr := datastore.Get(ctx, key, journey)
-	if dataErr != nil {
-		if dataErr != datastore.ErrNoSuchEntity {
-			encoder.Encode(ResponseError{Error: dataErr.Error()})
-			return
+	patch, bodyErr := readPatch(r, JourneyPatchFields)
+	if bodyErr != nil {
+		WriteError(w, bodyErr)
+		return
+	}
+	journey := Journey{}
+	if txErr := manager.transactor.RunInTransaction(ctx, func(ctx context.Context) error {
+		var dataErr error
+		if journey, dataErr = manager.journeys.GetJourney(ctx, journeyID); dataErr != nil {
+			return withID(dataErr, journeyID)
+		}
+		if patchErr := applyPatch(&journey, patch); patchErr != nil {
+			return patchErr
+		}
+		if validErr := manager.validate(ctx, journey); validErr != nil {
+			return validErr
 		}
-		encoder.Encode(ResponseError{Error: ErrJourneyMissing.Error()})
+		return manager.journeys.PutJourney(ctx, journey)
+	}); txErr != nil {
+		WriteError(w, txErr)
 		return
 	}
-	updatedJourney := Journey{}
-	decoder.Decode(updatedJourney)
-	journey.MergeInPlace(updatedJourney)
-	datastore.Put(ctx, key, journey)
-	encoder.Encode(*journey)
+	encoder.Encode(journey)
 }
 
 func (manager JourneyManager) StartJourney(w http.ResponseWriter, r *http.Request) {
-	ctx := appengine.NewContext(r)
+	if journey, ok := manager.runTransition(w, r, manager.startJourney); ok {
+		manager.outbox.flush(r.Context())
+		json.NewEncoder(w).Encode(journey)
+	}
+}
+
+// startJourney activates the journey, starts its first trip that has
+// not been cancelled and sends the robot on it.
+func (manager JourneyManager) startJourney(ctx context.Context, journeyID string) (Journey, error) {
+	journey, dataErr := manager.journeys.GetJourney(ctx, journeyID)
+	if dataErr != nil {
+		return journey, withID(dataErr, journeyID)
+	}
+	if transErr := journey.Transition(JourneyActive); transErr != nil {
+		return journey, transErr
+	}
+	user, userDataErr := manager.users.GetUser(ctx, journey.User)
+	if userDataErr != nil {
+		return journey, withID(userDataErr, journey.User)
+	}
+	trip, tripErr := manager.firstTrip(ctx, journey)
+	if tripErr != nil {
+		return journey, tripErr
+	}
+	if transErr := trip.Transition(TripInProgress); transErr != nil {
+		return journey, transErr
+	}
+	now := time.Now().UTC().Unix()
+	user.LatestJourney = journey.ID
+	trip.LeftAt = now
+	journey.StartAt = now
+	journey.LatestTrip = trip.ID
+	if dataErr := manager.trips.PutTrip(ctx, trip); dataErr != nil {
+		return journey, dataErr
+	}
+	if dataErr := manager.journeys.PutJourney(ctx, journey); dataErr != nil {
+		return journey, dataErr
+	}
+	if dataErr := manager.users.PutUser(ctx, user); dataErr != nil {
+		return journey, dataErr
+	}
+	return journey, sendRobot(ctx, manager.outbox, manager.rooms, trip)
+}
+
+// firstTrip finds the first trip of journey that has not ended yet.
+func (manager JourneyManager) firstTrip(ctx context.Context, journey Journey) (Trip, error) {
+	for _, tripID := range journey.Trips {
+		trip, dataErr := manager.trips.GetTrip(ctx, tripID)
+		if dataErr != nil {
+			return trip, withID(dataErr, tripID)
+		}
+		if trip.JourneyID == journey.ID && !trip.Final() {
+			return trip, nil
+		}
+	}
+	return Trip{}, withID(ErrJourneyEmpty, journey.ID)
+}
+
+func (manager JourneyManager) CompleteJourney(w http.ResponseWriter, r *http.Request) {
+	if journey, ok := manager.runTransition(w, r, manager.completeJourney); ok {
+		manager.outbox.flush(r.Context())
+		json.NewEncoder(w).Encode(journey)
+	}
+}
+
+// completeJourney marks an active journey as completed, cancelling the
+// trips it skips and stopping the robot on the trip under way.
+func (manager JourneyManager) completeJourney(ctx context.Context, journeyID string) (Journey, error) {
+	return manager.endJourney(ctx, journeyID, JourneyCompleted)
+}
+
+func (manager JourneyManager) AbortJourney(w http.ResponseWriter, r *http.Request) {
+	if journey, ok := manager.runTransition(w, r, manager.abortJourney); ok {
+		manager.outbox.flush(r.Context())
+		json.NewEncoder(w).Encode(journey)
+	}
+}
+
+// abortJourney aborts the journey and cancels every trip of it
+// that has not ended yet, stopping the robot on the trip under way.
+func (manager JourneyManager) abortJourney(ctx context.Context, journeyID string) (Journey, error) {
+	return manager.endJourney(ctx, journeyID, JourneyAborted)
+}
+
+// endJourney moves the journey to the final state and cancels every
+// trip of it that has not ended yet, so that no trip is left planned
+// or in progress on a finished journey.
+func (manager JourneyManager) endJourney(ctx context.Context, journeyID string, state JourneyState) (Journey, error) {
+	journey, dataErr := manager.journeys.GetJourney(ctx, journeyID)
+	if dataErr != nil {
+		return journey, withID(dataErr, journeyID)
+	}
+	if transErr := journey.Transition(state); transErr != nil {
+		return journey, transErr
+	}
+	if cancelErr := cancelTrips(ctx, manager.outbox, manager.trips, journey, ""); cancelErr != nil {
+		return journey, cancelErr
+	}
+	journey.Finished = true
+	journey.FinishedAt = time.Now().UTC().Unix()
+	return journey, manager.journeys.PutJourney(ctx, journey)
+}
+
+// cancelTrips cancels every trip of journey that has not ended yet,
+// other than the one with ID except, stopping the robot on the trip
+// under way. Trips listed on journey that belong to another journey
+// are left alone.
+func cancelTrips(ctx context.Context, outbox Outbox, trips TripStore, journey Journey, except string) error {
+	for _, tripID := range journey.Trips {
+		if tripID == except {
+			continue
+		}
+		trip, dataErr := trips.GetTrip(ctx, tripID)
+		if dataErr != nil {
+			return withID(dataErr, tripID)
+		}
+		if trip.JourneyID != journey.ID || trip.Final() {
+			continue
+		}
+		interrupted := trip.CurrentState() == TripInProgress
+		if transErr := trip.Transition(TripCancelled); transErr != nil {
+			return withID(transErr, tripID)
+		}
+		if dataErr := trips.PutTrip(ctx, trip); dataErr != nil {
+			return dataErr
+		}
+		if interrupted {
+			if stopErr := stopRobot(ctx, outbox, trip); stopErr != nil {
+				return stopErr
+			}
+		}
+	}
+	return nil
+}
+
+// GetCommands lists the robot commands sent for the journey, oldest
+// first. The status query parameter narrows them down to pending,
+// acknowledged or failed commands.
+func (manager JourneyManager) GetCommands(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
 	journeyID := mux.Vars(r)["journeyid"]
 	encoder := json.NewEncoder(w)
 
-	journey := &Journey{}
-	key := datastore.NewKey(ctx, "journey", journeyID, 0, nil)
-	dataErr := datastore.Get(ctx, key, journey)
+	status := CommandStatus(r.URL.Query().Get("status"))
+	switch status {
+	case "", CommandPending, CommandAcknowledged, CommandFailed:
+	default:
+		WriteError(w, ErrCommandStatusUnknown)
+		return
+	}
+	if _, dataErr := manager.journeys.GetJourney(ctx, journeyID); dataErr != nil {
+		WriteError(w, withID(dataErr, journeyID))
+		return
+	}
+	commands, dataErr := manager.commands.JourneyCommands(ctx, journeyID)
 	if dataErr != nil {
-		if dataErr != datastore.ErrNoSuchEntity {
-			encoder.Encode(ResponseError{Error: dataErr.Error()})
-			return
-		}
-		encoder.Encode(ResponseError{Error: ErrJourneyMissing.Error()})
+		WriteError(w, dataErr)
 		return
 	}
-	user := &User{}
-	userKey := datastore.NewKey(ctx, "user", journey.User, 0, nil)
-	userDataErr := datastore.Get(ctx, userKey, user)
-	if userDataErr != nil {
-		if userDataErr != datastore.ErrNoSuchEntity {
-			encoder.Encode(ResponseError{Error: userDataErr.Error()})
-			return
+	matching := []Command{}
+	for _, command := range commands {
+		if status == "" || command.Status == status {
+			matching = append(matching, command)
 		}
-		encoder.Encode(ResponseError{Error: ErrUserMissing.Error()})
+	}
+	encoder.Encode(matching)
+}
+
+// runTransition runs f on the journey named in r in a transaction,
+// writing the error if it fails.
+func (manager JourneyManager) runTransition(w http.ResponseWriter, r *http.Request, f func(ctx context.Context, journeyID string) (Journey, error)) (Journey, bool) {
+	journeyID := mux.Vars(r)["journeyid"]
+	journey := Journey{}
+	if txErr := manager.transactor.RunInTransaction(r.Context(), func(ctx context.Context) error {
+		var err error
+		journey, err = f(ctx, journeyID)
+		return err
+	}); txErr != nil {
+		WriteError(w, txErr)
+		return journey, false
+	}
+	return journey, true
+}
+
+// GetTimeline lists every recorded change to the journey and its
+// trips, oldest first. It outlives the journey being deleted.
+func (manager JourneyManager) GetTimeline(w http.ResponseWriter, r *http.Request) {
+	journeyID := mux.Vars(r)["journeyid"]
+	encoder := json.NewEncoder(w)
+
+	events, dataErr := manager.events.JourneyEvents(r.Context(), journeyID)
+	if dataErr != nil {
+		WriteError(w, dataErr)
 		return
 	}
-	trip := &Trip{}
-	tripKey := datastore.NewKey(ctx, "trip", journey.LatestTrip, 0, nil)
-	tripDataErr := datastore.Get(ctx, tripKey, trip)
-	if tripDataErr != nil {
-		if tripDataErr != datastore.ErrNoSuchEntity {
-			encoder.Encode(ResponseError{Error: tripDataErr.Error()})
+	if len(events) == 0 {
+		if _, dataErr := manager.journeys.GetJourney(r.Context(), journeyID); dataErr != nil {
+			WriteError(w, withID(dataErr, journeyID))
 			return
 		}
-		encoder.Encode(ResponseError{Error: ErrTripMissing.Error()})
-		return
 	}
-	user.LatestJourney = journey.ID
-	trip.LeftAt = time.Now().UTC().Unix()
-	journey.StartAt = time.Now().UTC().Unix()
-	manager.pubnubManager.PublishJSON(MessageStart{UserID: user.ID, JourneyID: journey.ID})
-	datastore.Put(ctx, tripKey, tripKey)
-	datastore.Put(ctx, key, journey)
-	datastore.Put(ctx, key, journey)
-	encoder.Encode(*journey)
+	encoder.Encode(events)
 }
 
-func (manager JourneyManager) CompleteJourney(w http.ResponseWriter, r *http.Request) {
-	ctx := appengine.NewContext(r)
+// RebuildJourney answers with the journey as replayed from its
+// timeline rather than read from the store.
+func (manager JourneyManager) RebuildJourney(w http.ResponseWriter, r *http.Request) {
 	journeyID := mux.Vars(r)["journeyid"]
 	encoder := json.NewEncoder(w)
 
-	journey := &Journey{}
-	key := datastore.NewKey(ctx, "journey", journeyID, 0, nil)
-	dataErr := datastore.Get(ctx, key, journey)
+	events, dataErr := manager.events.JourneyEvents(r.Context(), journeyID)
 	if dataErr != nil {
-		if dataErr != datastore.ErrNoSuchEntity {
-			encoder.Encode(ResponseError{Error: dataErr.Error()})
-			return
-		}
-		encoder.Encode(ResponseError{Error: ErrJourneyMissing.Error()})
+		WriteError(w, dataErr)
 		return
 	}
-	journey.Finished = true
-	datastore.Put(ctx, key, journey)
-	encoder.Encode(*journey)
+	journey, rebuildErr := rebuildJourney(journeyID, events)
+	if rebuildErr != nil {
+		WriteError(w, rebuildErr)
+		return
+	}
+	encoder.Encode(journey)
 }
 
-func (old *Journey) MergeInPlace(new Journey) {
-	for ii := 0; ii < reflect.TypeOf(old).Elem().NumField(); ii++ {
-		if x := reflect.ValueOf(&new).Elem().Field(ii); !x.IsNil() {
-			reflect.ValueOf(old).Elem().Field(ii).Set(x)
+// Events streams the journey as it is now, then every change to it
+// and its trips along with the robot's position. Requests asking to
+// upgrade get a WebSocket, all others Server-Sent Events.
+func (manager JourneyManager) Events(w http.ResponseWriter, r *http.Request) {
+	journeyID := mux.Vars(r)["journeyid"]
+
+	// Subscribe first so that no change after the read is missed.
+	updates, cancel := manager.hub.Subscribe(journeyID)
+	defer cancel()
+	journey, dataErr := manager.journeys.GetJourney(r.Context(), journeyID)
+	if dataErr != nil {
+		WriteError(w, withID(dataErr, journeyID))
+		return
+	}
+	first := Update{Type: UpdateJourney, JourneyID: journeyID, Data: journey, Timestamp: time.Now().UTC().Unix()}
+	if websocket.IsWebSocketUpgrade(r) {
+		streamWebSocket(w, r, first, updates)
+	} else {
+		streamSSE(w, r, first, updates)
+	}
+}
+
+// Validate reports every field of journey that is missing.
+func (journey Journey) Validate() FieldErrors {
+	errs := FieldErrors{}
+	if journey.User == "" {
+		errs.Add("user_id", "is required")
+	}
+	return errs
+}
+
+// validate checks journey and that the user it belongs to exists.
+func (manager JourneyManager) validate(ctx context.Context, journey Journey) error {
+	errs := journey.Validate()
+	if journey.User != "" {
+		if _, dataErr := manager.users.GetUser(ctx, journey.User); dataErr == ErrUserMissing {
+			errs.Add("user_id", ErrUserMissing.Message)
+		} else if dataErr != nil {
+			return dataErr
 		}
 	}
-}
\ No newline at end of file
+	return errs.Err()
+}
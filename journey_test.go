@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestReplaceJourney(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	for _, id := range []string{"u1", "u2"} {
+		if err := store.PutUser(ctx, User{ID: id, FirstName: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	manager := JourneyManager{transactor: store, journeys: store, users: store, trips: store}
+	put := func(body string) (*httptest.ResponseRecorder, Journey) {
+		r := httptest.NewRequest(http.MethodPut, "/journeys/j1", strings.NewReader(body))
+		r = mux.SetURLVars(r, map[string]string{"journeyid": "j1"})
+		w := httptest.NewRecorder()
+		manager.ReplaceJourney(w, r)
+		var journey Journey
+		json.Unmarshal(w.Body.Bytes(), &journey)
+		return w, journey
+	}
+
+	body := `{"user_id": "u1", "name": "Tour", "auto_advance": true, "trips": ["t9"]}`
+	if w, journey := put(body); w.Code != http.StatusCreated || journey.Name != "Tour" || len(journey.Trips) != 0 {
+		t.Fatalf("first PUT = %d %+v, want 201 with the journey and no trips", w.Code, journey)
+	}
+	if w, journey := put(body); w.Code != http.StatusOK || journey.Name != "Tour" || !journey.AutoAdvance {
+		t.Errorf("resending the PUT = %d %+v, want 200 with the same journey", w.Code, journey)
+	}
+	if w, journey := put(`{"user_id": "u1", "name": "Walk"}`); w.Code != http.StatusOK || journey.Name != "Walk" || journey.AutoAdvance {
+		t.Errorf("replacing = %d %+v, want 200 with auto_advance reset", w.Code, journey)
+	}
+	if w, _ := put(`{"user_id": "u2", "name": "Walk"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("moving the journey to u2 = %d, want 400", w.Code)
+	}
+	if user, _ := store.GetUser(ctx, "u1"); len(user.Journeys) != 1 {
+		t.Errorf("u1 lists journeys %v, want only j1", user.Journeys)
+	}
+	if journey, _ := store.GetJourney(ctx, "j1"); journey.User != "u1" || journey.CreatedAt == 0 {
+		t.Errorf("stored journey = %+v, want u1's with its creation time", journey)
+	}
+}
+
+func TestAddTripCapsJourney(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	journey := Journey{ID: "j1", State: JourneyPlanned}
+	for i := 0; i < maxJourneyTrips; i++ {
+		if err := addTrip(ctx, store, &journey, Trip{ID: fmt.Sprintf("t%d", i), JourneyID: "j1"}); err != nil {
+			t.Fatalf("adding trip %d: %v", i, err)
+		}
+	}
+	err := addTrip(ctx, store, &journey, Trip{ID: "extra", JourneyID: "j1"})
+	if e, ok := err.(*Error); !ok || e.Message != ErrJourneyFull.Message {
+		t.Errorf("adding a trip to a full journey = %v, want ErrJourneyFull", err)
+	}
+	if len(journey.Trips) != maxJourneyTrips {
+		t.Errorf("journey lists %d trips, want %d", len(journey.Trips), maxJourneyTrips)
+	}
+}
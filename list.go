@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+var ErrInvalidCursor = &Error{Code: CodeInvalid, Message: "invalid cursor"}
+
+// ListQuery selects a page of entities. Filters match datastore
+// properties exactly. Order names the property to sort by, descending
+// if prefixed with "-"; entities without it are left out. Without an
+// Order, entities come in no particular order. Cursor continues after
+// the page it came with.
+type ListQuery struct {
+	Filters []ListFilter
+	Order   string
+	Limit   int
+	Cursor  string
+}
+
+// ListFilter matches entities whose Property equals Value.
+type ListFilter struct {
+	Property string
+	Value    interface{}
+}
+
+// ResponsePage is a page of a list endpoint. NextCursor is passed as
+// the cursor parameter to fetch the following page; it is empty on
+// the last page.
+type ResponsePage struct {
+	Items      interface{} `json:"items"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+}
+
+// listParam is a query parameter of a list endpoint filtering on a
+// datastore property. Parse converts and checks its value.
+type listParam struct {
+	name     string
+	property string
+	parse    func(value string) (interface{}, error)
+}
+
+// parseListQuery reads the limit, cursor and sort query parameters of
+// r along with the filters among params that are present. Lists sort
+// by created_at, oldest first unless sort is -created_at.
+func parseListQuery(r *http.Request, params []listParam) (ListQuery, error) {
+	values := r.URL.Query()
+	errs := FieldErrors{}
+	query := ListQuery{Order: "created_at", Limit: defaultPageSize, Cursor: values.Get("cursor")}
+	if limit := values.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > maxPageSize {
+			errs.Add("limit", "must be between 1 and "+strconv.Itoa(maxPageSize))
+		}
+		query.Limit = n
+	}
+	switch sort := values.Get("sort"); sort {
+	case "", "created_at":
+	case "-created_at":
+		query.Order = sort
+	default:
+		errs.Add("sort", "must be created_at or -created_at")
+	}
+	for _, param := range params {
+		value := values.Get(param.name)
+		if value == "" {
+			continue
+		}
+		parsed, err := param.parse(value)
+		if err != nil {
+			errs.Add(param.name, err.Error())
+			continue
+		}
+		query.Filters = append(query.Filters, ListFilter{Property: param.property, Value: parsed})
+	}
+	return query, errs.Err()
+}
+
+// stringParam filters on a string property as it is given.
+func stringParam(name, property string) listParam {
+	return listParam{name: name, property: property, parse: func(value string) (interface{}, error) {
+		return value, nil
+	}}
+}
+
+// descending splits order into its property and direction.
+func descending(order string) (string, bool) {
+	return strings.TrimPrefix(order, "-"), strings.HasPrefix(order, "-")
+}
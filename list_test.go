@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestParseListQuery(t *testing.T) {
+	tests := []struct {
+		query string
+		want  ListQuery
+	}{
+		{"", ListQuery{Order: "created_at", Limit: defaultPageSize}},
+		{"?limit=5&sort=-created_at&cursor=abc", ListQuery{Order: "-created_at", Limit: 5, Cursor: "abc"}},
+		{"?user_id=u1&state=active", ListQuery{
+			Filters: []ListFilter{{Property: "user_id", Value: "u1"}, {Property: "state", Value: "active"}},
+			Order:   "created_at",
+			Limit:   defaultPageSize,
+		}},
+		{"?user_id=", ListQuery{Order: "created_at", Limit: defaultPageSize}},
+	}
+	for _, test := range tests {
+		query, err := parseListQuery(httptest.NewRequest(http.MethodGet, "/journeys"+test.query, nil), journeyListParams)
+		if err != nil {
+			t.Errorf("%q: %v", test.query, err)
+		} else if !reflect.DeepEqual(query, test.want) {
+			t.Errorf("%q = %+v, want %+v", test.query, query, test.want)
+		}
+	}
+
+	floor, err := parseListQuery(httptest.NewRequest(http.MethodGet, "/rooms?floor=-1", nil), roomListParams)
+	if want := []ListFilter{{Property: "pose.z_pos", Value: int64(-1)}}; err != nil || !reflect.DeepEqual(floor.Filters, want) {
+		t.Errorf("floor filter = %+v, %v, want %+v", floor.Filters, err, want)
+	}
+}
+
+func TestParseListQueryRejects(t *testing.T) {
+	_, err := parseListQuery(httptest.NewRequest(http.MethodGet, "/journeys?limit=0&sort=name&state=lost", nil), journeyListParams)
+	e, ok := err.(*Error)
+	if !ok || e.Code != CodeInvalid {
+		t.Fatalf("parseListQuery = %v, want an invalid request error", err)
+	}
+	fields := []string{}
+	for _, fieldErr := range e.Details.(FieldErrors) {
+		fields = append(fields, fieldErr.Field)
+	}
+	if want := []string{"limit", "sort", "state"}; !reflect.DeepEqual(fields, want) {
+		t.Errorf("rejected %v, want %v", fields, want)
+	}
+	for _, limit := range []string{"x", "-1", fmt.Sprint(maxPageSize + 1)} {
+		if _, err := parseListQuery(httptest.NewRequest(http.MethodGet, "/journeys?limit="+limit, nil), nil); err == nil {
+			t.Errorf("limit %s was accepted", limit)
+		}
+	}
+}
+
+func TestListCursor(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	for i := 0; i < 5; i++ {
+		store.PutJourney(ctx, Journey{ID: fmt.Sprintf("j%d", i), User: []string{"u1", "u2"}[i%2], CreatedAt: int64(100 - i)})
+	}
+	pages := func(query ListQuery) [][]string {
+		t.Helper()
+		ids := [][]string{}
+		for {
+			journeys, next, err := store.ListJourneys(ctx, query)
+			if err != nil {
+				t.Fatalf("ListJourneys: %v", err)
+			}
+			page := []string{}
+			for _, journey := range journeys {
+				page = append(page, journey.ID)
+			}
+			ids = append(ids, page)
+			if next == "" {
+				return ids
+			}
+			query.Cursor = next
+		}
+	}
+
+	if got, want := pages(ListQuery{Order: "created_at", Limit: 2}), [][]string{{"j4", "j3"}, {"j2", "j1"}, {"j0"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("oldest first = %v, want %v", got, want)
+	}
+	if got, want := pages(ListQuery{Order: "-created_at", Limit: 2}), [][]string{{"j0", "j1"}, {"j2", "j3"}, {"j4"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("newest first = %v, want %v", got, want)
+	}
+	filtered := ListQuery{Filters: []ListFilter{{Property: "user_id", Value: "u1"}}, Order: "created_at", Limit: 2}
+	if got, want := pages(filtered), [][]string{{"j4", "j2"}, {"j0"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("u1's journeys = %v, want %v", got, want)
+	}
+	if _, _, err := store.ListJourneys(ctx, ListQuery{Order: "created_at", Limit: 2, Cursor: "not a cursor"}); err != ErrInvalidCursor {
+		t.Errorf("ListJourneys with a bad cursor = %v, want ErrInvalidCursor", err)
+	}
+}
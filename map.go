@@ -0,0 +1,775 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+var (
+	ErrFloorAlreadyExists     = &Error{Code: CodeConflict, Entity: "floor", Message: "floor already exists"}
+	ErrFloorMissing           = &Error{Code: CodeNotFound, Entity: "floor", Message: "floor does not exist"}
+	ErrFloorLevelTaken        = &Error{Code: CodeConflict, Entity: "floor", Message: "another floor has this level"}
+	ErrFloorInUse             = &Error{Code: CodeConflict, Entity: "floor", Message: "floor has rooms"}
+	ErrEdgeAlreadyExists      = &Error{Code: CodeConflict, Entity: "edge", Message: "edge already exists"}
+	ErrEdgeMissing            = &Error{Code: CodeNotFound, Entity: "edge", Message: "edge does not exist"}
+	ErrConnectorAlreadyExists = &Error{Code: CodeConflict, Entity: "connector", Message: "connector already exists"}
+	ErrConnectorMissing       = &Error{Code: CodeNotFound, Entity: "connector", Message: "connector does not exist"}
+)
+
+// EdgeKind is how the two rooms of an Edge are joined.
+type EdgeKind string
+
+const (
+	EdgeDoorway  EdgeKind = "doorway"
+	EdgeCorridor EdgeKind = "corridor"
+)
+
+// ConnectorKind is how a Connector moves between floors.
+type ConnectorKind string
+
+const (
+	ConnectorElevator ConnectorKind = "elevator"
+	ConnectorStairs   ConnectorKind = "stairs"
+)
+
+// MapManager maintains the model of the building: its floors, the
+// edges between rooms on a floor and the connectors between floors.
+type MapManager struct {
+	transactor Transactor
+	floors     FloorStore
+	edges      EdgeStore
+	connectors ConnectorStore
+	rooms      RoomStore
+}
+
+// Floor is a level of the building along with the occupancy grid map
+// the robot localizes on there. Level is the Pose.Floor of its rooms.
+// As with ROS map_server, each pixel of Image covers Resolution
+// meters and the lower left one lies at Origin.
+type Floor struct {
+	ID         string  `datastore:"id" json:"id"`
+	Name       string  `datastore:"name" json:"name"`
+	Level      int     `datastore:"level" json:"level"`
+	Image      string  `datastore:"image,noindex" json:"image"`
+	Resolution float64 `datastore:"resolution,noindex" json:"resolution"`
+	Origin     Origin  `datastore:"origin,noindex" json:"origin"`
+	CreatedAt  int64   `datastore:"created_at" json:"created_at"`
+}
+
+// Origin is the pose of the lower left pixel of a floor's map, in
+// meters and radians.
+type Origin struct {
+	X   float64 `datastore:"x" json:"x"`
+	Y   float64 `datastore:"y" json:"y"`
+	Yaw float64 `datastore:"yaw" json:"yaw"`
+}
+
+// Edge joins two rooms on the same floor that the robot can drive
+// between, in either direction. A zero Length is taken to be the
+// distance between the poses of the rooms. Blocked edges are left
+// out of routes until they are cleared.
+type Edge struct {
+	ID        string   `datastore:"id" json:"id"`
+	From      string   `datastore:"from_room" json:"from"`
+	To        string   `datastore:"to_room" json:"to"`
+	Kind      EdgeKind `datastore:"kind" json:"kind"`
+	Length    float64  `datastore:"length,noindex" json:"length"`
+	Blocked   bool     `datastore:"blocked" json:"blocked"`
+	CreatedAt int64    `datastore:"created_at" json:"created_at"`
+}
+
+// Connector is an elevator or staircase, listing the room it opens
+// onto on each floor it serves. The robot can only ride elevators,
+// and not while they are Blocked.
+type Connector struct {
+	ID        string        `datastore:"id" json:"id"`
+	Name      string        `datastore:"name" json:"name"`
+	Kind      ConnectorKind `datastore:"kind" json:"kind"`
+	Rooms     []string      `datastore:"rooms" json:"rooms"`
+	Blocked   bool          `datastore:"blocked" json:"blocked"`
+	CreatedAt int64         `datastore:"created_at" json:"created_at"`
+}
+
+// Map is the whole building model.
+type Map struct {
+	Floors     []Floor     `json:"floors"`
+	Edges      []Edge      `json:"edges"`
+	Connectors []Connector `json:"connectors"`
+}
+
+// FloorPatchFields, EdgePatchFields and ConnectorPatchFields list the
+// fields of each map entity clients may change.
+var (
+	FloorPatchFields     = []string{"name", "level", "image", "resolution", "origin"}
+	EdgePatchFields      = []string{"kind", "length", "blocked"}
+	ConnectorPatchFields = []string{"name", "rooms", "blocked"}
+)
+
+func (manager MapManager) Group() Group {
+	admin := Filters{IsAdmin}
+	return Group{
+		Paths: Routes{
+			"": Methods{
+				http.MethodGet: Route{
+					Handler: manager.GetMap,
+				},
+			},
+			"floors": Methods{
+				http.MethodGet: Route{
+					Handler: manager.ListFloors,
+				},
+				http.MethodPost: Route{
+					Handler: manager.CreateFloor,
+					Allow:   admin,
+				},
+			},
+			"floors/{floorid}": Methods{
+				http.MethodGet: Route{
+					Handler: manager.GetFloor,
+				},
+				http.MethodPut: Route{
+					Handler: manager.CreateFloor,
+					Allow:   admin,
+				},
+				http.MethodPatch: Route{
+					Handler: manager.SetFloor,
+					Allow:   admin,
+				},
+				http.MethodDelete: Route{
+					Handler: manager.DelFloor,
+					Allow:   admin,
+				},
+			},
+			"edges": Methods{
+				http.MethodGet: Route{
+					Handler: manager.ListEdges,
+				},
+				http.MethodPost: Route{
+					Handler: manager.CreateEdge,
+					Allow:   admin,
+				},
+			},
+			"edges/{edgeid}": Methods{
+				http.MethodGet: Route{
+					Handler: manager.GetEdge,
+				},
+				http.MethodPut: Route{
+					Handler: manager.CreateEdge,
+					Allow:   admin,
+				},
+				http.MethodPatch: Route{
+					Handler: manager.SetEdge,
+					Allow:   admin,
+				},
+				http.MethodDelete: Route{
+					Handler: manager.DelEdge,
+					Allow:   admin,
+				},
+			},
+			"connectors": Methods{
+				http.MethodGet: Route{
+					Handler: manager.ListConnectors,
+				},
+				http.MethodPost: Route{
+					Handler: manager.CreateConnector,
+					Allow:   admin,
+				},
+			},
+			"connectors/{connectorid}": Methods{
+				http.MethodGet: Route{
+					Handler: manager.GetConnector,
+				},
+				http.MethodPut: Route{
+					Handler: manager.CreateConnector,
+					Allow:   admin,
+				},
+				http.MethodPatch: Route{
+					Handler: manager.SetConnector,
+					Allow:   admin,
+				},
+				http.MethodDelete: Route{
+					Handler: manager.DelConnector,
+					Allow:   admin,
+				},
+			},
+		},
+	}
+}
+
+// GetMap serves every floor, edge and connector of the building.
+func (manager MapManager) GetMap(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	encoder := json.NewEncoder(w)
+
+	building, dataErr := manager.load(ctx)
+	if dataErr != nil {
+		WriteError(w, dataErr)
+		return
+	}
+	encoder.Encode(building)
+}
+
+// load reads the whole building model.
+func (manager MapManager) load(ctx context.Context) (Map, error) {
+	floors, dataErr := manager.floors.Floors(ctx)
+	if dataErr != nil {
+		return Map{}, dataErr
+	}
+	edges, dataErr := manager.edges.Edges(ctx)
+	if dataErr != nil {
+		return Map{}, dataErr
+	}
+	connectors, dataErr := manager.connectors.Connectors(ctx)
+	if dataErr != nil {
+		return Map{}, dataErr
+	}
+	return Map{Floors: floors, Edges: edges, Connectors: connectors}, nil
+}
+
+func (manager MapManager) ListFloors(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	encoder := json.NewEncoder(w)
+
+	floors, dataErr := manager.floors.Floors(ctx)
+	if dataErr != nil {
+		WriteError(w, dataErr)
+		return
+	}
+	encoder.Encode(ResponsePage{Items: floors})
+}
+
+func (manager MapManager) CreateFloor(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	encoder := json.NewEncoder(w)
+
+	floorID, idErr := entityID(r, "floorid")
+	if idErr != nil {
+		WriteError(w, idErr)
+		return
+	}
+	floor := Floor{}
+	if bodyErr := decodeBody(r, &floor); bodyErr != nil {
+		WriteError(w, bodyErr)
+		return
+	}
+	if validErr := floor.Validate().Err(); validErr != nil {
+		WriteError(w, validErr)
+		return
+	}
+	floor.ID = floorID
+	floor.CreatedAt = time.Now().UTC().Unix()
+	if txErr := manager.transactor.RunInTransaction(ctx, func(ctx context.Context) error {
+		_, dataErr := manager.floors.GetFloor(ctx, floor.ID)
+		if dataErr == nil {
+			return withID(ErrFloorAlreadyExists, floor.ID)
+		} else if dataErr != ErrFloorMissing {
+			return withID(dataErr, floor.ID)
+		}
+		if levelErr := manager.checkLevel(ctx, floor); levelErr != nil {
+			return levelErr
+		}
+		return manager.floors.PutFloor(ctx, floor)
+	}); txErr != nil {
+		WriteError(w, txErr)
+		return
+	}
+	created(w, "/map/floors/"+floor.ID)
+	encoder.Encode(floor)
+}
+
+func (manager MapManager) GetFloor(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	floorID := mux.Vars(r)["floorid"]
+	encoder := json.NewEncoder(w)
+
+	floor, dataErr := manager.floors.GetFloor(ctx, floorID)
+	if dataErr != nil {
+		WriteError(w, withID(dataErr, floorID))
+		return
+	}
+	encoder.Encode(floor)
+}
+
+func (manager MapManager) SetFloor(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	floorID := mux.Vars(r)["floorid"]
+	encoder := json.NewEncoder(w)
+
+	patch, bodyErr := readPatch(r, FloorPatchFields)
+	if bodyErr != nil {
+		WriteError(w, bodyErr)
+		return
+	}
+	if _, ok := patch["level"]; ok {
+		floor, dataErr := manager.floors.GetFloor(ctx, floorID)
+		if dataErr != nil {
+			WriteError(w, withID(dataErr, floorID))
+			return
+		}
+		moved := floor
+		if patchErr := applyPatch(&moved, patch); patchErr != nil {
+			WriteError(w, patchErr)
+			return
+		}
+		if moved.Level != floor.Level {
+			if inUseErr := manager.checkEmpty(ctx, floor); inUseErr != nil {
+				WriteError(w, inUseErr)
+				return
+			}
+		}
+	}
+	floor := Floor{}
+	if txErr := manager.transactor.RunInTransaction(ctx, func(ctx context.Context) error {
+		var dataErr error
+		if floor, dataErr = manager.floors.GetFloor(ctx, floorID); dataErr != nil {
+			return withID(dataErr, floorID)
+		}
+		if patchErr := applyPatch(&floor, patch); patchErr != nil {
+			return patchErr
+		}
+		if validErr := floor.Validate().Err(); validErr != nil {
+			return validErr
+		}
+		if levelErr := manager.checkLevel(ctx, floor); levelErr != nil {
+			return levelErr
+		}
+		return manager.floors.PutFloor(ctx, floor)
+	}); txErr != nil {
+		WriteError(w, txErr)
+		return
+	}
+	encoder.Encode(floor)
+}
+
+func (manager MapManager) DelFloor(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	floorID := mux.Vars(r)["floorid"]
+	encoder := json.NewEncoder(w)
+
+	floor, dataErr := manager.floors.GetFloor(ctx, floorID)
+	if dataErr != nil {
+		WriteError(w, withID(dataErr, floorID))
+		return
+	}
+	if inUseErr := manager.checkEmpty(ctx, floor); inUseErr != nil {
+		WriteError(w, inUseErr)
+		return
+	}
+	if dataErr := manager.floors.DeleteFloor(ctx, floorID); dataErr != nil {
+		WriteError(w, withID(dataErr, floorID))
+		return
+	}
+	encoder.Encode(ResponseSuccess{Success: true})
+}
+
+// checkEmpty reports the rooms at the level of floor, which deleting
+// or moving it would leave without a floor. Queries cannot run in
+// datastore transactions, so this is checked before the floor is
+// written; a room placed there meanwhile is left without a floor.
+func (manager MapManager) checkEmpty(ctx context.Context, floor Floor) error {
+	rooms := []string{}
+	query := ListQuery{Filters: []ListFilter{{Property: "pose.z_pos", Value: int64(floor.Level)}}, Limit: maxPageSize}
+	for {
+		page, next, dataErr := manager.rooms.ListRooms(ctx, query)
+		if dataErr != nil {
+			return dataErr
+		}
+		for _, room := range page {
+			rooms = append(rooms, room.ID)
+		}
+		if next == "" {
+			break
+		}
+		query.Cursor = next
+	}
+	if len(rooms) == 0 {
+		return nil
+	}
+	inUse := *ErrFloorInUse
+	inUse.ID = floor.ID
+	inUse.Details = rooms
+	return &inUse
+}
+
+// checkLevel reports another floor at the level of floor. It runs in
+// the transaction writing floor, as the map's stores may be queried
+// in one.
+func (manager MapManager) checkLevel(ctx context.Context, floor Floor) error {
+	floors, dataErr := manager.floors.Floors(ctx)
+	if dataErr != nil {
+		return dataErr
+	}
+	for _, other := range floors {
+		if other.Level == floor.Level && other.ID != floor.ID {
+			return withID(ErrFloorLevelTaken, other.ID)
+		}
+	}
+	return nil
+}
+
+func (manager MapManager) ListEdges(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	encoder := json.NewEncoder(w)
+
+	edges, dataErr := manager.edges.Edges(ctx)
+	if dataErr != nil {
+		WriteError(w, dataErr)
+		return
+	}
+	encoder.Encode(ResponsePage{Items: edges})
+}
+
+func (manager MapManager) CreateEdge(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	encoder := json.NewEncoder(w)
+
+	edgeID, idErr := entityID(r, "edgeid")
+	if idErr != nil {
+		WriteError(w, idErr)
+		return
+	}
+	edge := Edge{}
+	if bodyErr := decodeBody(r, &edge); bodyErr != nil {
+		WriteError(w, bodyErr)
+		return
+	}
+	edge.ID = edgeID
+	edge.CreatedAt = time.Now().UTC().Unix()
+	if txErr := manager.transactor.RunInTransaction(ctx, func(ctx context.Context) error {
+		// The rooms are read in the transaction so that they cannot be
+		// deleted from under the edge.
+		if validErr := manager.validateEdge(ctx, edge); validErr != nil {
+			return validErr
+		}
+		_, dataErr := manager.edges.GetEdge(ctx, edge.ID)
+		if dataErr == nil {
+			return withID(ErrEdgeAlreadyExists, edge.ID)
+		} else if dataErr != ErrEdgeMissing {
+			return withID(dataErr, edge.ID)
+		}
+		return manager.edges.PutEdge(ctx, edge)
+	}); txErr != nil {
+		WriteError(w, txErr)
+		return
+	}
+	created(w, "/map/edges/"+edge.ID)
+	encoder.Encode(edge)
+}
+
+func (manager MapManager) GetEdge(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	edgeID := mux.Vars(r)["edgeid"]
+	encoder := json.NewEncoder(w)
+
+	edge, dataErr := manager.edges.GetEdge(ctx, edgeID)
+	if dataErr != nil {
+		WriteError(w, withID(dataErr, edgeID))
+		return
+	}
+	encoder.Encode(edge)
+}
+
+func (manager MapManager) SetEdge(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	edgeID := mux.Vars(r)["edgeid"]
+	encoder := json.NewEncoder(w)
+
+	patch, bodyErr := readPatch(r, EdgePatchFields)
+	if bodyErr != nil {
+		WriteError(w, bodyErr)
+		return
+	}
+	edge := Edge{}
+	if txErr := manager.transactor.RunInTransaction(ctx, func(ctx context.Context) error {
+		var dataErr error
+		if edge, dataErr = manager.edges.GetEdge(ctx, edgeID); dataErr != nil {
+			return withID(dataErr, edgeID)
+		}
+		if patchErr := applyPatch(&edge, patch); patchErr != nil {
+			return patchErr
+		}
+		if validErr := edge.Validate().Err(); validErr != nil {
+			return validErr
+		}
+		return manager.edges.PutEdge(ctx, edge)
+	}); txErr != nil {
+		WriteError(w, txErr)
+		return
+	}
+	encoder.Encode(edge)
+}
+
+func (manager MapManager) DelEdge(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	edgeID := mux.Vars(r)["edgeid"]
+	encoder := json.NewEncoder(w)
+
+	if dataErr := manager.edges.DeleteEdge(ctx, edgeID); dataErr != nil {
+		WriteError(w, withID(dataErr, edgeID))
+		return
+	}
+	encoder.Encode(ResponseSuccess{Success: true})
+}
+
+// validateEdge also checks that both rooms of edge exist and are on
+// the same floor.
+func (manager MapManager) validateEdge(ctx context.Context, edge Edge) error {
+	errs := edge.Validate()
+	from, fromErr := manager.room(ctx, &errs, "from", edge.From)
+	to, toErr := manager.room(ctx, &errs, "to", edge.To)
+	if fromErr != nil {
+		return fromErr
+	} else if toErr != nil {
+		return toErr
+	}
+	if from != nil && to != nil && from.Pose.Floor != to.Pose.Floor {
+		errs.Add("to", "must be on the floor of from")
+	}
+	return errs.Err()
+}
+
+func (manager MapManager) ListConnectors(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	encoder := json.NewEncoder(w)
+
+	connectors, dataErr := manager.connectors.Connectors(ctx)
+	if dataErr != nil {
+		WriteError(w, dataErr)
+		return
+	}
+	encoder.Encode(ResponsePage{Items: connectors})
+}
+
+func (manager MapManager) CreateConnector(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	encoder := json.NewEncoder(w)
+
+	connectorID, idErr := entityID(r, "connectorid")
+	if idErr != nil {
+		WriteError(w, idErr)
+		return
+	}
+	connector := Connector{}
+	if bodyErr := decodeBody(r, &connector); bodyErr != nil {
+		WriteError(w, bodyErr)
+		return
+	}
+	connector.ID = connectorID
+	connector.CreatedAt = time.Now().UTC().Unix()
+	if txErr := manager.transactor.RunInTransaction(ctx, func(ctx context.Context) error {
+		if validErr := manager.validateConnector(ctx, connector); validErr != nil {
+			return validErr
+		}
+		_, dataErr := manager.connectors.GetConnector(ctx, connector.ID)
+		if dataErr == nil {
+			return withID(ErrConnectorAlreadyExists, connector.ID)
+		} else if dataErr != ErrConnectorMissing {
+			return withID(dataErr, connector.ID)
+		}
+		return manager.connectors.PutConnector(ctx, connector)
+	}); txErr != nil {
+		WriteError(w, txErr)
+		return
+	}
+	created(w, "/map/connectors/"+connector.ID)
+	encoder.Encode(connector)
+}
+
+func (manager MapManager) GetConnector(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	connectorID := mux.Vars(r)["connectorid"]
+	encoder := json.NewEncoder(w)
+
+	connector, dataErr := manager.connectors.GetConnector(ctx, connectorID)
+	if dataErr != nil {
+		WriteError(w, withID(dataErr, connectorID))
+		return
+	}
+	encoder.Encode(connector)
+}
+
+func (manager MapManager) SetConnector(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	connectorID := mux.Vars(r)["connectorid"]
+	encoder := json.NewEncoder(w)
+
+	patch, bodyErr := readPatch(r, ConnectorPatchFields)
+	if bodyErr != nil {
+		WriteError(w, bodyErr)
+		return
+	}
+	connector := Connector{}
+	if txErr := manager.transactor.RunInTransaction(ctx, func(ctx context.Context) error {
+		var dataErr error
+		if connector, dataErr = manager.connectors.GetConnector(ctx, connectorID); dataErr != nil {
+			return withID(dataErr, connectorID)
+		}
+		if patchErr := applyPatch(&connector, patch); patchErr != nil {
+			return patchErr
+		}
+		if validErr := manager.validateConnector(ctx, connector); validErr != nil {
+			return validErr
+		}
+		return manager.connectors.PutConnector(ctx, connector)
+	}); txErr != nil {
+		WriteError(w, txErr)
+		return
+	}
+	encoder.Encode(connector)
+}
+
+func (manager MapManager) DelConnector(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	connectorID := mux.Vars(r)["connectorid"]
+	encoder := json.NewEncoder(w)
+
+	if dataErr := manager.connectors.DeleteConnector(ctx, connectorID); dataErr != nil {
+		WriteError(w, withID(dataErr, connectorID))
+		return
+	}
+	encoder.Encode(ResponseSuccess{Success: true})
+}
+
+// validateConnector also checks that the rooms of connector exist and
+// are each on a different floor.
+func (manager MapManager) validateConnector(ctx context.Context, connector Connector) error {
+	errs := connector.Validate()
+	floors := map[int]string{}
+	for i, roomID := range connector.Rooms {
+		field := fmt.Sprintf("rooms[%d]", i)
+		room, dataErr := manager.room(ctx, &errs, field, roomID)
+		if dataErr != nil {
+			return dataErr
+		}
+		if room == nil {
+			continue
+		}
+		if other, ok := floors[room.Pose.Floor]; ok {
+			errs.Add(field, "is on the same floor as "+other)
+		}
+		floors[room.Pose.Floor] = roomID
+	}
+	return errs.Err()
+}
+
+// checkFloor adds a field error if no floor is at level. Until the map
+// has any floors, rooms may be placed at any level in MinFloor to
+// MaxFloor, as before floors existed. It is checked when rooms are
+// placed rather than whenever they change, so that rooms placed
+// before the map had floors can still be edited.
+func (manager MapManager) checkFloor(ctx context.Context, errs *FieldErrors, field string, level int) error {
+	floors, dataErr := manager.floors.Floors(ctx)
+	if dataErr != nil {
+		return dataErr
+	}
+	if len(floors) == 0 {
+		if level < MinFloor || level > MaxFloor {
+			errs.Add(field, fmt.Sprintf("must be between %d and %d", MinFloor, MaxFloor))
+		}
+		return nil
+	}
+	for _, floor := range floors {
+		if floor.Level == level {
+			return nil
+		}
+	}
+	errs.Add(field, "is not the level of any floor")
+	return nil
+}
+
+// links lists the IDs of the edges and connectors that join the room
+// with the given ID to others.
+func (manager MapManager) links(ctx context.Context, roomID string) ([]string, error) {
+	edges, dataErr := manager.edges.Edges(ctx)
+	if dataErr != nil {
+		return nil, dataErr
+	}
+	connectors, dataErr := manager.connectors.Connectors(ctx)
+	if dataErr != nil {
+		return nil, dataErr
+	}
+	links := []string{}
+	for _, edge := range edges {
+		if edge.From == roomID || edge.To == roomID {
+			links = append(links, edge.ID)
+		}
+	}
+	for _, connector := range connectors {
+		if contains(connector.Rooms, roomID) {
+			links = append(links, connector.ID)
+		}
+	}
+	return links, nil
+}
+
+// room reads the room a map entity refers to in field, adding a field
+// error if it does not exist.
+func (manager MapManager) room(ctx context.Context, errs *FieldErrors, field, roomID string) (*Room, error) {
+	if roomID == "" {
+		return nil, nil
+	}
+	room, dataErr := manager.rooms.GetRoom(ctx, roomID)
+	if dataErr == ErrRoomMissing {
+		errs.Add(field, ErrRoomMissing.Message)
+		return nil, nil
+	} else if dataErr != nil {
+		return nil, dataErr
+	}
+	return &room, nil
+}
+
+// Validate reports every field of floor that is missing or out of range.
+func (floor Floor) Validate() FieldErrors {
+	errs := FieldErrors{}
+	if floor.Name == "" {
+		errs.Add("name", "is required")
+	}
+	if floor.Level < MinFloor || floor.Level > MaxFloor {
+		errs.Add("level", fmt.Sprintf("must be between %d and %d", MinFloor, MaxFloor))
+	}
+	if floor.Resolution <= 0 {
+		errs.Add("resolution", "must be positive")
+	}
+	return errs
+}
+
+// Validate reports every field of edge that is missing or out of range.
+func (edge Edge) Validate() FieldErrors {
+	errs := FieldErrors{}
+	if edge.From == "" {
+		errs.Add("from", "is required")
+	}
+	if edge.To == "" {
+		errs.Add("to", "is required")
+	} else if edge.To == edge.From {
+		errs.Add("to", "must differ from from")
+	}
+	if edge.Kind != EdgeDoorway && edge.Kind != EdgeCorridor {
+		errs.Add("kind", fmt.Sprintf("must be %s or %s", EdgeDoorway, EdgeCorridor))
+	}
+	if edge.Length < 0 {
+		errs.Add("length", "must not be negative")
+	}
+	return errs
+}
+
+// Validate reports every field of connector that is missing or out of
+// range.
+func (connector Connector) Validate() FieldErrors {
+	errs := FieldErrors{}
+	if connector.Name == "" {
+		errs.Add("name", "is required")
+	}
+	if connector.Kind != ConnectorElevator && connector.Kind != ConnectorStairs {
+		errs.Add("kind", fmt.Sprintf("must be %s or %s", ConnectorElevator, ConnectorStairs))
+	}
+	if len(connector.Rooms) < 2 {
+		errs.Add("rooms", "must list at least two rooms")
+	}
+	return errs
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// serve runs handler on a request with the given route variables.
+func serve(handler http.HandlerFunc, method, path, body string, vars map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r = mux.SetURLVars(r, vars)
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+func TestFloorInUse(t *testing.T) {
+	ctx := context.Background()
+	store, maps := testMap()
+	store.PutFloor(ctx, Floor{ID: "ground", Name: "Ground", Level: 0, Resolution: 0.05})
+	store.PutFloor(ctx, Floor{ID: "first", Name: "First", Level: 1, Resolution: 0.05})
+	ground := map[string]string{"floorid": "ground"}
+
+	w := serve(maps.DelFloor, http.MethodDelete, "/map/floors/ground", "", ground)
+	var inUse ResponseError
+	json.Unmarshal(w.Body.Bytes(), &inUse)
+	if w.Code != http.StatusConflict || inUse.Error == nil || !reflect.DeepEqual(inUse.Error.Details, []interface{}{"a", "b", "c", "f"}) {
+		t.Errorf("deleting a floor with rooms = %d %s, want 409 listing its rooms", w.Code, w.Body)
+	}
+	if w := serve(maps.SetFloor, http.MethodPatch, "/map/floors/ground", `{"level": 3}`, ground); w.Code != http.StatusConflict {
+		t.Errorf("moving a floor with rooms = %d, want 409", w.Code)
+	}
+	if w := serve(maps.SetFloor, http.MethodPatch, "/map/floors/ground", `{"name": "Lobby", "level": 0}`, ground); w.Code != http.StatusOK {
+		t.Errorf("renaming a floor with rooms = %d %s, want 200", w.Code, w.Body)
+	}
+	if floor, _ := store.GetFloor(ctx, "ground"); floor.Level != 0 || floor.Name != "Lobby" {
+		t.Errorf("stored floor = %+v, want Lobby at level 0", floor)
+	}
+	first := map[string]string{"floorid": "first"}
+	if w := serve(maps.SetFloor, http.MethodPatch, "/map/floors/first", `{"level": 4}`, first); w.Code != http.StatusOK {
+		t.Errorf("moving an empty floor = %d %s, want 200", w.Code, w.Body)
+	}
+	if w := serve(maps.DelFloor, http.MethodDelete, "/map/floors/first", "", first); w.Code != http.StatusOK {
+		t.Errorf("deleting an empty floor = %d %s, want 200", w.Code, w.Body)
+	}
+}
+
+func TestRoomsPlacedBeforeFloors(t *testing.T) {
+	ctx := context.Background()
+	store, maps := testMap()
+	store.PutFloor(ctx, Floor{ID: "ground", Name: "Ground", Level: 0, Resolution: 0.05})
+	rooms := RoomManager{transactor: store, rooms: store, trips: store, maps: maps, index: NewRoomIndex(store)}
+	d := map[string]string{"roomid": "d"}
+
+	// d was placed at level 2 before the map had floors.
+	if w := serve(rooms.SetRoom, http.MethodPatch, "/rooms/d", `{"name": "Lab"}`, d); w.Code != http.StatusOK {
+		t.Errorf("renaming a room without a floor = %d %s, want 200", w.Code, w.Body)
+	}
+	store.PutRoom(ctx, Room{ID: "g", Name: "Hall", Pose: Pose{Floor: 2}})
+	if w := serve(rooms.SetRoom, http.MethodPatch, "/rooms/g", `{"pose": {"z": 3}}`, map[string]string{"roomid": "g"}); w.Code != http.StatusBadRequest {
+		t.Errorf("moving a room to a level without a floor = %d, want 400", w.Code)
+	}
+	if w := serve(rooms.SetRoom, http.MethodPatch, "/rooms/g", `{"pose": {"z": 0}}`, map[string]string{"roomid": "g"}); w.Code != http.StatusOK {
+		t.Errorf("moving a room onto a floor = %d %s, want 200", w.Code, w.Body)
+	}
+}
+
+func TestFloorCRUD(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	maps := MapManager{transactor: store, floors: store, edges: store, connectors: store, rooms: store}
+	ground := map[string]string{"floorid": "ground"}
+
+	w := serve(maps.CreateFloor, http.MethodPost, "/map/floors", `{"name": "Basement", "level": -1, "resolution": 0.05}`, nil)
+	if w.Code != http.StatusCreated || !strings.HasPrefix(w.Header().Get("Location"), "/map/floors/") {
+		t.Errorf("POST = %d at %q, want 201 with a location", w.Code, w.Header().Get("Location"))
+	}
+	body := `{"name": "Ground", "level": 0, "resolution": 0.05, "origin": {"x": -10, "y": -5}}`
+	if w := serve(maps.CreateFloor, http.MethodPut, "/map/floors/ground", body, ground); w.Code != http.StatusCreated {
+		t.Errorf("PUT = %d %s, want 201", w.Code, w.Body)
+	}
+	if w := serve(maps.CreateFloor, http.MethodPut, "/map/floors/ground", body, ground); w.Code != http.StatusConflict {
+		t.Errorf("PUT of an existing floor = %d, want 409", w.Code)
+	}
+	if w := serve(maps.CreateFloor, http.MethodPut, "/map/floors/lobby", body, map[string]string{"floorid": "lobby"}); w.Code != http.StatusConflict {
+		t.Errorf("PUT at a taken level = %d, want 409", w.Code)
+	}
+	if w := serve(maps.CreateFloor, http.MethodPost, "/map/floors", `{"level": 99}`, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("POST of an invalid floor = %d, want 400", w.Code)
+	}
+
+	if w := serve(maps.SetFloor, http.MethodPatch, "/map/floors/ground", `{"level": -1}`, ground); w.Code != http.StatusConflict {
+		t.Errorf("PATCH to a taken level = %d, want 409", w.Code)
+	}
+	if w := serve(maps.SetFloor, http.MethodPatch, "/map/floors/ground", `{"resolution": 0}`, ground); w.Code != http.StatusBadRequest {
+		t.Errorf("PATCH to an invalid resolution = %d, want 400", w.Code)
+	}
+	if w := serve(maps.SetFloor, http.MethodPatch, "/map/floors/ground", `{"level": 1, "resolution": 0.1}`, ground); w.Code != http.StatusOK {
+		t.Errorf("PATCH = %d %s, want 200", w.Code, w.Body)
+	}
+	w = serve(maps.GetFloor, http.MethodGet, "/map/floors/ground", "", ground)
+	var floor Floor
+	json.Unmarshal(w.Body.Bytes(), &floor)
+	if want := (Origin{X: -10, Y: -5}); w.Code != http.StatusOK || floor.Level != 1 || floor.Resolution != 0.1 || floor.Origin != want || floor.CreatedAt == 0 {
+		t.Errorf("GET = %d %+v, want the patched floor", w.Code, floor)
+	}
+	if floors, _ := store.Floors(ctx); len(floors) != 2 {
+		t.Errorf("stored %d floors, want 2", len(floors))
+	}
+
+	if w := serve(maps.DelFloor, http.MethodDelete, "/map/floors/ground", "", ground); w.Code != http.StatusOK {
+		t.Errorf("DELETE = %d %s, want 200", w.Code, w.Body)
+	}
+	if w := serve(maps.GetFloor, http.MethodGet, "/map/floors/ground", "", ground); w.Code != http.StatusNotFound {
+		t.Errorf("GET of a deleted floor = %d, want 404", w.Code)
+	}
+	if w := serve(maps.DelFloor, http.MethodDelete, "/map/floors/ground", "", ground); w.Code != http.StatusNotFound {
+		t.Errorf("DELETE of a deleted floor = %d, want 404", w.Code)
+	}
+}
+
+func TestEdgeCRUD(t *testing.T) {
+	ctx := context.Background()
+	_, maps := testMap()
+	bf := map[string]string{"edgeid": "bf"}
+
+	if w := serve(maps.CreateEdge, http.MethodPut, "/map/edges/bf", `{"from": "b", "to": "f", "kind": "corridor"}`, bf); w.Code != http.StatusCreated {
+		t.Errorf("PUT = %d %s, want 201", w.Code, w.Body)
+	}
+	if w := serve(maps.CreateEdge, http.MethodPut, "/map/edges/bf", `{"from": "b", "to": "f", "kind": "corridor"}`, bf); w.Code != http.StatusConflict {
+		t.Errorf("PUT of an existing edge = %d, want 409", w.Code)
+	}
+	for _, body := range []string{
+		`{"from": "a", "to": "d", "kind": "corridor"}`,
+		`{"from": "a", "to": "z", "kind": "corridor"}`,
+		`{"from": "a", "to": "a", "kind": "corridor"}`,
+		`{"from": "a", "to": "b", "kind": "tunnel"}`,
+		`{"from": "a", "to": "b", "kind": "doorway", "length": -1}`,
+	} {
+		if w := serve(maps.CreateEdge, http.MethodPost, "/map/edges", body, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("POST %s = %d, want 400", body, w.Code)
+		}
+	}
+
+	if w := serve(maps.SetEdge, http.MethodPatch, "/map/edges/bf", `{"from": "a"}`, bf); w.Code != http.StatusBadRequest {
+		t.Errorf("PATCH of from = %d, want 400", w.Code)
+	}
+	if w := serve(maps.SetEdge, http.MethodPatch, "/map/edges/bf", `{"blocked": true, "length": 25}`, bf); w.Code != http.StatusOK {
+		t.Errorf("PATCH = %d %s, want 200", w.Code, w.Body)
+	}
+	if edge, _ := maps.edges.GetEdge(ctx, "bf"); !edge.Blocked || edge.Length != 25 || edge.From != "b" {
+		t.Errorf("stored edge = %+v, want b to f blocked at length 25", edge)
+	}
+
+	if w := serve(maps.DelEdge, http.MethodDelete, "/map/edges/bf", "", bf); w.Code != http.StatusOK {
+		t.Errorf("DELETE = %d %s, want 200", w.Code, w.Body)
+	}
+	if w := serve(maps.GetEdge, http.MethodGet, "/map/edges/bf", "", bf); w.Code != http.StatusNotFound {
+		t.Errorf("GET of a deleted edge = %d, want 404", w.Code)
+	}
+}
+
+func TestConnectorCRUD(t *testing.T) {
+	ctx := context.Background()
+	_, maps := testMap()
+	hoist := map[string]string{"connectorid": "hoist"}
+
+	body := `{"name": "Hoist", "kind": "elevator", "rooms": ["b", "e"]}`
+	if w := serve(maps.CreateConnector, http.MethodPut, "/map/connectors/hoist", body, hoist); w.Code != http.StatusCreated {
+		t.Errorf("PUT = %d %s, want 201", w.Code, w.Body)
+	}
+	if w := serve(maps.CreateConnector, http.MethodPut, "/map/connectors/hoist", body, hoist); w.Code != http.StatusConflict {
+		t.Errorf("PUT of an existing connector = %d, want 409", w.Code)
+	}
+	for _, body := range []string{
+		`{"name": "Hoist", "kind": "elevator", "rooms": ["a", "b"]}`,
+		`{"name": "Hoist", "kind": "elevator", "rooms": ["a", "z"]}`,
+		`{"name": "Hoist", "kind": "elevator", "rooms": ["a"]}`,
+		`{"name": "Hoist", "kind": "slide", "rooms": ["a", "d"]}`,
+		`{"kind": "stairs", "rooms": ["a", "d"]}`,
+	} {
+		if w := serve(maps.CreateConnector, http.MethodPost, "/map/connectors", body, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("POST %s = %d, want 400", body, w.Code)
+		}
+	}
+
+	if w := serve(maps.SetConnector, http.MethodPatch, "/map/connectors/hoist", `{"rooms": ["b", "c"]}`, hoist); w.Code != http.StatusBadRequest {
+		t.Errorf("PATCH to rooms on one floor = %d, want 400", w.Code)
+	}
+	if w := serve(maps.SetConnector, http.MethodPatch, "/map/connectors/hoist", `{"rooms": ["f", "d"], "blocked": true}`, hoist); w.Code != http.StatusOK {
+		t.Errorf("PATCH = %d %s, want 200", w.Code, w.Body)
+	}
+	if connector, _ := maps.connectors.GetConnector(ctx, "hoist"); !connector.Blocked || !reflect.DeepEqual(connector.Rooms, []string{"f", "d"}) {
+		t.Errorf("stored connector = %+v, want f and d blocked", connector)
+	}
+
+	if w := serve(maps.DelConnector, http.MethodDelete, "/map/connectors/hoist", "", hoist); w.Code != http.StatusOK {
+		t.Errorf("DELETE = %d %s, want 200", w.Code, w.Body)
+	}
+	if w := serve(maps.GetConnector, http.MethodGet, "/map/connectors/hoist", "", hoist); w.Code != http.StatusNotFound {
+		t.Errorf("GET of a deleted connector = %d, want 404", w.Code)
+	}
+}
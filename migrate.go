@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+)
+
+// Migrations brings entities stored by earlier versions up to date.
+type Migrations struct {
+	transactor Transactor
+	users      UserStore
+	journeys   JourneyStore
+	trips      TripStore
+	rooms      RoomStore
+}
+
+// BackfillResult counts the entities of each kind a backfill wrote.
+type BackfillResult struct {
+	Users    int `json:"users"`
+	Journeys int `json:"journeys"`
+	Trips    int `json:"trips"`
+	Rooms    int `json:"rooms"`
+}
+
+func (migrations Migrations) Group() Group {
+	return Group{
+		Paths: Routes{
+			"created-at": Route{
+				Methods: []string{http.MethodPost},
+				Handler: migrations.BackfillCreatedAt,
+				Allow:   Filters{IsAdmin},
+			},
+		},
+	}
+}
+
+// BackfillCreatedAt writes every user, journey, trip and room back as
+// it is, so that those stored before created_at existed get the
+// property. The datastore leaves entities without it out of the lists
+// sorted by it; backfilled ones sort first, with a created_at of 0.
+// Running it again does no harm, so it can be retried if it fails.
+func (migrations Migrations) BackfillCreatedAt(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	result := BackfillResult{}
+	var err error
+	if result.Users, err = migrations.rewrite(ctx, func(ctx context.Context, query ListQuery) ([]string, string, error) {
+		users, next, dataErr := migrations.users.ListUsers(ctx, query)
+		ids := make([]string, len(users))
+		for i, user := range users {
+			ids[i] = user.ID
+		}
+		return ids, next, dataErr
+	}, func(ctx context.Context, id string) error {
+		user, dataErr := migrations.users.GetUser(ctx, id)
+		if dataErr == ErrUserMissing {
+			return nil
+		} else if dataErr != nil {
+			return dataErr
+		}
+		return migrations.users.PutUser(ctx, user)
+	}); err != nil {
+		WriteError(w, err)
+		return
+	}
+	if result.Journeys, err = migrations.rewrite(ctx, func(ctx context.Context, query ListQuery) ([]string, string, error) {
+		journeys, next, dataErr := migrations.journeys.ListJourneys(ctx, query)
+		ids := make([]string, len(journeys))
+		for i, journey := range journeys {
+			ids[i] = journey.ID
+		}
+		return ids, next, dataErr
+	}, func(ctx context.Context, id string) error {
+		journey, dataErr := migrations.journeys.GetJourney(ctx, id)
+		if dataErr == ErrJourneyMissing {
+			return nil
+		} else if dataErr != nil {
+			return dataErr
+		}
+		return migrations.journeys.PutJourney(ctx, journey)
+	}); err != nil {
+		WriteError(w, err)
+		return
+	}
+	if result.Trips, err = migrations.rewrite(ctx, func(ctx context.Context, query ListQuery) ([]string, string, error) {
+		trips, next, dataErr := migrations.trips.ListTrips(ctx, query)
+		ids := make([]string, len(trips))
+		for i, trip := range trips {
+			ids[i] = trip.ID
+		}
+		return ids, next, dataErr
+	}, func(ctx context.Context, id string) error {
+		trip, dataErr := migrations.trips.GetTrip(ctx, id)
+		if dataErr == ErrTripMissing {
+			return nil
+		} else if dataErr != nil {
+			return dataErr
+		}
+		return migrations.trips.PutTrip(ctx, trip)
+	}); err != nil {
+		WriteError(w, err)
+		return
+	}
+	if result.Rooms, err = migrations.rewrite(ctx, func(ctx context.Context, query ListQuery) ([]string, string, error) {
+		rooms, next, dataErr := migrations.rooms.ListRooms(ctx, query)
+		ids := make([]string, len(rooms))
+		for i, room := range rooms {
+			ids[i] = room.ID
+		}
+		return ids, next, dataErr
+	}, func(ctx context.Context, id string) error {
+		room, dataErr := migrations.rooms.GetRoom(ctx, id)
+		if dataErr == ErrRoomMissing {
+			return nil
+		} else if dataErr != nil {
+			return dataErr
+		}
+		return migrations.rooms.PutRoom(ctx, room)
+	}); err != nil {
+		WriteError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+// rewrite runs write in a transaction of its own on the ID of every
+// entity list pages through, unsorted so that none is left out, and
+// counts them. Writing does not change the key, so the cursor of list
+// stays valid; entities deleted meanwhile are left to write to skip.
+func (migrations Migrations) rewrite(ctx context.Context, list func(ctx context.Context, query ListQuery) ([]string, string, error), write func(ctx context.Context, id string) error) (int, error) {
+	count := 0
+	query := ListQuery{Limit: maxPageSize}
+	for {
+		ids, next, dataErr := list(ctx, query)
+		if dataErr != nil {
+			return count, dataErr
+		}
+		for _, id := range ids {
+			if txErr := migrations.transactor.RunInTransaction(ctx, func(ctx context.Context) error {
+				return write(ctx, id)
+			}); txErr != nil {
+				return count, withID(txErr, id)
+			}
+			count++
+		}
+		if next == "" {
+			return count, nil
+		}
+		query.Cursor = next
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBackfillCreatedAt(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	rooms := maxPageSize + 20
+	for i := 0; i < rooms; i++ {
+		store.PutRoom(ctx, Room{ID: fmt.Sprintf("r%03d", i), Name: "Room"})
+	}
+	store.PutUser(ctx, User{ID: "u1", FirstName: "Ada", Journeys: []string{"j1"}})
+	store.PutUser(ctx, User{ID: "u2", FirstName: "Grace", CreatedAt: 100})
+	store.PutJourney(ctx, Journey{ID: "j1", User: "u1", Trips: []string{"t1"}})
+	store.PutTrip(ctx, Trip{ID: "t1", JourneyID: "j1"})
+	migrations := Migrations{transactor: store, users: store, journeys: store, trips: store, rooms: store}
+
+	w := httptest.NewRecorder()
+	migrations.BackfillCreatedAt(w, httptest.NewRequest(http.MethodPost, "/migrations/created-at", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	result := BackfillResult{}
+	json.Unmarshal(w.Body.Bytes(), &result)
+	if want := (BackfillResult{Users: 2, Journeys: 1, Trips: 1, Rooms: rooms}); result != want {
+		t.Errorf("backfilled %+v, want %+v", result, want)
+	}
+	if user, _ := store.GetUser(ctx, "u2"); user.CreatedAt != 100 {
+		t.Errorf("backfill changed the created_at of u2 to %d", user.CreatedAt)
+	}
+	if found, err := allRooms(ctx, store); err != nil || len(found) != rooms {
+		t.Errorf("allRooms found %d rooms, %v, want %d", len(found), err, rooms)
+	}
+}
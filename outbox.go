@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/ros-nueva/backend/protocol"
+)
+
+const (
+	// maxDeliveryAttempts is how often a command is published before
+	// it is given up on as failed.
+	maxDeliveryAttempts = 8
+	// retryBackoff is the wait after the first delivery of a command;
+	// it doubles with every further attempt up to maxRetryBackoff.
+	retryBackoff    = 2 * time.Second
+	maxRetryBackoff = 5 * time.Minute
+	// flushInterval is how often Run looks for commands due again.
+	flushInterval = time.Second
+)
+
+var (
+	ErrCommandMissing       = &Error{Code: CodeNotFound, Entity: "command", Message: "command does not exist"}
+	ErrCommandStatusUnknown = &Error{Code: CodeInvalid, Message: "status must be one of pending, acknowledged or failed"}
+)
+
+// CommandStatus is where a command stands in the outbox.
+type CommandStatus string
+
+const (
+	CommandPending      CommandStatus = "pending"
+	CommandAcknowledged CommandStatus = "acknowledged"
+	CommandFailed       CommandStatus = "failed"
+)
+
+// Command is a message to the robot kept in the outbox until the
+// robot acknowledges it. Its ID is the correlation id of the envelope
+// in Message.
+type Command struct {
+	ID             string        `datastore:"id" json:"id"`
+	JourneyID      string        `datastore:"journey_id" json:"journey_id,omitempty"`
+	TripID         string        `datastore:"trip_id" json:"trip_id,omitempty"`
+	Type           string        `datastore:"type" json:"type"`
+	Message        string        `datastore:"message,noindex" json:"-"`
+	Status         CommandStatus `datastore:"status" json:"status"`
+	Attempts       int           `datastore:"attempts" json:"attempts"`
+	LastError      string        `datastore:"last_error,noindex" json:"last_error,omitempty"`
+	CreatedAt      int64         `datastore:"created_at" json:"created_at"`
+	NextAttemptAt  int64         `datastore:"next_attempt_at" json:"next_attempt_at,omitempty"`
+	AcknowledgedAt int64         `datastore:"acknowledged_at" json:"acknowledged_at,omitempty"`
+}
+
+// Outbox delivers commands to the robot. Commands are stored before
+// they are published and published again with growing backoff until
+// the robot acknowledges them. A command queued in a transaction is
+// sent only once the change it belongs to has been committed. When a
+// command setting off on a trip is given up on, the trip is failed.
+type Outbox struct {
+	publisher  Publisher
+	transactor Transactor
+	commands   CommandStore
+	trips      TripStore
+	journeys   JourneyStore
+}
+
+func (outbox Outbox) Group() Group {
+	return Group{
+		Paths: Routes{
+			// App Engine cron requests are GETs.
+			"flush": Route{
+				Methods: []string{http.MethodGet, http.MethodPost},
+				Handler: outbox.FlushCommands,
+				Allow:   Filters{IsAdmin},
+			},
+		},
+	}
+}
+
+// FlushCommands delivers every command that is due, for deployments
+// that cannot run a background worker.
+func (outbox Outbox) FlushCommands(w http.ResponseWriter, r *http.Request) {
+	if err := outbox.Flush(r.Context()); err != nil {
+		WriteError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(ResponseSuccess{Success: true})
+}
+
+// Enqueue stores a command of the given type for delivery by the
+// next Flush. The journey and trip it concerns may be empty.
+func (outbox Outbox) Enqueue(ctx context.Context, journeyID, tripID, commandType string, payload interface{}) (Command, error) {
+	envelope, err := protocol.NewEnvelope(commandType, payload)
+	if err != nil {
+		return Command{}, err
+	}
+	message, err := json.Marshal(envelope)
+	if err != nil {
+		return Command{}, err
+	}
+	command := Command{
+		ID:            envelope.CorrelationID,
+		JourneyID:     journeyID,
+		TripID:        tripID,
+		Type:          commandType,
+		Message:       string(message),
+		Status:        CommandPending,
+		CreatedAt:     envelope.Timestamp,
+		NextAttemptAt: envelope.Timestamp,
+	}
+	return command, outbox.commands.PutCommand(ctx, command)
+}
+
+// Send enqueues a command and delivers it right away.
+func (outbox Outbox) Send(ctx context.Context, journeyID, tripID, commandType string, payload interface{}) (Command, error) {
+	command, err := outbox.Enqueue(ctx, journeyID, tripID, commandType, payload)
+	if err != nil {
+		return command, err
+	}
+	return outbox.deliver(ctx, command, time.Now().UTC())
+}
+
+// Flush delivers every pending command that is due. A command that
+// cannot be delivered is logged and left to the next Flush, so that
+// it does not hold up the others.
+func (outbox Outbox) Flush(ctx context.Context) error {
+	now := time.Now().UTC()
+	due, dataErr := outbox.commands.DueCommands(ctx, now.Unix())
+	if dataErr != nil {
+		return dataErr
+	}
+	for _, command := range due {
+		if _, err := outbox.deliver(ctx, command, now); err != nil {
+			log.Printf("outbox: delivering %s: %v", command.ID, err)
+		}
+	}
+	return nil
+}
+
+// flush is Flush for handlers whose change has already been
+// committed, so that failures are only logged and left to the retries.
+func (outbox Outbox) flush(ctx context.Context) {
+	if err := outbox.Flush(ctx); err != nil {
+		log.Printf("outbox: %v", err)
+	}
+}
+
+// Run flushes the outbox every flushInterval until ctx is done.
+func (outbox Outbox) Run(ctx context.Context) {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			outbox.flush(ctx)
+		}
+	}
+}
+
+// deliver publishes command and schedules its next attempt, or marks
+// it failed once every attempt went unanswered, failing the trip it
+// set off on. Publishing happens outside the transaction since it may
+// block for publishTimeout.
+func (outbox Outbox) deliver(ctx context.Context, command Command, now time.Time) (Command, error) {
+	id := command.ID
+	var publishErr error
+	failed := command.Attempts >= maxDeliveryAttempts
+	if !failed {
+		publishErr = outbox.publisher.PublishJSON(json.RawMessage(command.Message))
+	}
+	txErr := outbox.transactor.RunInTransaction(ctx, func(ctx context.Context) error {
+		var dataErr error
+		command, dataErr = outbox.commands.GetCommand(ctx, id)
+		if dataErr != nil {
+			return withID(dataErr, id)
+		}
+		// The robot may have answered while the command was published.
+		if command.Status != CommandPending {
+			return nil
+		}
+		if failed {
+			command.Status = CommandFailed
+			command.NextAttemptAt = 0
+			if dataErr := outbox.commands.PutCommand(ctx, command); dataErr != nil {
+				return dataErr
+			}
+			return outbox.failTrip(ctx, command)
+		}
+		command.Attempts++
+		command.LastError = ""
+		if publishErr != nil {
+			command.LastError = publishErr.Error()
+		}
+		command.NextAttemptAt = now.Add(backoff(command.Attempts)).Unix()
+		return outbox.commands.PutCommand(ctx, command)
+	})
+	return command, txErr
+}
+
+// failTrip fails the trip in progress that the failed command was to
+// set off on, which aborts its journey and tells the clients following
+// it. Other commands only concern trips that have already ended.
+func (outbox Outbox) failTrip(ctx context.Context, command Command) error {
+	if command.Type != protocol.CommandStartTrip || command.TripID == "" {
+		return nil
+	}
+	trip, dataErr := outbox.trips.GetTrip(ctx, command.TripID)
+	if dataErr == ErrTripMissing {
+		return nil
+	} else if dataErr != nil {
+		return dataErr
+	}
+	if trip.CurrentState() != TripInProgress {
+		return nil
+	}
+	log.Printf("outbox: giving up on %s after %d attempts, failing trip %s", command.ID, command.Attempts, trip.ID)
+	_, err := abandonTrip(ctx, outbox, outbox.trips, outbox.journeys, trip.ID)
+	return err
+}
+
+// Acknowledge records that the robot received the command with the
+// given correlation id, which stops its redelivery. Commands that
+// were given up on are acknowledged all the same.
+func (outbox Outbox) Acknowledge(ctx context.Context, id string) error {
+	return outbox.transactor.RunInTransaction(ctx, func(ctx context.Context) error {
+		command, dataErr := outbox.commands.GetCommand(ctx, id)
+		if dataErr != nil {
+			return dataErr
+		}
+		if command.Status == CommandAcknowledged {
+			return nil
+		}
+		command.Status = CommandAcknowledged
+		command.NextAttemptAt = 0
+		command.AcknowledgedAt = time.Now().UTC().Unix()
+		return outbox.commands.PutCommand(ctx, command)
+	})
+}
+
+// backoff is the wait before the attempt following the given number
+// of attempts.
+func backoff(attempts int) time.Duration {
+	wait := retryBackoff
+	for i := 1; i < attempts && wait < maxRetryBackoff; i++ {
+		wait *= 2
+	}
+	if wait > maxRetryBackoff {
+		return maxRetryBackoff
+	}
+	return wait
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/ros-nueva/backend/protocol"
+)
+
+func TestOutboxRedelivers(t *testing.T) {
+	ctx := context.Background()
+	store, bus, manager := testRobot(t, false)
+	outbox := manager.outbox
+
+	command, err := outbox.Send(ctx, "j1", "t1", protocol.CommandCancel, protocol.Cancel{TripID: "t1"})
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if command.Attempts != 1 || len(bus.Messages()) != 1 {
+		t.Fatalf("after Send: %d attempts, %d messages, want 1 of each", command.Attempts, len(bus.Messages()))
+	}
+	if due, _ := store.DueCommands(ctx, command.NextAttemptAt-1); len(due) != 0 {
+		t.Errorf("command is due again before its backoff ran out")
+	}
+	due, _ := store.DueCommands(ctx, command.NextAttemptAt)
+	if len(due) != 1 {
+		t.Fatalf("%d commands due after the backoff, want the unanswered one", len(due))
+	}
+	later := time.Unix(command.NextAttemptAt, 0)
+	command, err = outbox.deliver(ctx, due[0], later)
+	if err != nil {
+		t.Fatalf("deliver: %v", err)
+	}
+	if command.Attempts != 2 || len(bus.Messages()) != 2 {
+		t.Errorf("after redelivery: %d attempts, %d messages, want 2 of each", command.Attempts, len(bus.Messages()))
+	}
+	if want := later.Add(backoff(2)).Unix(); command.NextAttemptAt != want {
+		t.Errorf("next attempt at %d, want %d", command.NextAttemptAt, want)
+	}
+}
+
+func TestOutboxAckStopsRedelivery(t *testing.T) {
+	ctx := context.Background()
+	store, bus, manager := testRobot(t, false)
+	outbox := manager.outbox
+
+	command, err := outbox.Send(ctx, "j1", "t1", protocol.CommandCancel, protocol.Cancel{TripID: "t1"})
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	ack, _ := protocol.Reply(protocol.EventAck, command.ID, protocol.Ack{})
+	if err := manager.Handle(ctx, ack); err != nil {
+		t.Fatalf("Handle ack: %v", err)
+	}
+	if due, _ := store.DueCommands(ctx, time.Now().Add(maxRetryBackoff).Unix()); len(due) != 0 {
+		t.Errorf("%d commands due after the ack, want none", len(due))
+	}
+	// A delivery racing the ack leaves the command acknowledged.
+	if command, err = outbox.deliver(ctx, command, time.Now()); err != nil {
+		t.Fatalf("deliver: %v", err)
+	}
+	if command.Status != CommandAcknowledged || command.Attempts != 1 || command.AcknowledgedAt == 0 {
+		t.Errorf("command is %s after %d attempts, want acknowledged after 1", command.Status, command.Attempts)
+	}
+	if len(bus.Messages()) != 2 {
+		t.Errorf("published %d messages, want the delivery and the racing one", len(bus.Messages()))
+	}
+}
+
+func TestOutboxGivesUp(t *testing.T) {
+	ctx := context.Background()
+	store, _, manager := testRobot(t, false)
+	outbox := manager.outbox
+
+	command, err := outbox.Enqueue(ctx, "j1", "t1", protocol.CommandStartTrip, protocol.StartTrip{JourneyID: "j1", TripID: "t1", RoomID: "b"})
+	if err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+	command.Attempts = maxDeliveryAttempts
+	store.PutCommand(ctx, command)
+	if command, err = outbox.deliver(ctx, command, time.Now()); err != nil {
+		t.Fatalf("deliver: %v", err)
+	}
+	if command.Status != CommandFailed || command.NextAttemptAt != 0 {
+		t.Errorf("command is %s, due at %d, want failed and not due", command.Status, command.NextAttemptAt)
+	}
+	checkTrips(t, store, map[string]TripState{"t1": TripFailed, "t2": TripCancelled})
+	if journey, _ := store.GetJourney(ctx, "j1"); journey.CurrentState() != JourneyAborted {
+		t.Errorf("journey is %s, want aborted", journey.CurrentState())
+	}
+}
+
+func TestAbandonTrip(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	outbox := Outbox{transactor: store, commands: store, trips: store, journeys: store}
+	store.PutJourney(ctx, Journey{ID: "j1", State: JourneyActive, Trips: []string{"t1", "t2", "t3"}})
+	store.PutTrip(ctx, Trip{ID: "t1", JourneyID: "j1", State: TripArrived})
+	store.PutTrip(ctx, Trip{ID: "t2", JourneyID: "j1", State: TripInProgress})
+	store.PutTrip(ctx, Trip{ID: "t3", JourneyID: "j1", State: TripPlanned})
+
+	trip, err := abandonTrip(ctx, outbox, store, store, "t2")
+	if err != nil {
+		t.Fatalf("abandonTrip: %v", err)
+	}
+	if trip.State != TripFailed {
+		t.Errorf("abandoned trip is %s, want %s", trip.State, TripFailed)
+	}
+	journey, _ := store.GetJourney(ctx, "j1")
+	if journey.State != JourneyAborted || !journey.Finished {
+		t.Errorf("journey is %s, finished %v, want aborted and finished", journey.State, journey.Finished)
+	}
+	for id, want := range map[string]TripState{"t1": TripArrived, "t2": TripFailed, "t3": TripCancelled} {
+		if trip, _ := store.GetTrip(ctx, id); trip.State != want {
+			t.Errorf("trip %s is %s, want %s", id, trip.State, want)
+		}
+	}
+
+	if _, err := abandonTrip(ctx, outbox, store, store, "t2"); !isConflict(err) {
+		t.Errorf("abandoning a failed trip = %v, want a conflict", err)
+	}
+}
+
+func TestGetCommands(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	store.PutJourney(ctx, Journey{ID: "j1", State: JourneyActive})
+	store.PutJourney(ctx, Journey{ID: "j2", State: JourneyActive})
+	for _, command := range []Command{
+		{ID: "c1", JourneyID: "j1", Status: CommandAcknowledged, CreatedAt: 1},
+		{ID: "c2", JourneyID: "j1", Status: CommandPending, CreatedAt: 2},
+		{ID: "c3", JourneyID: "j2", Status: CommandPending, CreatedAt: 3},
+		{ID: "c4", JourneyID: "j1", Status: CommandFailed, CreatedAt: 4},
+	} {
+		store.PutCommand(ctx, command)
+	}
+	manager := JourneyManager{journeys: store, commands: store}
+
+	tests := []struct {
+		journey, query string
+		status         int
+		want           []string
+	}{
+		{"j1", "", http.StatusOK, []string{"c1", "c2", "c4"}},
+		{"j1", "?status=pending", http.StatusOK, []string{"c2"}},
+		{"j2", "?status=failed", http.StatusOK, []string{}},
+		{"j1", "?status=lost", http.StatusBadRequest, nil},
+		{"j9", "", http.StatusNotFound, nil},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/journeys/"+test.journey+"/commands"+test.query, nil)
+		r = mux.SetURLVars(r, map[string]string{"journeyid": test.journey})
+		w := httptest.NewRecorder()
+		manager.GetCommands(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s%s: status %d, want %d", test.journey, test.query, w.Code, test.status)
+			continue
+		}
+		if test.want == nil {
+			continue
+		}
+		commands := []Command{}
+		json.Unmarshal(w.Body.Bytes(), &commands)
+		ids := []string{}
+		for _, command := range commands {
+			ids = append(ids, command.ID)
+		}
+		if !reflect.DeepEqual(ids, test.want) {
+			t.Errorf("%s%s listed %v, want %v", test.journey, test.query, ids, test.want)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sort"
+)
+
+// patchBody applies the JSON Merge Patch (RFC 7386) in the body of r
+// to target, which must point to an entity. Only the top-level fields
+// named in allowed may appear in the patch; a null value resets a
+// field to its zero value.
+func patchBody(r *http.Request, target interface{}, allowed []string) error {
+	patch, err := readPatch(r, allowed)
+	if err != nil {
+		return err
+	}
+	return applyPatch(target, patch)
+}
+
+// readPatch reads the JSON Merge Patch in the body of r, checking that
+// it only changes the top-level fields named in allowed. It is read
+// once, before a transaction that may run applyPatch more than once.
+func readPatch(r *http.Request, allowed []string) (map[string]interface{}, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	patch := map[string]interface{}{}
+	if err := json.Unmarshal(body, &patch); err != nil {
+		return nil, malformed(err)
+	}
+	fields := make([]string, 0, len(patch))
+	for field := range patch {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	errs := FieldErrors{}
+	for _, field := range fields {
+		if !contains(allowed, field) {
+			errs.Add(field, "cannot be changed")
+		}
+	}
+	return patch, errs.Err()
+}
+
+// readFields reads the entity in the body of r into target, which must
+// point to a new entity, keeping only the top-level fields named in
+// allowed. Clients may send back an entity as they got it, so the
+// fields the server maintains are dropped rather than refused.
+func readFields(r *http.Request, target interface{}, allowed []string) error {
+	patch, err := readReplacement(r, allowed)
+	if err != nil {
+		return err
+	}
+	return applyPatch(target, patch)
+}
+
+// readReplacement reads the entity in the body of r as a JSON Merge
+// Patch that sets every top-level field named in allowed, resetting
+// the ones the body leaves out. Other fields are dropped, as they are
+// by readFields.
+func readReplacement(r *http.Request, allowed []string) (map[string]interface{}, error) {
+	fields := map[string]interface{}{}
+	if err := decodeBody(r, &fields); err != nil {
+		return nil, err
+	}
+	patch := make(map[string]interface{}, len(allowed))
+	for _, field := range allowed {
+		patch[field] = fields[field]
+	}
+	return patch, nil
+}
+
+// checkFixed reports every field named in fixed that patch would
+// change on target, which must point to an entity.
+func checkFixed(target interface{}, patch map[string]interface{}, fixed ...string) error {
+	document, err := toDocument(target)
+	if err != nil {
+		return err
+	}
+	errs := FieldErrors{}
+	for _, field := range fixed {
+		if !reflect.DeepEqual(document[field], patch[field]) {
+			errs.Add(field, "cannot be changed")
+		}
+	}
+	return errs.Err()
+}
+
+// applyPatch applies patch to target, which must point to an entity.
+func applyPatch(target interface{}, patch map[string]interface{}) error {
+	document, err := toDocument(target)
+	if err != nil {
+		return err
+	}
+	merged, err := json.Marshal(mergePatch(document, patch))
+	if err != nil {
+		return err
+	}
+	value := reflect.ValueOf(target).Elem()
+	value.Set(reflect.Zero(value.Type()))
+	if err := json.Unmarshal(merged, target); err != nil {
+		return malformed(err)
+	}
+	return nil
+}
+
+// mergePatch implements the MergePatch function of RFC 7386.
+func mergePatch(target interface{}, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = map[string]interface{}{}
+	}
+	for name, value := range patchObject {
+		if value == nil {
+			delete(targetObject, name)
+		} else {
+			targetObject[name] = mergePatch(targetObject[name], value)
+		}
+	}
+	return targetObject
+}
+
+// diffPatch returns the JSON Merge Patch turning from into to. Since
+// a merge patch cannot set a field to null, null fields of to end up
+// absent, which decodes to the same entity.
+func diffPatch(from, to map[string]interface{}) map[string]interface{} {
+	patch := map[string]interface{}{}
+	for name := range from {
+		if _, ok := to[name]; !ok {
+			patch[name] = nil
+		}
+	}
+	for name, value := range to {
+		old, ok := from[name]
+		if ok && reflect.DeepEqual(old, value) {
+			continue
+		}
+		oldObject, oldIsObject := old.(map[string]interface{})
+		object, isObject := value.(map[string]interface{})
+		switch {
+		case oldIsObject && isObject:
+			patch[name] = diffPatch(oldObject, object)
+		case value == nil:
+			if ok {
+				patch[name] = nil
+			}
+		default:
+			patch[name] = value
+		}
+	}
+	return patch
+}
+
+// toDocument converts v to the generic form of its JSON encoding,
+// which must be an object.
+func toDocument(v interface{}) (map[string]interface{}, error) {
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	document := map[string]interface{}{}
+	return document, json.Unmarshal(encoded, &document)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// without returns values less every occurrence of value.
+func without(values []string, value string) []string {
+	kept := []string{}
+	for _, v := range values {
+		if v != value {
+			kept = append(kept, v)
+		}
+	}
+	return kept
+}
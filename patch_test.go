@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func patchRequest(body string) *http.Request {
+	return httptest.NewRequest(http.MethodPatch, "/", strings.NewReader(body))
+}
+
+func TestPatchBodyApplies(t *testing.T) {
+	room := Room{
+		ID:            "r1",
+		Name:          "Library",
+		Description:   "Quiet",
+		Pose:          Pose{Floor: 1, X: 10, Y: 20},
+		Tags:          []string{"books"},
+		Accessibility: Accessibility{StepFree: true, Notes: "Lift at the back"},
+	}
+	body := `{"name": "Reading room", "tags": null, "pose": {"x": 15}, "accessibility": {"notes": null}}`
+	if err := patchBody(patchRequest(body), &room, RoomPatchFields); err != nil {
+		t.Fatalf("patchBody: %v", err)
+	}
+	want := Room{
+		ID:            "r1",
+		Name:          "Reading room",
+		Description:   "Quiet",
+		Pose:          Pose{Floor: 1, X: 15, Y: 20},
+		Accessibility: Accessibility{StepFree: true},
+	}
+	if !reflect.DeepEqual(room, want) {
+		t.Errorf("patched room = %+v, want %+v", room, want)
+	}
+}
+
+func TestPatchBodyAllowlist(t *testing.T) {
+	user := User{ID: "u1", FirstName: "Ada", Journeys: []string{"j1"}}
+	err := patchBody(patchRequest(`{"id": "u2", "first_name": "Grace", "journeys": []}`), &user, UserPatchFields)
+	e, ok := err.(*Error)
+	if !ok || e.Code != CodeInvalid {
+		t.Fatalf("patchBody = %v, want an invalid request error", err)
+	}
+	want := FieldErrors{
+		{Field: "id", Message: "cannot be changed"},
+		{Field: "journeys", Message: "cannot be changed"},
+	}
+	if !reflect.DeepEqual(e.Details, want) {
+		t.Errorf("patchBody details = %+v, want %+v", e.Details, want)
+	}
+	if user.ID != "u1" || user.FirstName != "Ada" || len(user.Journeys) != 1 {
+		t.Errorf("patchBody changed %+v despite rejecting the patch", user)
+	}
+}
+
+func TestPatchBodyMalformed(t *testing.T) {
+	for _, body := range []string{``, `[]`, `{"name": }`} {
+		journey := Journey{ID: "j1", Name: "Tour"}
+		err := patchBody(patchRequest(body), &journey, JourneyPatchFields)
+		if e, ok := err.(*Error); !ok || e.Code != ErrMalformedBody.Code || e.Message != ErrMalformedBody.Message {
+			t.Errorf("patchBody(%q) = %v, want ErrMalformedBody", body, err)
+		}
+		if journey.Name != "Tour" {
+			t.Errorf("patchBody(%q) changed the journey", body)
+		}
+	}
+}
+
+func TestDiffPatch(t *testing.T) {
+	from := map[string]interface{}{
+		"name": "Library",
+		"tags": []interface{}{"books"},
+		"pose": map[string]interface{}{"x": 1.0, "y": 2.0},
+	}
+	to := map[string]interface{}{
+		"name":     "Library",
+		"pose":     map[string]interface{}{"x": 1.0, "y": 3.0},
+		"category": "study",
+	}
+	want := map[string]interface{}{
+		"tags":     nil,
+		"pose":     map[string]interface{}{"y": 3.0},
+		"category": "study",
+	}
+	patch := diffPatch(from, to)
+	if !reflect.DeepEqual(patch, want) {
+		t.Errorf("diffPatch = %v, want %v", patch, want)
+	}
+	if merged := mergePatch(from, patch); !reflect.DeepEqual(merged, to) {
+		t.Errorf("merging the diff gives %v, want %v", merged, to)
+	}
+}
+
+func TestReadFieldsDropsServerFields(t *testing.T) {
+	body := `{"id": "j9", "user_id": "u1", "name": "Tour", "trips": ["t1"], "latest_trip": "t1", "start_at": 100, "Finished": true, "state": "completed"}`
+	var journey Journey
+	if err := readFields(patchRequest(body), &journey, JourneyCreateFields); err != nil {
+		t.Fatalf("readFields: %v", err)
+	}
+	want := Journey{User: "u1", Name: "Tour"}
+	if !reflect.DeepEqual(journey, want) {
+		t.Errorf("read journey = %+v, want %+v", journey, want)
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+)
+
+// Travel times the planner weighs routes by.
+const (
+	robotSpeed           = 0.5 // meters per second
+	elevatorTransferTime = 45  // seconds calling, boarding and leaving an elevator
+	elevatorFloorTime    = 5   // seconds per floor ridden
+)
+
+// defaultResolution is the meters per map pixel assumed for rooms on
+// floors that are not mapped yet, the map_server default.
+const defaultResolution = 0.05
+
+var ErrUnreachable = &Error{Code: CodeNotFound, Entity: "route", Message: "no route between the rooms"}
+
+// RoutePlan is the fastest way between two rooms. Waypoints start at
+// From and end at To. Distance is in meters, leaving out elevator
+// rides, and Duration in seconds.
+type RoutePlan struct {
+	From      string     `json:"from"`
+	To        string     `json:"to"`
+	Waypoints []Waypoint `json:"waypoints"`
+	Distance  float64    `json:"distance"`
+	Duration  float64    `json:"duration"`
+}
+
+// Waypoint is a room along a route, reached through the edge or
+// connector Via, of kind ViaKind. The first waypoint has neither.
+type Waypoint struct {
+	RoomID  string `json:"room_id"`
+	Pose    Pose   `json:"pose"`
+	Via     string `json:"via,omitempty"`
+	ViaKind string `json:"via_kind,omitempty"`
+}
+
+// GetRoute serves the plan from the room in the from query parameter
+// to the one in to.
+func (manager MapManager) GetRoute(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	encoder := json.NewEncoder(w)
+
+	from, to := r.URL.Query().Get("from"), r.URL.Query().Get("to")
+	errs := FieldErrors{}
+	if from == "" {
+		errs.Add("from", "is required")
+	}
+	if to == "" {
+		errs.Add("to", "is required")
+	}
+	if queryErr := errs.Err(); queryErr != nil {
+		WriteError(w, queryErr)
+		return
+	}
+	graph, dataErr := manager.graph(ctx)
+	if dataErr != nil {
+		WriteError(w, dataErr)
+		return
+	}
+	plan, planErr := graph.plan(ctx, from, to)
+	if planErr != nil {
+		WriteError(w, planErr)
+		return
+	}
+	encoder.Encode(plan)
+}
+
+// roomGraph is the building map as a graph of rooms, linked by the
+// edges and elevators the robot can currently use.
+type roomGraph struct {
+	rooms RoomStore
+	known map[string]Room
+	links map[string][]roomLink
+}
+
+// roomLink leads to a neighbouring room through an edge or elevator.
+type roomLink struct {
+	to       string
+	via      string
+	kind     string
+	distance float64
+	duration float64
+}
+
+// graph builds the roomGraph of the building. Edges and connectors
+// that are blocked, or whose rooms no longer exist, are left out, as
+// are stairs.
+func (manager MapManager) graph(ctx context.Context) (*roomGraph, error) {
+	building, dataErr := manager.load(ctx)
+	if dataErr != nil {
+		return nil, dataErr
+	}
+	resolutions := map[int]float64{}
+	for _, floor := range building.Floors {
+		resolutions[floor.Level] = floor.Resolution
+	}
+	graph := &roomGraph{rooms: manager.rooms, known: map[string]Room{}, links: map[string][]roomLink{}}
+
+	for _, edge := range building.Edges {
+		if edge.Blocked {
+			continue
+		}
+		rooms, dataErr := graph.load(ctx, edge.From, edge.To)
+		if dataErr != nil {
+			return nil, dataErr
+		} else if len(rooms) < 2 {
+			continue
+		}
+		distance := edge.Length
+		if distance == 0 {
+			resolution, ok := resolutions[rooms[0].Pose.Floor]
+			if !ok {
+				resolution = defaultResolution
+			}
+			dx, dy := float64(rooms[1].Pose.X-rooms[0].Pose.X), float64(rooms[1].Pose.Y-rooms[0].Pose.Y)
+			distance = math.Hypot(dx, dy) * resolution
+		}
+		graph.link(rooms[0].ID, rooms[1].ID, roomLink{via: edge.ID, kind: string(edge.Kind), distance: distance, duration: distance / robotSpeed})
+	}
+
+	for _, connector := range building.Connectors {
+		if connector.Kind != ConnectorElevator || connector.Blocked {
+			continue
+		}
+		rooms, dataErr := graph.load(ctx, connector.Rooms...)
+		if dataErr != nil {
+			return nil, dataErr
+		}
+		for i, from := range rooms {
+			for _, to := range rooms[i+1:] {
+				floors := math.Abs(float64(to.Pose.Floor - from.Pose.Floor))
+				graph.link(from.ID, to.ID, roomLink{via: connector.ID, kind: string(connector.Kind), duration: elevatorTransferTime + elevatorFloorTime*floors})
+			}
+		}
+	}
+	return graph, nil
+}
+
+// load returns those of the rooms with the given IDs that exist,
+// caching them on graph.
+func (graph *roomGraph) load(ctx context.Context, ids ...string) ([]Room, error) {
+	rooms := []Room{}
+	for _, id := range ids {
+		room, ok := graph.known[id]
+		if !ok {
+			var dataErr error
+			room, dataErr = graph.rooms.GetRoom(ctx, id)
+			if dataErr == ErrRoomMissing {
+				continue
+			} else if dataErr != nil {
+				return nil, dataErr
+			}
+			graph.known[id] = room
+		}
+		rooms = append(rooms, room)
+	}
+	return rooms, nil
+}
+
+// link joins a and b both ways.
+func (graph *roomGraph) link(a, b string, link roomLink) {
+	link.to = b
+	graph.links[a] = append(graph.links[a], link)
+	link.to = a
+	graph.links[b] = append(graph.links[b], link)
+}
+
+// plan finds the fastest route from one room to another with
+// Dijkstra's algorithm. Explicit edge lengths need not bound the
+// straight-line distance between rooms, so there is no admissible
+// heuristic for A*, and buildings are small enough not to need one.
+func (graph *roomGraph) plan(ctx context.Context, from, to string) (RoutePlan, error) {
+	for _, id := range []string{from, to} {
+		if rooms, dataErr := graph.load(ctx, id); dataErr != nil {
+			return RoutePlan{}, dataErr
+		} else if len(rooms) == 0 {
+			return RoutePlan{}, withID(ErrRoomMissing, id)
+		}
+	}
+
+	durations := map[string]float64{from: 0}
+	previous := map[string]roomLink{}
+	queue := &roomQueue{{room: from}}
+	for queue.Len() > 0 {
+		item := heap.Pop(queue).(roomQueueItem)
+		if item.duration > durations[item.room] {
+			continue
+		}
+		if item.room == to {
+			break
+		}
+		for _, link := range graph.links[item.room] {
+			duration := item.duration + link.duration
+			if known, ok := durations[link.to]; ok && known <= duration {
+				continue
+			}
+			durations[link.to] = duration
+			previous[link.to] = roomLink{to: item.room, via: link.via, kind: link.kind, distance: link.distance}
+			heap.Push(queue, roomQueueItem{room: link.to, duration: duration})
+		}
+	}
+	if _, ok := durations[to]; !ok {
+		e := *ErrUnreachable
+		e.Details = map[string]string{"from": from, "to": to}
+		return RoutePlan{}, &e
+	}
+
+	plan := RoutePlan{From: from, To: to, Duration: durations[to]}
+	for room := to; ; {
+		waypoint := Waypoint{RoomID: room, Pose: graph.known[room].Pose}
+		if room == from {
+			plan.Waypoints = append(plan.Waypoints, waypoint)
+			break
+		}
+		link := previous[room]
+		waypoint.Via, waypoint.ViaKind = link.via, link.kind
+		plan.Waypoints = append(plan.Waypoints, waypoint)
+		plan.Distance += link.distance
+		room = link.to
+	}
+	for i, j := 0, len(plan.Waypoints)-1; i < j; i, j = i+1, j-1 {
+		plan.Waypoints[i], plan.Waypoints[j] = plan.Waypoints[j], plan.Waypoints[i]
+	}
+	return plan, nil
+}
+
+// roomQueue is a min-heap of rooms by the time taken to reach them.
+type roomQueue []roomQueueItem
+
+type roomQueueItem struct {
+	room     string
+	duration float64
+}
+
+func (q roomQueue) Len() int            { return len(q) }
+func (q roomQueue) Less(i, j int) bool  { return q[i].duration < q[j].duration }
+func (q roomQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *roomQueue) Push(x interface{}) { *q = append(*q, x.(roomQueueItem)) }
+
+func (q *roomQueue) Pop() interface{} {
+	old := *q
+	item := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return item
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+// testMap stores a building of two floors: a, b and c on the ground
+// floor, with a shortcut from a to c that is slower than going through
+// b and a blocked edge from a to b, and d and e upstairs, reached from
+// c by elevator. f is on neither route.
+func testMap() (*MemoryStore, MapManager) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	for _, room := range []Room{
+		{ID: "a", Pose: Pose{Floor: 0, X: 0, Y: 0}},
+		{ID: "b", Pose: Pose{Floor: 0, X: 200, Y: 0}},
+		{ID: "c", Pose: Pose{Floor: 0, X: 200, Y: 200}},
+		{ID: "d", Pose: Pose{Floor: 2, X: 200, Y: 200}},
+		{ID: "e", Pose: Pose{Floor: 2, X: 0, Y: 200}},
+		{ID: "f", Pose: Pose{Floor: 0, X: 400, Y: 400}},
+	} {
+		store.PutRoom(ctx, room)
+	}
+	for _, edge := range []Edge{
+		{ID: "ab", From: "a", To: "b", Kind: EdgeCorridor, Length: 10},
+		{ID: "ab2", From: "a", To: "b", Kind: EdgeCorridor, Length: 1, Blocked: true},
+		{ID: "bc", From: "b", To: "c", Kind: EdgeDoorway},
+		{ID: "ac", From: "a", To: "c", Kind: EdgeCorridor, Length: 30},
+		{ID: "de", From: "d", To: "e", Kind: EdgeCorridor, Length: 10},
+	} {
+		store.PutEdge(ctx, edge)
+	}
+	store.PutConnector(ctx, Connector{ID: "lift", Kind: ConnectorElevator, Rooms: []string{"c", "d"}})
+	store.PutConnector(ctx, Connector{ID: "stairs", Kind: ConnectorStairs, Rooms: []string{"a", "e"}})
+	return store, MapManager{transactor: store, floors: store, edges: store, connectors: store, rooms: store}
+}
+
+func TestPlan(t *testing.T) {
+	ctx := context.Background()
+	_, maps := testMap()
+	graph, err := maps.graph(ctx)
+	if err != nil {
+		t.Fatalf("graph: %v", err)
+	}
+
+	plan, err := graph.plan(ctx, "a", "e")
+	if err != nil {
+		t.Fatalf("plan: %v", err)
+	}
+	want := []Waypoint{
+		{RoomID: "a", Pose: Pose{Floor: 0, X: 0, Y: 0}},
+		{RoomID: "b", Pose: Pose{Floor: 0, X: 200, Y: 0}, Via: "ab", ViaKind: "corridor"},
+		{RoomID: "c", Pose: Pose{Floor: 0, X: 200, Y: 200}, Via: "bc", ViaKind: "doorway"},
+		{RoomID: "d", Pose: Pose{Floor: 2, X: 200, Y: 200}, Via: "lift", ViaKind: "elevator"},
+		{RoomID: "e", Pose: Pose{Floor: 2, X: 0, Y: 200}, Via: "de", ViaKind: "corridor"},
+	}
+	if !reflect.DeepEqual(plan.Waypoints, want) {
+		t.Errorf("plan waypoints = %+v, want %+v", plan.Waypoints, want)
+	}
+	// The doorway has no length, so it is measured on the default
+	// resolution of the unmapped floor.
+	if distance := 10 + 200*defaultResolution + 10; plan.Distance != distance {
+		t.Errorf("plan distance = %v, want %v", plan.Distance, distance)
+	}
+	if duration := 30/robotSpeed + elevatorTransferTime + 2*elevatorFloorTime; plan.Duration != duration {
+		t.Errorf("plan duration = %v, want %v", plan.Duration, duration)
+	}
+
+	if plan, err := graph.plan(ctx, "b", "b"); err != nil || len(plan.Waypoints) != 1 || plan.Duration != 0 {
+		t.Errorf("plan to the same room = %+v, %v, want a single waypoint", plan, err)
+	}
+}
+
+func TestPlanFailures(t *testing.T) {
+	ctx := context.Background()
+	store, maps := testMap()
+	graph, err := maps.graph(ctx)
+	if err != nil {
+		t.Fatalf("graph: %v", err)
+	}
+
+	_, err = graph.plan(ctx, "a", "f")
+	if e, ok := err.(*Error); !ok || e.Message != ErrUnreachable.Message {
+		t.Errorf("plan to an isolated room = %v, want ErrUnreachable", err)
+	}
+	_, err = graph.plan(ctx, "a", "nowhere")
+	if e, ok := err.(*Error); !ok || e.Message != ErrRoomMissing.Message || e.ID != "nowhere" {
+		t.Errorf("plan to a missing room = %v, want ErrRoomMissing", err)
+	}
+
+	store.PutConnector(ctx, Connector{ID: "lift", Kind: ConnectorElevator, Rooms: []string{"c", "d"}, Blocked: true})
+	graph, err = maps.graph(ctx)
+	if err != nil {
+		t.Fatalf("graph: %v", err)
+	}
+	if _, err := graph.plan(ctx, "a", "e"); err == nil {
+		t.Error("plan through a blocked elevator succeeded, want no route")
+	}
+}
+
+func TestReversePlan(t *testing.T) {
+	ctx := context.Background()
+	_, maps := testMap()
+	graph, err := maps.graph(ctx)
+	if err != nil {
+		t.Fatalf("graph: %v", err)
+	}
+	forward, err := graph.plan(ctx, "a", "d")
+	if err != nil {
+		t.Fatalf("plan: %v", err)
+	}
+	backward, err := graph.plan(ctx, "d", "a")
+	if err != nil {
+		t.Fatalf("plan: %v", err)
+	}
+	if reversed := reversePlan(forward); !reflect.DeepEqual(reversed, backward) {
+		t.Errorf("reversePlan = %+v, want %+v", reversed, backward)
+	}
+}
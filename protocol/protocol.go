@@ -0,0 +1,155 @@
+// Package protocol defines the messages exchanged between the backend
+// and the ROS bridge on the robot. Every message travels in an
+// Envelope whose payload is one of the command or event types below;
+// the JSON schemas in schema/ describe the same messages for the
+// bridge.
+package protocol
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Version is the protocol version this package speaks. Receivers
+// reject messages from a newer version.
+const Version = 1
+
+// Commands, sent from the backend to the robot.
+const (
+	CommandStartTrip  = "start_trip"
+	CommandCancel     = "cancel"
+	CommandPause      = "pause"
+	CommandResume     = "resume"
+	CommandReturnHome = "return_home"
+)
+
+// Events, sent from the robot to the backend.
+const (
+	EventGoalReached = "goal_reached"
+	EventGoalAborted = "goal_aborted"
+	EventPosition    = "position"
+	EventBattery     = "battery"
+	EventAck         = "ack"
+)
+
+var ErrUnsupportedVersion = errors.New("protocol: unsupported version")
+
+// Envelope wraps every message. CorrelationID is unique per command;
+// events answering a command carry the command's CorrelationID.
+// Commands are redelivered until the robot answers them, so the robot
+// must ignore a CorrelationID it has already handled.
+// Timestamp is in Unix seconds.
+type Envelope struct {
+	Type          string          `json:"type"`
+	Version       int             `json:"version"`
+	CorrelationID string          `json:"correlation_id"`
+	Timestamp     int64           `json:"timestamp"`
+	Payload       json.RawMessage `json:"payload,omitempty"`
+}
+
+// NewEnvelope wraps payload in an Envelope of the given type with a
+// fresh correlation id.
+func NewEnvelope(messageType string, payload interface{}) (Envelope, error) {
+	id, err := NewCorrelationID()
+	if err != nil {
+		return Envelope{}, err
+	}
+	return Reply(messageType, id, payload)
+}
+
+// Reply wraps payload in an Envelope answering the message with the
+// given correlation id.
+func Reply(messageType, correlationID string, payload interface{}) (Envelope, error) {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return Envelope{}, err
+	}
+	return Envelope{
+		Type:          messageType,
+		Version:       Version,
+		CorrelationID: correlationID,
+		Timestamp:     time.Now().UTC().Unix(),
+		Payload:       raw,
+	}, nil
+}
+
+// Decode unmarshals the payload of e into v after checking that e
+// is of a version this package understands.
+func (e Envelope) Decode(v interface{}) error {
+	if e.Version < 1 || e.Version > Version {
+		return fmt.Errorf("%v %d", ErrUnsupportedVersion, e.Version)
+	}
+	if len(e.Payload) == 0 {
+		return nil
+	}
+	return json.Unmarshal(e.Payload, v)
+}
+
+// NewCorrelationID returns a random 128-bit identifier in hex.
+func NewCorrelationID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// Pose is a position in the building: a floor and coordinates on
+// that floor's map.
+type Pose struct {
+	Floor int `json:"z"`
+	X     int `json:"x"`
+	Y     int `json:"y"`
+}
+
+// StartTrip sends the robot to Target for the given trip.
+type StartTrip struct {
+	JourneyID string `json:"journey_id"`
+	TripID    string `json:"trip_id"`
+	RoomID    string `json:"room_id"`
+	Target    Pose   `json:"target"`
+}
+
+// Cancel abandons the trip in progress.
+type Cancel struct {
+	TripID string `json:"trip_id"`
+}
+
+// Pause halts the robot where it is until it receives Resume.
+type Pause struct{}
+
+// Resume continues the trip that was paused.
+type Resume struct{}
+
+// ReturnHome sends the robot back to its charging station.
+type ReturnHome struct{}
+
+// GoalReached reports that the robot arrived for a trip.
+type GoalReached struct {
+	TripID string `json:"trip_id"`
+}
+
+// GoalAborted reports that the robot gave up on a trip.
+type GoalAborted struct {
+	TripID string `json:"trip_id"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// Position reports where the robot is.
+type Position struct {
+	Pose Pose `json:"pose"`
+}
+
+// Battery reports the robot's remaining charge in percent.
+type Battery struct {
+	Percent float64 `json:"percent"`
+}
+
+// Ack acknowledges the command with the envelope's CorrelationID.
+// Until it arrives, or an event answering the command does, the
+// backend keeps redelivering the command.
+type Ack struct{}
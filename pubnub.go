@@ -1,45 +1,106 @@
 package main
 
 import (
-	"github.com/pubnub/go/messaging"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
-)
+	"os"
 
-const (
-	PubKey = "pub-c-5277d936-a028-41b2-8774-f7f7cb8d2102"
-	SubKey = "sub-c-056c9aec-d84b-11e6-b9cf-02ee2ddab7fe"
-	SecKey = "sec-c-NTVmYWEyYjYtMzU5OC00YTJlLTgwNjAtNTdiMzlmOGU1Nzk1"
-	CipKey = ""
-	SSL    = false
-	UUID   = ""
-	Channel = "unicub"
+	"github.com/pubnub/go/messaging"
 )
 
-type PubnubManager struct {
-	*messaging.Pubnub
+// PubnubConfig holds the credentials and channels of a PubNub bus.
+// Messages to the robot go to Channel, messages from it arrive on
+// StatusChannel.
+type PubnubConfig struct {
+	PublishKey    string
+	SubscribeKey  string
+	SecretKey     string
+	CipherKey     string
+	SSL           bool
+	UUID          string
+	Channel       string
+	StatusChannel string
 }
 
-type MessageStart struct {
-	UserID string `json:"user_id"`
-	JourneyID string `json:"journey_id"`
+// PubnubConfigFromEnv reads a PubnubConfig from the PUBNUB_*
+// environment variables.
+func PubnubConfigFromEnv() PubnubConfig {
+	channel := getenv("PUBNUB_CHANNEL", "unicub")
+	return PubnubConfig{
+		PublishKey:    os.Getenv("PUBNUB_PUBLISH_KEY"),
+		SubscribeKey:  os.Getenv("PUBNUB_SUBSCRIBE_KEY"),
+		SecretKey:     os.Getenv("PUBNUB_SECRET_KEY"),
+		CipherKey:     os.Getenv("PUBNUB_CIPHER_KEY"),
+		SSL:           getenvBool("PUBNUB_SSL", false),
+		UUID:          os.Getenv("PUBNUB_UUID"),
+		Channel:       channel,
+		StatusChannel: getenv("PUBNUB_STATUS_CHANNEL", channel+"-status"),
+	}
 }
 
-func (manager *PubnubManager) Initialize() {
-	manager.Pubnub = messaging.NewPubnub(PubKey, SubKey, SecKey, CipKey, SSL, UUID)
+// PubnubManager is a Bus exchanging messages over PubNub.
+type PubnubManager struct {
+	*messaging.Pubnub
+	channel       string
+	statusChannel string
 }
 
-func (manager *PubnubManager) PublishJSON(message interface{}) {
-	jsonMsg, _ := json.Marshal(message)
+func NewPubnubManager(config PubnubConfig) (*PubnubManager, error) {
+	if config.PublishKey == "" || config.SubscribeKey == "" {
+		return nil, errors.New("pubnub: publish and subscribe keys are required")
+	}
+	return &PubnubManager{
+		Pubnub:        messaging.NewPubnub(config.PublishKey, config.SubscribeKey, config.SecretKey, config.CipherKey, config.SSL, config.UUID),
+		channel:       config.Channel,
+		statusChannel: config.StatusChannel,
+	}, nil
+}
+
+func (manager *PubnubManager) PublishJSON(message interface{}) error {
+	jsonMsg, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
 	successChannel := make(chan []byte)
 	errorChannel := make(chan []byte)
-	go manager.Publish(Channel, jsonMsg, successChannel, errorChannel)
+	go manager.Publish(manager.channel, jsonMsg, successChannel, errorChannel)
 	select {
 	case response := <-successChannel:
 		log.Println(string(response))
+		return nil
 	case err := <-errorChannel:
-		log.Println(string(err))
+		return fmt.Errorf("pubnub: %s", err)
 	case <-messaging.Timeout():
-		log.Println("Publish() timeout")
+		return ErrPublishTimeout
 	}
-}
\ No newline at end of file
+}
+
+// Subscribe listens on the status channel in the background. PubNub
+// delivers messages in batches of the form [[messages...], timetoken,
+// channel]; anything else, such as connection notices, is logged.
+func (manager *PubnubManager) Subscribe(handle func(message []byte)) error {
+	successChannel := make(chan []byte)
+	errorChannel := make(chan []byte)
+	go manager.Pubnub.Subscribe(manager.statusChannel, "", successChannel, errorChannel, false)
+	go func() {
+		for {
+			select {
+			case response := <-successChannel:
+				var batch []json.RawMessage
+				var messages []json.RawMessage
+				if json.Unmarshal(response, &batch) != nil || len(batch) == 0 || json.Unmarshal(batch[0], &messages) != nil {
+					log.Println(string(response))
+					continue
+				}
+				for _, message := range messages {
+					handle(message)
+				}
+			case err := <-errorChannel:
+				log.Printf("pubnub: %s", err)
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Weights of the parts of a room's recommendation score.
+const (
+	tagMatchScore    = 1.0 // per tag of the room the user likes
+	gradeFitScore    = 1.0 // for a room suiting the user's grade
+	gradeMissPenalty = 0.5 // per grade the user is outside the room's range
+	visitPenalty     = 1.5 // per earlier trip to the room
+)
+
+// defaultRecommendations is how many rooms are recommended unless the
+// limit query parameter says otherwise.
+const defaultRecommendations = 5
+
+// Recommendation is a room suggested to a user and why: the tags the
+// user likes, whether the room suits their grade and how often they
+// have been taken there before.
+type Recommendation struct {
+	Room        Room     `json:"room"`
+	Score       float64  `json:"score"`
+	MatchedTags []string `json:"matched_tags"`
+	GradeFit    bool     `json:"grade_fit"`
+	Visits      int      `json:"visits"`
+}
+
+// ResponseRecommendations lists recommendations best first. Rooms are
+// their IDs, ready to be planned as a tour with POST /journeys/plan.
+type ResponseRecommendations struct {
+	UserID          string           `json:"user_id"`
+	Rooms           []string         `json:"rooms"`
+	Recommendations []Recommendation `json:"recommendations"`
+}
+
+// RecommendRooms serves the rooms that best match the user's likes
+// and grade, favouring ones they have not visited. The limit query
+// parameter caps how many, up to the stops of a tour.
+func (manager UserManager) RecommendRooms(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := mux.Vars(r)["userid"]
+	encoder := json.NewEncoder(w)
+
+	limit := defaultRecommendations
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxTourStops {
+			errs := FieldErrors{}
+			errs.Add("limit", "must be between 1 and "+strconv.Itoa(maxTourStops))
+			WriteError(w, errs.Err())
+			return
+		}
+		limit = n
+	}
+	user, dataErr := manager.users.GetUser(ctx, userID)
+	if dataErr != nil {
+		WriteError(w, withID(dataErr, userID))
+		return
+	}
+	visits, dataErr := manager.visits(ctx, user)
+	if dataErr != nil {
+		WriteError(w, dataErr)
+		return
+	}
+	rooms, dataErr := allRooms(ctx, manager.rooms)
+	if dataErr != nil {
+		WriteError(w, dataErr)
+		return
+	}
+
+	recommendations := []Recommendation{}
+	for _, room := range rooms {
+		recommendation := recommend(user, room, visits[room.ID])
+		if recommendation.Score > 0 {
+			recommendations = append(recommendations, recommendation)
+		}
+	}
+	sort.Slice(recommendations, func(i, j int) bool {
+		if recommendations[i].Score != recommendations[j].Score {
+			return recommendations[i].Score > recommendations[j].Score
+		}
+		return recommendations[i].Room.ID < recommendations[j].Room.ID
+	})
+	if len(recommendations) > limit {
+		recommendations = recommendations[:limit]
+	}
+	response := ResponseRecommendations{UserID: user.ID, Rooms: []string{}, Recommendations: recommendations}
+	for _, recommendation := range recommendations {
+		response.Rooms = append(response.Rooms, recommendation.Room.ID)
+	}
+	encoder.Encode(response)
+}
+
+// recommend scores room for user, who has been taken there visits
+// times before.
+func recommend(user User, room Room, visits int) Recommendation {
+	recommendation := Recommendation{Room: room, MatchedTags: []string{}, Visits: visits}
+	for _, tag := range room.Tags {
+		for _, like := range user.Likes {
+			if strings.EqualFold(tag, like) {
+				recommendation.MatchedTags = append(recommendation.MatchedTags, tag)
+				break
+			}
+		}
+	}
+	recommendation.Score = tagMatchScore * float64(len(recommendation.MatchedTags))
+
+	switch {
+	case user.Grade < room.MinGrade:
+		recommendation.Score -= gradeMissPenalty * float64(room.MinGrade-user.Grade)
+	case room.MaxGrade != 0 && user.Grade > room.MaxGrade:
+		recommendation.Score -= gradeMissPenalty * float64(user.Grade-room.MaxGrade)
+	default:
+		recommendation.GradeFit = true
+		recommendation.Score += gradeFitScore
+	}
+	recommendation.Score -= visitPenalty * float64(visits)
+	return recommendation
+}
+
+// visits counts the trips of user's journeys that arrived at each
+// room. Journeys and trips deleted since are not counted.
+func (manager UserManager) visits(ctx context.Context, user User) (map[string]int, error) {
+	visits := map[string]int{}
+	for _, journeyID := range user.Journeys {
+		journey, dataErr := manager.journeys.GetJourney(ctx, journeyID)
+		if dataErr == ErrJourneyMissing {
+			continue
+		} else if dataErr != nil {
+			return nil, dataErr
+		}
+		for _, tripID := range journey.Trips {
+			trip, dataErr := manager.trips.GetTrip(ctx, tripID)
+			if dataErr == ErrTripMissing {
+				continue
+			} else if dataErr != nil {
+				return nil, dataErr
+			}
+			if trip.CurrentState() == TripArrived {
+				visits[trip.EndRoom]++
+			}
+		}
+	}
+	return visits, nil
+}
+
+// allRooms reads every room, a page at a time. It does not sort them,
+// since sorting leaves out rooms stored without the sort property.
+func allRooms(ctx context.Context, rooms RoomStore) ([]Room, error) {
+	found := []Room{}
+	query := ListQuery{Limit: maxPageSize}
+	for {
+		page, next, dataErr := rooms.ListRooms(ctx, query)
+		if dataErr != nil {
+			return nil, dataErr
+		}
+		found = append(found, page...)
+		if next == "" {
+			return found, nil
+		}
+		query.Cursor = next
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestRecommend(t *testing.T) {
+	user := User{Grade: 3, Likes: []string{"Space", "robots"}}
+	tests := []struct {
+		room     Room
+		visits   int
+		score    float64
+		tags     []string
+		gradeFit bool
+	}{
+		{Room{Tags: []string{"space", "robots"}}, 0, 3, []string{"space", "robots"}, true},
+		{Room{Tags: []string{"dinosaurs"}, MinGrade: 1, MaxGrade: 5}, 0, 1, []string{}, true},
+		{Room{Tags: []string{"space"}, MinGrade: 5}, 0, 0, []string{"space"}, false},
+		{Room{Tags: []string{"space"}, MaxGrade: 1}, 0, 0, []string{"space"}, false},
+		{Room{Tags: []string{"space"}}, 2, -1, []string{"space"}, true},
+	}
+	for _, test := range tests {
+		recommendation := recommend(user, test.room, test.visits)
+		if recommendation.Score != test.score || !reflect.DeepEqual(recommendation.MatchedTags, test.tags) || recommendation.GradeFit != test.gradeFit {
+			t.Errorf("recommend(%+v, %d) = %+v, want score %v, tags %v and grade fit %v", test.room, test.visits, recommendation, test.score, test.tags, test.gradeFit)
+		}
+	}
+}
+
+func TestRecommendRooms(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	store.PutUser(ctx, User{ID: "u1", FirstName: "Ada", Grade: 3, Likes: []string{"space", "robots"}, Journeys: []string{"j1", "j9"}})
+	store.PutJourney(ctx, Journey{ID: "j1", User: "u1", State: JourneyActive, Trips: []string{"t1", "t2", "t9"}})
+	store.PutTrip(ctx, Trip{ID: "t1", JourneyID: "j1", StartRoom: "robots", EndRoom: "planets", State: TripArrived})
+	store.PutTrip(ctx, Trip{ID: "t2", JourneyID: "j1", StartRoom: "planets", EndRoom: "robots", State: TripPlanned})
+	for _, room := range []Room{
+		{ID: "planets", Name: "Planets", Tags: []string{"space"}, MinGrade: 1, MaxGrade: 5},
+		{ID: "robots", Name: "Robots", Tags: []string{"robots", "space"}},
+		{ID: "fossils", Name: "Fossils", Tags: []string{"dinosaurs"}},
+		{ID: "lab", Name: "Lab", Tags: []string{"robots"}, MinGrade: 6},
+	} {
+		store.PutRoom(ctx, room)
+	}
+	manager := UserManager{transactor: store, users: store, journeys: store, trips: store, rooms: store}
+	get := func(userID, query string) (*httptest.ResponseRecorder, ResponseRecommendations) {
+		r := httptest.NewRequest(http.MethodGet, "/users/"+userID+"/recommended-rooms"+query, nil)
+		r = mux.SetURLVars(r, map[string]string{"userid": userID})
+		w := httptest.NewRecorder()
+		manager.RecommendRooms(w, r)
+		var response ResponseRecommendations
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return w, response
+	}
+
+	// The visit to planets counts against it; the planned trip to
+	// robots and the missing journey and trip do not.
+	w, response := get("u1", "")
+	if want := []string{"robots", "fossils", "planets"}; w.Code != http.StatusOK || !reflect.DeepEqual(response.Rooms, want) {
+		t.Fatalf("recommended = %d %v, want %v", w.Code, response.Rooms, want)
+	}
+	if planets := response.Recommendations[2]; planets.Visits != 1 || planets.Score != 0.5 {
+		t.Errorf("planets = %+v, want one visit and a score of 0.5", planets)
+	}
+	if _, response := get("u1", "?limit=1"); !reflect.DeepEqual(response.Rooms, []string{"robots"}) {
+		t.Errorf("recommended with a limit of 1 = %v, want [robots]", response.Rooms)
+	}
+	for _, limit := range []string{"0", "x", fmt.Sprint(maxTourStops + 1)} {
+		if w, _ := get("u1", "?limit="+limit); w.Code != http.StatusBadRequest {
+			t.Errorf("limit %s = %d, want 400", limit, w.Code)
+		}
+	}
+	if w, _ := get("u9", ""); w.Code != http.StatusNotFound {
+		t.Errorf("recommending to a missing user = %d, want 404", w.Code)
+	}
+}
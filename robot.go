@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ros-nueva/backend/protocol"
+)
+
+var (
+	ErrUnknownEvent     = &Error{Code: CodeInvalid, Message: "unknown robot event"}
+	ErrEventTripMissing = FieldErrors{{Field: "payload.trip_id", Message: "is required"}}.Err()
+)
+
+// RobotManager follows what the robot reports, completing or failing
+// trips as it reaches or gives up on its goals, and relays commands
+// that do not concern a single trip.
+type RobotManager struct {
+	outbox Outbox
+	hub    *Hub
+	trips  TripManager
+	status *robotStatus
+}
+
+// RobotStatus is the last position and charge the robot reported.
+type RobotStatus struct {
+	Pose      *Pose    `json:"pose,omitempty"`
+	Battery   *float64 `json:"battery,omitempty"`
+	UpdatedAt int64    `json:"updated_at"`
+}
+
+type robotStatus struct {
+	mu sync.RWMutex
+	RobotStatus
+}
+
+func (manager RobotManager) Group() Group {
+	return Group{
+		Paths: Routes{
+			"status": Route{
+				Methods: []string{http.MethodGet},
+				Handler: manager.GetStatus,
+				Allow:   Filters{AnyOf(IsAdmin, IsRobot)},
+			},
+			"events": Route{
+				Methods: []string{http.MethodPost},
+				Handler: manager.PostEvent,
+				Allow:   Filters{IsRobot},
+			},
+			"pause": Route{
+				Methods: []string{http.MethodPost},
+				Handler: manager.command(protocol.CommandPause, protocol.Pause{}),
+				Allow:   Filters{IsAdmin},
+			},
+			"resume": Route{
+				Methods: []string{http.MethodPost},
+				Handler: manager.command(protocol.CommandResume, protocol.Resume{}),
+				Allow:   Filters{IsAdmin},
+			},
+			"return_home": Route{
+				Methods: []string{http.MethodPost},
+				Handler: manager.command(protocol.CommandReturnHome, protocol.ReturnHome{}),
+				Allow:   Filters{IsAdmin},
+			},
+		},
+	}
+}
+
+func (manager RobotManager) GetStatus(w http.ResponseWriter, r *http.Request) {
+	manager.status.mu.RLock()
+	defer manager.status.mu.RUnlock()
+	json.NewEncoder(w).Encode(manager.status.RobotStatus)
+}
+
+// command serves an endpoint sending the given command to the robot
+// through the outbox and answering with the queued command.
+func (manager RobotManager) command(commandType string, payload interface{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		command, err := manager.outbox.Send(r.Context(), "", "", commandType, payload)
+		if err != nil {
+			WriteError(w, err)
+			return
+		}
+		json.NewEncoder(w).Encode(command)
+	}
+}
+
+// PostEvent accepts a robot event over HTTP, for deployments where
+// the robot cannot be subscribed to.
+func (manager RobotManager) PostEvent(w http.ResponseWriter, r *http.Request) {
+	envelope := protocol.Envelope{}
+	if bodyErr := decodeBody(r, &envelope); bodyErr != nil {
+		WriteError(w, bodyErr)
+		return
+	}
+	if handleErr := manager.Handle(r.Context(), envelope); handleErr != nil {
+		WriteError(w, handleErr)
+		return
+	}
+	json.NewEncoder(w).Encode(ResponseSuccess{Success: true})
+}
+
+// HandleMessage handles a raw message from the bus, logging what
+// cannot be handled since there is nobody to report it to. Messages
+// on the bus come from the robot, so changes are attributed to it.
+func (manager RobotManager) HandleMessage(message []byte) {
+	envelope := protocol.Envelope{}
+	if err := json.Unmarshal(message, &envelope); err != nil {
+		log.Printf("robot: malformed message %s: %v", message, err)
+		return
+	}
+	if handleErr := manager.Handle(WithActor(context.Background(), ActorRobot), envelope); handleErr != nil {
+		log.Printf("robot: %s %s: %v", envelope.Type, envelope.CorrelationID, handleErr)
+	}
+}
+
+// Handle applies the event in envelope: acks and the goal events
+// answering a command acknowledge it, reached goals complete their
+// trip, aborted goals fail it and abort its journey, and position and
+// battery reports update the status. Goals on trips that are gone or
+// have ended are ignored.
+func (manager RobotManager) Handle(ctx context.Context, envelope protocol.Envelope) error {
+	switch envelope.Type {
+	case protocol.EventAck:
+		if err := envelope.Decode(&protocol.Ack{}); err != nil {
+			return malformed(err)
+		}
+		return withID(manager.outbox.Acknowledge(ctx, envelope.CorrelationID), envelope.CorrelationID)
+	case protocol.EventGoalReached:
+		event := protocol.GoalReached{}
+		if err := envelope.Decode(&event); err != nil {
+			return malformed(err)
+		}
+		if event.TripID == "" {
+			return ErrEventTripMissing
+		}
+		if err := manager.answer(ctx, envelope); err != nil {
+			return err
+		}
+		if stale, err := manager.stale(ctx, envelope, event.TripID); stale || err != nil {
+			return err
+		}
+		_, err := manager.trips.arrive(ctx, event.TripID)
+		return err
+	case protocol.EventGoalAborted:
+		event := protocol.GoalAborted{}
+		if err := envelope.Decode(&event); err != nil {
+			return malformed(err)
+		}
+		if event.TripID == "" {
+			return ErrEventTripMissing
+		}
+		if err := manager.answer(ctx, envelope); err != nil {
+			return err
+		}
+		if stale, err := manager.stale(ctx, envelope, event.TripID); stale || err != nil {
+			return err
+		}
+		_, err := manager.trips.transact(ctx, event.TripID, manager.trips.failTrip)
+		return err
+	case protocol.EventPosition:
+		event := protocol.Position{}
+		if err := envelope.Decode(&event); err != nil {
+			return malformed(err)
+		}
+		pose := Pose(event.Pose)
+		manager.status.update(func(status *RobotStatus) { status.Pose = &pose })
+		manager.hub.Publish(Update{Type: UpdatePosition, Data: pose})
+	case protocol.EventBattery:
+		event := protocol.Battery{}
+		if err := envelope.Decode(&event); err != nil {
+			return malformed(err)
+		}
+		manager.status.update(func(status *RobotStatus) { status.Battery = &event.Percent })
+	default:
+		unknown := *ErrUnknownEvent
+		unknown.Details = envelope.Type
+		return &unknown
+	}
+	return nil
+}
+
+// answer acknowledges the command the event in envelope answers. The
+// robot may report goals it set itself, so unknown correlation ids
+// are not an error.
+func (manager RobotManager) answer(ctx context.Context, envelope protocol.Envelope) error {
+	if err := manager.outbox.Acknowledge(ctx, envelope.CorrelationID); err != nil && err != ErrCommandMissing {
+		return err
+	}
+	return nil
+}
+
+// stale reports whether the trip with the given ID is gone or has
+// ended, as when it was cancelled while the robot was driving, so that
+// the goal event in envelope no longer concerns it.
+func (manager RobotManager) stale(ctx context.Context, envelope protocol.Envelope, tripID string) (bool, error) {
+	trip, dataErr := manager.trips.trips.GetTrip(ctx, tripID)
+	if dataErr == ErrTripMissing {
+		log.Printf("robot: ignoring %s for missing trip %s", envelope.Type, tripID)
+		return true, nil
+	} else if dataErr != nil {
+		return false, withID(dataErr, tripID)
+	}
+	if trip.Final() {
+		log.Printf("robot: ignoring %s for %s trip %s", envelope.Type, trip.CurrentState(), tripID)
+		return true, nil
+	}
+	return false, nil
+}
+
+func (status *robotStatus) update(f func(status *RobotStatus)) {
+	status.mu.Lock()
+	defer status.mu.Unlock()
+	f(&status.RobotStatus)
+	status.UpdatedAt = time.Now().UTC().Unix()
+}
+
+// pose returns the last position the robot reported, or nil before
+// it has reported any.
+func (status *robotStatus) pose() *Pose {
+	status.mu.RLock()
+	defer status.mu.RUnlock()
+	if status.Pose == nil {
+		return nil
+	}
+	pose := *status.Pose
+	return &pose
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/ros-nueva/backend/protocol"
+)
+
+// testRobot stores the active journey j1, whose trip t1 from a to b is
+// in progress and whose trip t2 from b to c is planned.
+func testRobot(t *testing.T, autoAdvance bool) (*MemoryStore, *LocalBus, RobotManager) {
+	t.Helper()
+	ctx := context.Background()
+	store := NewMemoryStore()
+	bus := NewLocalBus()
+	for i, id := range []string{"a", "b", "c"} {
+		store.PutRoom(ctx, Room{ID: id, Name: id, Pose: Pose{X: 10 * i}})
+	}
+	store.PutUser(ctx, User{ID: "u1", FirstName: "Ada", Journeys: []string{"j1"}, LatestJourney: "j1"})
+	store.PutJourney(ctx, Journey{ID: "j1", User: "u1", State: JourneyActive, StartAt: 1, Trips: []string{"t1", "t2"}, LatestTrip: "t1", AutoAdvance: autoAdvance})
+	store.PutTrip(ctx, Trip{ID: "t1", JourneyID: "j1", StartRoom: "a", EndRoom: "b", State: TripInProgress, LeftAt: 1})
+	store.PutTrip(ctx, Trip{ID: "t2", JourneyID: "j1", StartRoom: "b", EndRoom: "c", State: TripPlanned})
+
+	outbox := Outbox{publisher: bus, transactor: store, commands: store, trips: store, journeys: store}
+	trips := TripManager{outbox: outbox, transactor: store, trips: store, journeys: store, rooms: store}
+	return store, bus, RobotManager{outbox: outbox, hub: NewHub(), trips: trips, status: &robotStatus{}}
+}
+
+func robotEvent(t *testing.T, eventType string, payload interface{}) protocol.Envelope {
+	t.Helper()
+	envelope, err := protocol.NewEnvelope(eventType, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return envelope
+}
+
+// checkTrips fails t unless every trip is in the state given for it.
+func checkTrips(t *testing.T, store *MemoryStore, want map[string]TripState) {
+	t.Helper()
+	for id, state := range want {
+		if trip, _ := store.GetTrip(context.Background(), id); trip.CurrentState() != state {
+			t.Errorf("trip %s is %s, want %s", id, trip.CurrentState(), state)
+		}
+	}
+}
+
+func TestRobotGoalReached(t *testing.T) {
+	ctx := context.Background()
+	store, bus, manager := testRobot(t, true)
+
+	if err := manager.Handle(ctx, robotEvent(t, protocol.EventGoalReached, protocol.GoalReached{TripID: "t1"})); err != nil {
+		t.Fatalf("Handle: %v", err)
+	}
+	checkTrips(t, store, map[string]TripState{"t1": TripArrived, "t2": TripInProgress})
+	if journey, _ := store.GetJourney(ctx, "j1"); journey.CurrentState() != JourneyActive || journey.LatestTrip != "t2" {
+		t.Errorf("journey is %s on trip %s, want active on t2", journey.CurrentState(), journey.LatestTrip)
+	}
+	messages := bus.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("published %d messages, want the start of t2", len(messages))
+	}
+	envelope := protocol.Envelope{}
+	start := protocol.StartTrip{}
+	json.Unmarshal(messages[0], &envelope)
+	envelope.Decode(&start)
+	if envelope.Type != protocol.CommandStartTrip || start.TripID != "t2" || start.RoomID != "c" {
+		t.Errorf("published %s %+v, want the start of t2 to c", envelope.Type, start)
+	}
+
+	if err := manager.Handle(ctx, robotEvent(t, protocol.EventGoalReached, protocol.GoalReached{TripID: "t2"})); err != nil {
+		t.Fatalf("Handle: %v", err)
+	}
+	if journey, _ := store.GetJourney(ctx, "j1"); journey.CurrentState() != JourneyCompleted || journey.FinishedAt == 0 {
+		t.Errorf("journey is %s, want completed once its last trip arrived", journey.CurrentState())
+	}
+}
+
+func TestRobotGoalAborted(t *testing.T) {
+	ctx := context.Background()
+	store, _, manager := testRobot(t, true)
+
+	event := robotEvent(t, protocol.EventGoalAborted, protocol.GoalAborted{TripID: "t1", Reason: "blocked"})
+	if err := manager.Handle(ctx, event); err != nil {
+		t.Fatalf("Handle: %v", err)
+	}
+	checkTrips(t, store, map[string]TripState{"t1": TripFailed, "t2": TripCancelled})
+	if journey, _ := store.GetJourney(ctx, "j1"); journey.CurrentState() != JourneyAborted {
+		t.Errorf("journey is %s, want aborted", journey.CurrentState())
+	}
+}
+
+func TestRobotStatusEvents(t *testing.T) {
+	ctx := context.Background()
+	_, _, manager := testRobot(t, false)
+	updates, cancel := manager.hub.Subscribe("")
+	defer cancel()
+
+	if err := manager.Handle(ctx, robotEvent(t, protocol.EventPosition, protocol.Position{Pose: protocol.Pose{Floor: 1, X: 2, Y: 3}})); err != nil {
+		t.Fatalf("Handle position: %v", err)
+	}
+	if err := manager.Handle(ctx, robotEvent(t, protocol.EventBattery, protocol.Battery{Percent: 42})); err != nil {
+		t.Fatalf("Handle battery: %v", err)
+	}
+	status := manager.status.RobotStatus
+	if status.Pose == nil || *status.Pose != (Pose{Floor: 1, X: 2, Y: 3}) {
+		t.Errorf("status pose = %v, want the reported one", status.Pose)
+	}
+	if status.Battery == nil || *status.Battery != 42 {
+		t.Errorf("status battery = %v, want 42", status.Battery)
+	}
+	if status.UpdatedAt == 0 {
+		t.Error("status has no update time")
+	}
+	select {
+	case update := <-updates:
+		if update.Type != UpdatePosition {
+			t.Errorf("published a %s update, want %s", update.Type, UpdatePosition)
+		}
+	default:
+		t.Error("the position was not published")
+	}
+}
+
+func TestRobotIgnoresStaleGoals(t *testing.T) {
+	ctx := context.Background()
+	store, _, manager := testRobot(t, false)
+	store.PutTrip(ctx, Trip{ID: "t1", JourneyID: "j1", StartRoom: "a", EndRoom: "b", State: TripCancelled, LeftAt: 1})
+
+	for _, event := range []protocol.Envelope{
+		robotEvent(t, protocol.EventGoalReached, protocol.GoalReached{TripID: "t9"}),
+		robotEvent(t, protocol.EventGoalAborted, protocol.GoalAborted{TripID: "t9"}),
+		robotEvent(t, protocol.EventGoalReached, protocol.GoalReached{TripID: "t1"}),
+		robotEvent(t, protocol.EventGoalAborted, protocol.GoalAborted{TripID: "t1"}),
+	} {
+		if err := manager.Handle(ctx, event); err != nil {
+			t.Errorf("Handle %s: %v, want the stale goal ignored", event.Type, err)
+		}
+	}
+	checkTrips(t, store, map[string]TripState{"t1": TripCancelled, "t2": TripPlanned})
+	if journey, _ := store.GetJourney(ctx, "j1"); journey.CurrentState() != JourneyActive {
+		t.Errorf("journey is %s, want it left active", journey.CurrentState())
+	}
+
+	if err := manager.Handle(ctx, robotEvent(t, protocol.EventGoalReached, protocol.GoalReached{})); err != ErrEventTripMissing {
+		t.Errorf("Handle of a goal without trip = %v, want ErrEventTripMissing", err)
+	}
+	if err := manager.Handle(ctx, robotEvent(t, "teleported", nil)); err == nil {
+		t.Error("Handle of an unknown event succeeded")
+	}
+}
@@ -1,34 +1,158 @@
 package main
 
 import (
-	"reflect"
+	"context"
+	"fmt"
 	"net/http"
 	"github.com/gorilla/mux"
 	"encoding/json"
-	"appengine"
-	"appengine/datastore"
 	"errors"
+	"strconv"
+	"time"
 )
 
 var (
-	ErrRoomAlreadyExists = errors.New("room already exists")
-	ErrRoomMissing = errors.New("room does not exist")
+	ErrRoomAlreadyExists = &Error{Code: CodeConflict, Entity: "room", Message: "room already exists"}
+	ErrRoomMissing = &Error{Code: CodeNotFound, Entity: "room", Message: "room does not exist"}
+	ErrRoomInUse = &Error{Code: CodeConflict, Entity: "room", Message: "room is used by the map or by trips"}
 )
 
-type RoomManager struct {}
+// The floors rooms may be placed on, lowest to highest, until the map
+// has floors of its own.
+const (
+	MinFloor = -2
+	MaxFloor = 10
+)
+
+type RoomManager struct {
+	transactor Transactor
+	rooms RoomStore
+	trips TripStore
+	maps MapManager
+	index *RoomIndex
+	location *time.Location
+}
 
+// Room is a place the robot can take users to. Tags name the topics
+// it is about and MinGrade and MaxGrade the grades it suits, where a
+// zero MaxGrade leaves the range open. A room without OpeningHours is
+// always open.
 type Room struct {
 	ID string `datastore:"id" json:"id"`
 	Name string `datastore:"name" json:"name"`
 	Description string `datastore:"description" json:"description"`
-	Pose struct {
-		Floor int `datastore:"z_pos" json:"z"`
-		X int `datastore:"x_pos" json:"x"`
-		Y int `datastore:"y_pos" json:"y"`
-	} `datastore:"pose" json:"pose"`
+	Pose Pose `datastore:"pose" json:"pose"`
+	Tags []string `datastore:"tags" json:"tags"`
+	MinGrade int `datastore:"min_grade" json:"min_grade"`
+	MaxGrade int `datastore:"max_grade" json:"max_grade"`
+	Category string `datastore:"category" json:"category"`
+	Accessibility Accessibility `datastore:"accessibility" json:"accessibility"`
+	OpeningHours []OpeningHours `datastore:"opening_hours,noindex" json:"opening_hours"`
+	CreatedAt int64 `datastore:"created_at" json:"created_at"`
+}
+
+// Accessibility describes how easily a room can be reached and used.
+type Accessibility struct {
+	StepFree bool `datastore:"step_free" json:"step_free"`
+	HearingLoop bool `datastore:"hearing_loop" json:"hearing_loop"`
+	Notes string `datastore:"notes,noindex" json:"notes"`
+}
+
+// OpeningHours is when a room is open on a day of the week, 0 being
+// Sunday: from Open until Close, both "15:04" in the building's time
+// zone. Close may be "24:00" for rooms open until midnight.
+type OpeningHours struct {
+	Day int `datastore:"day" json:"day"`
+	Open string `datastore:"open" json:"open"`
+	Close string `datastore:"close" json:"close"`
+}
+
+// OpenAt reports whether room is open at t, which must be in the
+// building's time zone.
+func (room Room) OpenAt(t time.Time) bool {
+	if len(room.OpeningHours) == 0 {
+		return true
+	}
+	clock := t.Hour()*60 + t.Minute()
+	for _, hours := range room.OpeningHours {
+		open, openErr := clockMinutes(hours.Open)
+		close, closeErr := clockMinutes(hours.Close)
+		if openErr != nil || closeErr != nil {
+			continue
+		}
+		if time.Weekday(hours.Day) == t.Weekday() && open <= clock && clock < close {
+			return true
+		}
+	}
+	return false
+}
+
+// clockMinutes parses a "15:04" time of day, with or without the
+// leading zero, into minutes since midnight. "24:00" is the midnight
+// ending the day.
+func clockMinutes(clock string) (int, error) {
+	if clock == "24:00" {
+		return 24 * 60, nil
+	}
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
 }
 
+// Pose is where the robot stands to reach a room.
+type Pose struct {
+	Floor int `datastore:"z_pos" json:"z"`
+	X int `datastore:"x_pos" json:"x"`
+	Y int `datastore:"y_pos" json:"y"`
+}
+
+// RoomPatchFields lists the fields of a Room clients may change.
+var RoomPatchFields = []string{"name", "description", "pose", "tags", "min_grade", "max_grade", "category", "accessibility", "opening_hours"}
+
 func (manager RoomManager) Group() Group {
+	admin := Filters{IsAdmin}
+	return Group{
+		Paths: Routes{
+			"": Methods{
+				http.MethodGet: Route{
+					Handler: manager.ListRooms,
+				},
+				http.MethodPost: Route{
+					Handler: manager.CreateRoom,
+					Allow: admin,
+				},
+			},
+			"search": Route{
+				Methods: []string{http.MethodGet},
+				Handler: manager.SearchRooms,
+			},
+			"{roomid}": Methods{
+				http.MethodGet: Route{
+					Handler: manager.GetRoom,
+				},
+				http.MethodPut: Route{
+					Handler: manager.CreateRoom,
+					Allow: admin,
+				},
+				http.MethodPatch: Route{
+					Handler: manager.SetRoom,
+					Allow: admin,
+				},
+				http.MethodDelete: Route{
+					Handler: manager.DelRoom,
+					Allow: admin,
+				},
+			},
+		},
+	}
+}
+
+// LegacyGroup serves the action-suffixed paths used by the existing
+// robot and app clients. Each of them answers to any method.
+func (manager RoomManager) LegacyGroup() Group {
+	admin := Filters{IsAdmin}
 	return Group{
 		Paths: Routes{
 			"{roomid}/": Group{
@@ -38,12 +162,15 @@ func (manager RoomManager) Group() Group {
 					},
 					"create": Route{
 						Handler: manager.CreateRoom,
+						Allow: admin,
 					},
-					"delete": Route{
+					"del": Route{
 						Handler: manager.DelRoom,
+						Allow: admin,
 					},
 					"set": Route{
 						Handler: manager.SetRoom,
+						Allow: admin,
 					},
 				},
 			},
@@ -51,94 +178,243 @@ func (manager RoomManager) Group() Group {
 	}
 }
 
+// roomListParams filter rooms by the floor of their pose.
+var roomListParams = []listParam{
+	{name: "floor", property: "pose.z_pos", parse: func(value string) (interface{}, error) {
+		floor, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, errors.New("must be an integer")
+		}
+		return floor, nil
+	}},
+}
+
+// ListRooms serves a page of rooms.
+func (manager RoomManager) ListRooms(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	encoder := json.NewEncoder(w)
+
+	query, queryErr := parseListQuery(r, roomListParams)
+	if queryErr != nil {
+		WriteError(w, queryErr)
+		return
+	}
+	rooms, next, dataErr := manager.rooms.ListRooms(ctx, query)
+	if dataErr != nil {
+		WriteError(w, dataErr)
+		return
+	}
+	encoder.Encode(ResponsePage{Items: rooms, NextCursor: next})
+}
+
 func (manager RoomManager) CreateRoom(w http.ResponseWriter, r *http.Request) {
-	ctx := appengine.NewContext(r)
-	roomID := mux.Vars(r)["roomid"]
+	ctx := r.Context()
 	encoder := json.NewEncoder(w)
-	decoder := json.NewDecoder(r.Body)
 
+	roomID, idErr := entityID(r, "roomid")
+	if idErr != nil {
+		WriteError(w, idErr)
+		return
+	}
 	room := Room{}
-	key := datastore.NewKey(ctx, "room", roomID, 0, nil)
-	dataErr := datastore.Get(ctx, key, &room)
-	if dataErr == nil {
-		encoder.Encode(ResponseError{Error: ErrUserAlreadyExists.Error()})
+	if bodyErr := decodeBody(r, &room); bodyErr != nil {
+		WriteError(w, bodyErr)
 		return
-	} else if dataErr != datastore.ErrNoSuchEntity {
-		encoder.Encode(ResponseError{Error: dataErr.Error()})
+	}
+	if validErr := room.Validate().Err(); validErr != nil {
+		WriteError(w, validErr)
 		return
 	}
-	decoder.Decode(&room)
 	room.ID = roomID
-	datastore.Put(ctx, key, room)
+	room.CreatedAt = time.Now().UTC().Unix()
+	if txErr := manager.transactor.RunInTransaction(ctx, func(ctx context.Context) error {
+		if validErr := manager.validate(ctx, room, true); validErr != nil {
+			return validErr
+		}
+		return manager.createRoom(ctx, room)
+	}); txErr != nil {
+		WriteError(w, txErr)
+		return
+	}
+	manager.index.Invalidate()
+	created(w, "/rooms/"+room.ID)
 	encoder.Encode(room)
 }
 
+// createRoom stores room unless its ID is taken.
+func (manager RoomManager) createRoom(ctx context.Context, room Room) error {
+	_, dataErr := manager.rooms.GetRoom(ctx, room.ID)
+	if dataErr == nil {
+		return withID(ErrRoomAlreadyExists, room.ID)
+	} else if dataErr != ErrRoomMissing {
+		return withID(dataErr, room.ID)
+	}
+	return manager.rooms.PutRoom(ctx, room)
+}
+
 func (manager RoomManager) GetRoom(w http.ResponseWriter, r *http.Request) {
-	ctx := appengine.NewContext(r)
+	ctx := r.Context()
 	roomID := mux.Vars(r)["roomid"]
 	encoder := json.NewEncoder(w)
-	decoder := json.NewDecoder(r.Body)
 
-	room := Room{}
-	key := datastore.NewKey(ctx, "room", roomID, 0, nil)
-	dataErr := datastore.Get(ctx, key, &room)
+	room, dataErr := manager.rooms.GetRoom(ctx, roomID)
 	if dataErr != nil {
-		if dataErr != datastore.ErrNoSuchEntity {
-			encoder.Encode(ResponseError{Error: dataErr.Error()})
-			return
-		}
-		encoder.Encode(ResponseError{Error: ErrRoomMissing.Error()})
+		WriteError(w, withID(dataErr, roomID))
 		return
 	}
-	decoder.Decode(&room)
 	encoder.Encode(room)
 }
 
 func (manager RoomManager) DelRoom(w http.ResponseWriter, r *http.Request) {
-	ctx := appengine.NewContext(r)
+	ctx := r.Context()
 	roomID := mux.Vars(r)["roomid"]
 	encoder := json.NewEncoder(w)
 
-	key := datastore.NewKey(ctx, "room", roomID, 0, nil)
-	dataErr := datastore.Delete(ctx, key)
+	trips, dataErr := manager.pendingTrips(ctx, roomID)
 	if dataErr != nil {
-		if dataErr != datastore.ErrInvalidKey {
-			encoder.Encode(ResponseError{Error: dataErr.Error()})
-			return
+		WriteError(w, dataErr)
+		return
+	}
+	if txErr := manager.transactor.RunInTransaction(ctx, func(ctx context.Context) error {
+		links, dataErr := manager.maps.links(ctx, roomID)
+		if dataErr != nil {
+			return dataErr
+		}
+		if users := append(links, trips...); len(users) > 0 {
+			inUse := *ErrRoomInUse
+			inUse.ID = roomID
+			inUse.Details = users
+			return &inUse
 		}
-		encoder.Encode(ResponseError{Error: ErrRoomMissing.Error()})
+		return withID(manager.rooms.DeleteRoom(ctx, roomID), roomID)
+	}); txErr != nil {
+		WriteError(w, txErr)
+		return
 	}
+	manager.index.Invalidate()
 	encoder.Encode(ResponseSuccess{Success: true})
 }
 
+// pendingTrips lists the IDs of the trips to or from the room with the
+// given ID that have not ended. Queries cannot run in datastore
+// transactions, so this is checked before deleting the room; a trip
+// planned meanwhile fails to start on its missing room. The trips are
+// not sorted, so that none stored without created_at is missed.
+func (manager RoomManager) pendingTrips(ctx context.Context, roomID string) ([]string, error) {
+	pending := []string{}
+	for _, property := range []string{"start_room", "end_room"} {
+		query := ListQuery{Filters: []ListFilter{{Property: property, Value: roomID}}, Limit: maxPageSize}
+		for {
+			trips, next, dataErr := manager.trips.ListTrips(ctx, query)
+			if dataErr != nil {
+				return nil, dataErr
+			}
+			for _, trip := range trips {
+				if !trip.Final() && !contains(pending, trip.ID) {
+					pending = append(pending, trip.ID)
+				}
+			}
+			if next == "" {
+				break
+			}
+			query.Cursor = next
+		}
+	}
+	return pending, nil
+}
+
 func (manager RoomManager) SetRoom(w http.ResponseWriter, r *http.Request) {
-	ctx := appengine.NewContext(r)
+	ctx := r.Context()
 	roomID := mux.Vars(r)["roomid"]
 	encoder := json.NewEncoder(w)
-	decoder := json.NewDecoder(r.Body)
 
+	patch, bodyErr := readPatch(r, RoomPatchFields)
+	if bodyErr != nil {
+		WriteError(w, bodyErr)
+		return
+	}
 	room := Room{}
-	key := datastore.NewKey(ctx, "room", roomID, 0, nil)
-	dataErr := datastore.Get(ctx, key, &room)
-	if dataErr != nil {
-		if dataErr != datastore.ErrNoSuchEntity {
-			encoder.Encode(ResponseError{Error: dataErr.Error()})
-			return
+	if txErr := manager.transactor.RunInTransaction(ctx, func(ctx context.Context) error {
+		var dataErr error
+		if room, dataErr = manager.rooms.GetRoom(ctx, roomID); dataErr != nil {
+			return withID(dataErr, roomID)
 		}
-		encoder.Encode(ResponseError{Error: ErrRoomMissing.Error()})
+		floor := room.Pose.Floor
+		if patchErr := applyPatch(&room, patch); patchErr != nil {
+			return patchErr
+		}
+		if validErr := manager.validate(ctx, room, room.Pose.Floor != floor); validErr != nil {
+			return validErr
+		}
+		if room.Pose.Floor != floor {
+			// Edges join rooms on one floor and connectors rooms on
+			// different ones, so moving a linked room breaks the map.
+			links, dataErr := manager.maps.links(ctx, roomID)
+			if dataErr != nil {
+				return dataErr
+			}
+			if len(links) > 0 {
+				errs := FieldErrors{}
+				errs.Add("pose.z", "cannot change while edges or connectors join the room")
+				return errs.Err()
+			}
+		}
+		return manager.rooms.PutRoom(ctx, room)
+	}); txErr != nil {
+		WriteError(w, txErr)
 		return
 	}
-	updatedRoom := Room{}
-	decoder.Decode(&updatedRoom)
-	room.MergeInPlace(updatedRoom)
-	datastore.Put(ctx, key, room)
+	manager.index.Invalidate()
 	encoder.Encode(room)
 }
 
-func (old *Room) MergeInPlace(new Room) {
-	for ii := 0; ii < reflect.TypeOf(old).Elem().NumField(); ii++ {
-		if x := reflect.ValueOf(&new).Elem().Field(ii); !x.IsNil() {
-			reflect.ValueOf(old).Elem().Field(ii).Set(x)
+// validate checks room and, if it is being placed at a level, that a
+// floor of the map is there.
+func (manager RoomManager) validate(ctx context.Context, room Room, placed bool) error {
+	errs := room.Validate()
+	if !placed {
+		return errs.Err()
+	}
+	if floorErr := manager.maps.checkFloor(ctx, &errs, "pose.z", room.Pose.Floor); floorErr != nil {
+		return floorErr
+	}
+	return errs.Err()
+}
+
+// Validate reports every field of room that is missing or out of range.
+func (room Room) Validate() FieldErrors {
+	errs := FieldErrors{}
+	if room.Name == "" {
+		errs.Add("name", "is required")
+	}
+	for i, tag := range room.Tags {
+		if tag == "" {
+			errs.Add(fmt.Sprintf("tags[%d]", i), "must not be empty")
 		}
 	}
-}
\ No newline at end of file
+	if room.MinGrade < 0 {
+		errs.Add("min_grade", "must not be negative")
+	}
+	if room.MaxGrade != 0 && room.MaxGrade < room.MinGrade {
+		errs.Add("max_grade", "must not be below min_grade")
+	}
+	for i, hours := range room.OpeningHours {
+		field := fmt.Sprintf("opening_hours[%d]", i)
+		if hours.Day < 0 || hours.Day > 6 {
+			errs.Add(field+".day", "must be between 0 (Sunday) and 6")
+		}
+		open, openErr := clockMinutes(hours.Open)
+		close, closeErr := clockMinutes(hours.Close)
+		openOK := openErr == nil && open < 24*60
+		if !openOK {
+			errs.Add(field+".open", "must be a time such as 09:00")
+		}
+		if closeErr != nil {
+			errs.Add(field+".close", "must be a time such as 17:30 or 24:00")
+		}
+		if openOK && closeErr == nil && close <= open {
+			errs.Add(field+".close", "must be after open")
+		}
+	}
+	return errs
+}
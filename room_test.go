@@ -0,0 +1,63 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestOpeningHoursValidate(t *testing.T) {
+	tests := []struct {
+		hours  OpeningHours
+		fields []string
+	}{
+		{OpeningHours{Day: 1, Open: "09:00", Close: "17:30"}, []string{}},
+		{OpeningHours{Day: 1, Open: "9:00", Close: "17:30"}, []string{}},
+		{OpeningHours{Day: 6, Open: "18:00", Close: "24:00"}, []string{}},
+		{OpeningHours{Day: 7, Open: "09:00", Close: "17:00"}, []string{"opening_hours[0].day"}},
+		{OpeningHours{Day: 1, Open: "9am", Close: "25:00"}, []string{"opening_hours[0].open", "opening_hours[0].close"}},
+		{OpeningHours{Day: 1, Open: "24:00", Close: "24:00"}, []string{"opening_hours[0].open"}},
+		{OpeningHours{Day: 1, Open: "10:00", Close: "9:30"}, []string{"opening_hours[0].close"}},
+		{OpeningHours{Day: 1, Open: "10:00", Close: "10:00"}, []string{"opening_hours[0].close"}},
+	}
+	for _, test := range tests {
+		fields := []string{}
+		for _, err := range (Room{Name: "Library", OpeningHours: []OpeningHours{test.hours}}).Validate() {
+			fields = append(fields, err.Field)
+		}
+		if !reflect.DeepEqual(fields, test.fields) {
+			t.Errorf("Validate(%+v) rejects %v, want %v", test.hours, fields, test.fields)
+		}
+	}
+}
+
+func TestRoomOpenAt(t *testing.T) {
+	room := Room{OpeningHours: []OpeningHours{
+		{Day: 1, Open: "9:00", Close: "12:00"},
+		{Day: 1, Open: "13:00", Close: "24:00"},
+	}}
+	// 2024-01-01 was a Monday.
+	tests := []struct {
+		clock string
+		open  bool
+	}{
+		{"08:59", false},
+		{"09:00", true},
+		{"10:30", true},
+		{"12:00", false},
+		{"13:00", true},
+		{"23:59", true},
+	}
+	for _, test := range tests {
+		at, _ := time.Parse("2006-01-02 15:04", "2024-01-01 "+test.clock)
+		if open := room.OpenAt(at); open != test.open {
+			t.Errorf("OpenAt(Monday %s) = %v, want %v", test.clock, open, test.open)
+		}
+	}
+	if tuesday := time.Date(2024, 1, 2, 10, 0, 0, 0, time.UTC); room.OpenAt(tuesday) {
+		t.Error("OpenAt(Tuesday 10:00) = true, want closed on days without hours")
+	}
+	if !(Room{}).OpenAt(time.Now()) {
+		t.Error("a room without opening hours is closed, want always open")
+	}
+}
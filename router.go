@@ -1,24 +1,28 @@
 package main
 
 import (
+	"fmt"
 	"github.com/gorilla/mux"
 	"net/http"
+	"regexp"
+	"sort"
+	"strings"
 )
 
+var ErrMethodNotAllowed = &Error{Code: CodeMethodNotAllowed, Message: "method not allowed"}
+
 type RequestFilter func(*http.Request) bool
 type Middleware func(http.HandlerFunc) http.HandlerFunc
 type Filters []RequestFilter
 type Stack []Middleware
 type Routes map[string]Path
+type Methods map[string]Route
 type Router Group
 
+// A Path is a Route, a set of Routes keyed by HTTP method,
+// or a Group of further Paths.
 type Path interface {
-	Build(*mux.Router, string)
-}
-
-type IGroup interface {
-	AmGroup()
-	Build(*mux.Router, string)
+	Endpoints(prefix string) []Endpoint
 }
 
 type Group struct {
@@ -26,23 +30,55 @@ type Group struct {
 	Paths Routes
 }
 
-type IRoute interface {
-	AmRoute()
-	Build(*mux.Router, string)
-}
-
+// Route is a single endpoint. Methods lists the HTTP methods it
+// answers to; a Route without Methods answers to any method.
 type Route struct {
+	Methods    []string
 	Handler    http.HandlerFunc
 	Allow      Filters
 	Middleware Stack
 }
 
-func (r Routes) Serve() http.Handler{
+// Endpoint is a Route mounted at its full path template, carrying
+// the middleware of every Group it was nested in.
+type Endpoint struct {
+	Pattern string
+	Route
+}
+
+var patternVariable = regexp.MustCompile(`\{[^}]*\}`)
+
+// Serve flattens r into its endpoints and registers them on a new
+// router, one handler per path template that dispatches on the
+// request method. Conflicting endpoints are reported instead of
+// letting one silently shadow the other.
+func (r Routes) Serve() (http.Handler, error) {
+	endpoints := Group{Paths: r}.Endpoints("/")
+	byPattern, err := groupEndpoints(endpoints)
+	if err != nil {
+		return nil, err
+	}
+	patterns := make([]string, 0, len(byPattern))
+	for pattern := range byPattern {
+		patterns = append(patterns, pattern)
+	}
+	sort.Slice(patterns, func(i, j int) bool {
+		return moreSpecific(patterns[i], patterns[j])
+	})
 	router := mux.NewRouter().StrictSlash(true)
-	for pattern, path := range r {
-		path.Build(router, pattern)
+	router.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		WriteError(w, ErrRouteMissing)
+	})
+	for _, pattern := range patterns {
+		// Collections are mounted at the "" path of their group, and
+		// served without the trailing slash that leaves them with.
+		path := pattern
+		if path != "/" {
+			path = strings.TrimSuffix(path, "/")
+		}
+		router.HandleFunc(path, dispatch(byPattern[pattern]))
 	}
-	return router
+	return router, nil
 }
 
 func Allow(f RequestFilter) Middleware {
@@ -51,8 +87,7 @@ func Allow(f RequestFilter) Middleware {
 			if f(r) {
 				h(w, r)
 			} else {
-				// TODO
-				w.WriteHeader(http.StatusForbidden)
+				WriteError(w, ErrForbidden)
 			}
 		}
 	}
@@ -81,26 +116,130 @@ func (s Stack) Apply(f http.HandlerFunc) http.HandlerFunc {
 	return g
 }
 
-// Builds the endpoint described by e, by applying
+func (r Route) Endpoints(prefix string) []Endpoint {
+	return []Endpoint{{Pattern: prefix, Route: r}}
+}
+
+func (m Methods) Endpoints(prefix string) []Endpoint {
+	endpoints := []Endpoint{}
+	for method, route := range m {
+		route.Methods = []string{method}
+		endpoints = append(endpoints, route.Endpoints(prefix)...)
+	}
+	return endpoints
+}
+
+// handler builds the endpoint described by e, by applying
 // access restrictions and other middleware.
-func (r Route) Build(parent *mux.Router, prefix string) {
-	allowFilter := r.Allow.Combine()
-	restricted := Allow(allowFilter)(r.Handler)
-	parent.HandleFunc(prefix, r.Middleware.Apply(restricted))
-}
-
-func (r Route) AmRoute() {}
-
-func (g Group) Build(parent *mux.Router, prefix string) {
-	router := parent.PathPrefix(prefix).Subrouter()
-	for pattern, path := range g.Paths { // api/users/{id}/
-		switch path.(type) {
-		case IRoute:
-			path.Build(router, pattern)
-		case IGroup:
-			path.Build(parent, prefix + pattern)
+func (e Endpoint) handler() http.HandlerFunc {
+	allowFilter := e.Allow.Combine()
+	restricted := Allow(allowFilter)(e.Handler)
+	return e.Middleware.Apply(restricted)
+}
+
+// accepts reports whether e answers to the given method.
+func (e Endpoint) accepts(method string) bool {
+	if len(e.Methods) == 0 {
+		return true
+	}
+	for _, m := range e.Methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// dispatch serves each request with the first endpoint accepting
+// its method, answering 405 with an Allow header otherwise.
+func dispatch(endpoints []Endpoint) http.HandlerFunc {
+	handlers := make([]http.HandlerFunc, len(endpoints))
+	allowed := []string{}
+	for i, endpoint := range endpoints {
+		handlers[i] = endpoint.handler()
+		allowed = append(allowed, endpoint.Methods...)
+	}
+	sort.Strings(allowed)
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		for i, endpoint := range endpoints {
+			if endpoint.accepts(r.Method) {
+				handlers[i](w, r)
+				return
+			}
+		}
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		WriteError(w, ErrMethodNotAllowed)
+	}
+}
+
+// Endpoints collects the endpoints of every Path in g, wrapping
+// each in the middleware of g after its own.
+func (g Group) Endpoints(prefix string) []Endpoint {
+	endpoints := []Endpoint{}
+	for pattern, path := range g.Paths {
+		for _, endpoint := range path.Endpoints(prefix + pattern) {
+			endpoint.Middleware = append(append(Stack{}, endpoint.Middleware...), g.Middleware...)
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	return endpoints
+}
+
+// groupEndpoints groups endpoints by path template. It fails when two
+// templates match exactly the same requests, ignoring variable names
+// and trailing slashes, or when two endpoints on one template share
+// a method.
+func groupEndpoints(endpoints []Endpoint) (map[string][]Endpoint, error) {
+	byPattern := map[string][]Endpoint{}
+	seen := map[string]string{}
+	for _, endpoint := range endpoints {
+		pattern := endpoint.Pattern
+		key := normalizePattern(pattern)
+		if other, ok := seen[key]; ok && other != pattern {
+			return nil, fmt.Errorf("route %s conflicts with %s", pattern, other)
+		}
+		seen[key] = pattern
+		for _, other := range byPattern[pattern] {
+			if overlaps(endpoint, other) {
+				return nil, fmt.Errorf("route %s %v conflicts with %v", pattern, endpoint.Methods, other.Methods)
+			}
 		}
+		byPattern[pattern] = append(byPattern[pattern], endpoint)
 	}
+	return byPattern, nil
 }
 
-func (g Group) AmGroup() {}
+// overlaps reports whether a and b answer to a common method.
+func overlaps(a, b Endpoint) bool {
+	if len(a.Methods) == 0 || len(b.Methods) == 0 {
+		return true
+	}
+	for _, method := range a.Methods {
+		if b.accepts(method) {
+			return true
+		}
+	}
+	return false
+}
+
+func normalizePattern(pattern string) string {
+	return strings.TrimSuffix(patternVariable.ReplaceAllString(pattern, "{}"), "/")
+}
+
+// moreSpecific orders patterns so that literal segments are registered
+// before variables in the same position, letting /journey/plan win over
+// /journey/{journeyid} regardless of map iteration order.
+func moreSpecific(a, b string) bool {
+	as, bs := strings.Split(a, "/"), strings.Split(b, "/")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		aVar, bVar := strings.HasPrefix(as[i], "{"), strings.HasPrefix(bs[i], "{")
+		if aVar != bVar {
+			return bVar
+		}
+		if as[i] != bs[i] {
+			return as[i] < bs[i]
+		}
+	}
+	return len(as) > len(bs)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func respond(body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}
+}
+
+func TestRoutesServeConflicts(t *testing.T) {
+	tests := []struct {
+		name     string
+		routes   Routes
+		conflict bool
+	}{
+		{
+			name: "different methods on one path",
+			routes: Routes{
+				"journeys/": Group{Paths: Routes{
+					"{journeyid}": Methods{
+						http.MethodGet:    Route{Handler: respond("get")},
+						http.MethodDelete: Route{Handler: respond("delete")},
+					},
+				}},
+			},
+		},
+		{
+			name: "literal next to a variable",
+			routes: Routes{
+				"journeys/plan":        Route{Methods: []string{http.MethodPost}, Handler: respond("plan")},
+				"journeys/{journeyid}": Route{Methods: []string{http.MethodPost}, Handler: respond("journey")},
+			},
+		},
+		{
+			name: "variables named differently",
+			routes: Routes{
+				"journeys/{journeyid}": Route{Methods: []string{http.MethodGet}, Handler: respond("a")},
+				"journeys/{id}":        Route{Methods: []string{http.MethodPost}, Handler: respond("b")},
+			},
+			conflict: true,
+		},
+		{
+			name: "trailing slash",
+			routes: Routes{
+				"rooms":  Route{Methods: []string{http.MethodGet}, Handler: respond("a")},
+				"rooms/": Route{Methods: []string{http.MethodPost}, Handler: respond("b")},
+			},
+			conflict: true,
+		},
+		{
+			name: "same method twice",
+			routes: Routes{
+				"rooms/": Group{Paths: Routes{
+					"": Methods{http.MethodGet: Route{Handler: respond("a")}},
+				}},
+				"rooms": Route{Methods: []string{http.MethodGet}, Handler: respond("b")},
+			},
+			conflict: true,
+		},
+		{
+			name: "any method next to a method",
+			routes: Routes{
+				"rooms/": Group{Paths: Routes{
+					"search": Route{Handler: respond("a")},
+				}},
+				"rooms/search": Route{Methods: []string{http.MethodGet}, Handler: respond("b")},
+			},
+			conflict: true,
+		},
+	}
+	for _, test := range tests {
+		_, err := test.routes.Serve()
+		if test.conflict && err == nil {
+			t.Errorf("%s: Serve succeeded, want a conflict", test.name)
+		} else if !test.conflict && err != nil {
+			t.Errorf("%s: Serve = %v, want no conflict", test.name, err)
+		}
+	}
+}
+
+func TestRoutesServeDispatch(t *testing.T) {
+	handler, err := Routes{
+		"journeys/": Group{Paths: Routes{
+			"": Methods{
+				http.MethodGet:  Route{Handler: respond("list")},
+				http.MethodPost: Route{Handler: respond("create")},
+			},
+			"plan":        Route{Methods: []string{http.MethodPost}, Handler: respond("plan")},
+			"{journeyid}": Route{Methods: []string{http.MethodPost}, Handler: respond("journey")},
+			"private":     Route{Methods: []string{http.MethodGet}, Handler: respond("private"), Allow: Filters{func(r *http.Request) bool { return false }}},
+		}},
+	}.Serve()
+	if err != nil {
+		t.Fatalf("Serve: %v", err)
+	}
+
+	tests := []struct {
+		method, path string
+		status       int
+		body         string
+	}{
+		{http.MethodGet, "/journeys", http.StatusOK, "list"},
+		{http.MethodPost, "/journeys", http.StatusOK, "create"},
+		{http.MethodPost, "/journeys/plan", http.StatusOK, "plan"},
+		{http.MethodPost, "/journeys/j1", http.StatusOK, "journey"},
+		{http.MethodDelete, "/journeys", http.StatusMethodNotAllowed, ""},
+		{http.MethodGet, "/journeys/private", http.StatusForbidden, ""},
+		{http.MethodGet, "/nowhere", http.StatusNotFound, ""},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(test.method, test.path, nil))
+		if w.Code != test.status {
+			t.Errorf("%s %s: status %d, want %d", test.method, test.path, w.Code, test.status)
+			continue
+		}
+		if test.body != "" && w.Body.String() != test.body {
+			t.Errorf("%s %s: served %q, want %q", test.method, test.path, w.Body.String(), test.body)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/journeys", nil))
+	if allow := w.Header().Get("Allow"); allow != "GET, POST" {
+		t.Errorf("Allow = %q, want %q", allow, "GET, POST")
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// indexTTL is how long a RoomIndex is trusted before it is rebuilt,
+// bounding how late it sees rooms written by other instances.
+const indexTTL = 30 * time.Second
+
+// prefixMatchWeight discounts a query word that only begins an
+// indexed word, such as "chem" for "chemistry" as a kiosk user types.
+const prefixMatchWeight = 0.5
+
+// stopWords are left out of the index and of queries.
+var stopWords = map[string]bool{"a": true, "an": true, "and": true, "the": true, "of": true, "in": true, "to": true, "for": true}
+
+// searchFields are the parts of a room that are searched, weighted by
+// how telling a match in each of them is.
+var searchFields = []struct {
+	weight float64
+	text   func(room Room) []string
+}{
+	{3, func(room Room) []string { return []string{room.Name} }},
+	{2, func(room Room) []string { return room.Tags }},
+	{2, func(room Room) []string { return []string{room.Category} }},
+	{1, func(room Room) []string { return []string{room.Description} }},
+}
+
+// SearchResult is a room matching a search, and how well it does.
+type SearchResult struct {
+	Room  Room    `json:"room"`
+	Score float64 `json:"score"`
+}
+
+// RoomIndex is an in-memory full-text index of the rooms. Each
+// instance keeps its own, built from the store when first searched
+// and again once it is older than indexTTL or invalidated by a write
+// to the rooms, so no search service has to be run alongside.
+type RoomIndex struct {
+	rooms RoomStore
+
+	mu       sync.Mutex
+	builtAt  time.Time
+	docs     map[string]Room
+	postings map[string]map[string]float64
+	terms    []string
+}
+
+func NewRoomIndex(rooms RoomStore) *RoomIndex {
+	return &RoomIndex{rooms: rooms}
+}
+
+// Invalidate has the index rebuilt on the next search.
+func (index *RoomIndex) Invalidate() {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+	index.builtAt = time.Time{}
+}
+
+// Search returns the rooms matching every word of query, best first.
+// An empty query matches every room, ordered by name, while one made
+// only of stop words matches none.
+func (index *RoomIndex) Search(ctx context.Context, query string) ([]SearchResult, error) {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+	if time.Since(index.builtAt) > indexTTL {
+		if err := index.build(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	var scores map[string]float64
+	if strings.TrimSpace(query) == "" {
+		scores = map[string]float64{}
+		for id := range index.docs {
+			scores[id] = 0
+		}
+	}
+	for _, word := range tokenize(query) {
+		matches := index.match(word)
+		if scores == nil {
+			scores = matches
+			continue
+		}
+		for id, score := range scores {
+			if match, ok := matches[id]; ok {
+				scores[id] = score + match
+			} else {
+				delete(scores, id)
+			}
+		}
+	}
+
+	results := make([]SearchResult, 0, len(scores))
+	for id, score := range scores {
+		results = append(results, SearchResult{Room: index.docs[id], Score: math.Round(score*1000) / 1000})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		if results[i].Room.Name != results[j].Room.Name {
+			return results[i].Room.Name < results[j].Room.Name
+		}
+		return results[i].Room.ID < results[j].Room.ID
+	})
+	return results, nil
+}
+
+// match scores the rooms containing word, or a word it begins, by the
+// field weights of the match scaled by how rare the word is.
+func (index *RoomIndex) match(word string) map[string]float64 {
+	matches := map[string]float64{}
+	for i := sort.SearchStrings(index.terms, word); i < len(index.terms) && strings.HasPrefix(index.terms[i], word); i++ {
+		term := index.terms[i]
+		discount := 1.0
+		if term != word {
+			discount = prefixMatchWeight
+		}
+		idf := math.Log(1 + float64(len(index.docs))/float64(len(index.postings[term])))
+		for id, weight := range index.postings[term] {
+			if score := weight * idf * discount; score > matches[id] {
+				matches[id] = score
+			}
+		}
+	}
+	return matches
+}
+
+// build reads every room and indexes the words of its searched fields.
+func (index *RoomIndex) build(ctx context.Context) error {
+	rooms, dataErr := allRooms(ctx, index.rooms)
+	if dataErr != nil {
+		return dataErr
+	}
+	index.docs = map[string]Room{}
+	index.postings = map[string]map[string]float64{}
+	for _, room := range rooms {
+		index.docs[room.ID] = room
+		for _, field := range searchFields {
+			for _, text := range field.text(room) {
+				for _, word := range tokenize(text) {
+					if index.postings[word] == nil {
+						index.postings[word] = map[string]float64{}
+					}
+					index.postings[word][room.ID] += field.weight
+				}
+			}
+		}
+	}
+	index.terms = make([]string, 0, len(index.postings))
+	for term := range index.postings {
+		index.terms = append(index.terms, term)
+	}
+	sort.Strings(index.terms)
+	index.builtAt = time.Now()
+	return nil
+}
+
+// tokenize splits text into lower case words without stop words,
+// reducing plurals to their singular.
+func tokenize(text string) []string {
+	words := []string{}
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if stopWords[word] {
+			continue
+		}
+		words = append(words, singular(word))
+	}
+	return words
+}
+
+func singular(word string) string {
+	switch {
+	case len(word) > 4 && strings.HasSuffix(word, "ies"):
+		return strings.TrimSuffix(word, "ies") + "y"
+	case len(word) > 3 && strings.HasSuffix(word, "s") && !strings.HasSuffix(word, "ss"):
+		return strings.TrimSuffix(word, "s")
+	}
+	return word
+}
+
+// buildingLocation is the time zone of opening hours, named by the
+// BUILDING_TIMEZONE environment variable.
+func buildingLocation() *time.Location {
+	name := getenv("BUILDING_TIMEZONE", "UTC")
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		log.Printf("Unknown BUILDING_TIMEZONE %q, using UTC: %v", name, err)
+		return time.UTC
+	}
+	return location
+}
+
+// SearchRooms serves the rooms matching the words in the q query
+// parameter, narrowed down by category, tag, step_free and open_now.
+func (manager RoomManager) SearchRooms(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	encoder := json.NewEncoder(w)
+
+	values := r.URL.Query()
+	errs := FieldErrors{}
+	limit := defaultPageSize
+	if value := values.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxPageSize {
+			errs.Add("limit", "must be between 1 and "+strconv.Itoa(maxPageSize))
+		}
+		limit = n
+	}
+	flags := map[string]bool{}
+	for _, name := range []string{"step_free", "open_now"} {
+		if value := values.Get(name); value != "" {
+			flag, err := strconv.ParseBool(value)
+			if err != nil {
+				errs.Add(name, "must be true or false")
+			}
+			flags[name] = flag
+		}
+	}
+	if queryErr := errs.Err(); queryErr != nil {
+		WriteError(w, queryErr)
+		return
+	}
+
+	results, dataErr := manager.index.Search(ctx, values.Get("q"))
+	if dataErr != nil {
+		WriteError(w, dataErr)
+		return
+	}
+	now := time.Now().In(manager.location)
+	category, tag := values.Get("category"), values.Get("tag")
+	matching := []SearchResult{}
+	for _, result := range results {
+		room := result.Room
+		switch {
+		case category != "" && !strings.EqualFold(room.Category, category):
+		case tag != "" && !hasTag(room, tag):
+		case flags["step_free"] && !room.Accessibility.StepFree:
+		case flags["open_now"] && !room.OpenAt(now):
+		default:
+			matching = append(matching, result)
+		}
+		if len(matching) == limit {
+			break
+		}
+	}
+	encoder.Encode(ResponsePage{Items: matching})
+}
+
+func hasTag(room Room, tag string) bool {
+	for _, t := range room.Tags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}
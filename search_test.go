@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func testIndex() (*MemoryStore, *RoomIndex) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	for _, room := range []Room{
+		{ID: "r1", Name: "Library", Tags: []string{"books", "quiet"}, Category: "study"},
+		{ID: "r2", Name: "Reading room", Description: "Newspapers and library books", Category: "study"},
+		{ID: "r3", Name: "Chemistry lab", Tags: []string{"science"}, Category: "lab"},
+		{ID: "r4", Name: "Biology lab", Tags: []string{"science", "quiet"}, Category: "lab"},
+	} {
+		store.PutRoom(ctx, room)
+	}
+	return store, NewRoomIndex(store)
+}
+
+func searchIDs(t *testing.T, index *RoomIndex, query string) []string {
+	t.Helper()
+	results, err := index.Search(context.Background(), query)
+	if err != nil {
+		t.Fatalf("Search(%q): %v", query, err)
+	}
+	ids := []string{}
+	for _, result := range results {
+		ids = append(ids, result.Room.ID)
+	}
+	return ids
+}
+
+func TestRoomIndexSearch(t *testing.T) {
+	_, index := testIndex()
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		// A match in the name outweighs one in the description.
+		{"library", []string{"r1", "r2"}},
+		// Every word must match, in any field.
+		{"quiet lab", []string{"r4"}},
+		{"Science LABS", []string{"r4", "r3"}},
+		{"book", []string{"r1", "r2"}},
+		// A word matches the words it begins.
+		{"chem", []string{"r3"}},
+		{"library gym", []string{}},
+		{"", []string{"r4", "r3", "r1", "r2"}},
+		{"   ", []string{"r4", "r3", "r1", "r2"}},
+		{"the of and", []string{}},
+		{"the lab", []string{"r4", "r3"}},
+	}
+	for _, test := range tests {
+		if ids := searchIDs(t, index, test.query); !reflect.DeepEqual(ids, test.want) {
+			t.Errorf("Search(%q) = %v, want %v", test.query, ids, test.want)
+		}
+	}
+}
+
+func TestRoomIndexInvalidate(t *testing.T) {
+	store, index := testIndex()
+	if ids := searchIDs(t, index, "gym"); len(ids) != 0 {
+		t.Fatalf("Search(gym) = %v before any gym exists", ids)
+	}
+	store.PutRoom(context.Background(), Room{ID: "r5", Name: "Gym"})
+	index.Invalidate()
+	if ids := searchIDs(t, index, "gym"); !reflect.DeepEqual(ids, []string{"r5"}) {
+		t.Errorf("Search(gym) after Invalidate = %v, want [r5]", ids)
+	}
+}
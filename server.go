@@ -10,29 +10,134 @@ type Server struct {
 	JourneyManager
 	TripManager
 	RoomManager
-	*PubnubManager
+	RobotManager
+	MapManager
+	Migrations
+	Outbox
+	Publisher
+	Authenticator
+}
+
+// NewServer wires every manager to the given store and publisher.
+// Journeys and trips written through store are recorded as events
+// and pushed to the clients following them.
+func NewServer(store Store, publisher Publisher, authenticator Authenticator) Server {
+	hub := NewHub()
+	status := &robotStatus{}
+	store = hubStore{Store: journalStore{Store: store}, hub: hub}
+	outbox := Outbox{
+		publisher: publisher,
+		transactor: store,
+		commands: store,
+		trips: store,
+		journeys: store,
+	}
+	tripManager := TripManager{
+		outbox: outbox,
+		transactor: store,
+		trips: store,
+		journeys: store,
+		rooms: store,
+	}
+	mapManager := MapManager{
+		transactor: store,
+		floors: store,
+		edges: store,
+		connectors: store,
+		rooms: store,
+	}
+	return Server{
+		Outbox: outbox,
+		Publisher: publisher,
+		Authenticator: authenticator,
+		UserManager: UserManager{
+			transactor: store,
+			users: store,
+			journeys: store,
+			trips: store,
+			rooms: store,
+		},
+		JourneyManager: JourneyManager{
+			outbox: outbox,
+			hub: hub,
+			commands: store,
+			events: store,
+			transactor: store,
+			journeys: store,
+			users: store,
+			trips: store,
+			rooms: store,
+			maps: mapManager,
+			robot: status,
+		},
+		TripManager: tripManager,
+		RoomManager: RoomManager{
+			transactor: store,
+			rooms: store,
+			trips: store,
+			maps: mapManager,
+			index: NewRoomIndex(store),
+			location: buildingLocation(),
+		},
+		MapManager: mapManager,
+		Migrations: Migrations{
+			transactor: store,
+			users: store,
+			journeys: store,
+			trips: store,
+			rooms: store,
+		},
+		RobotManager: RobotManager{
+			outbox: outbox,
+			hub: hub,
+			trips: tripManager,
+			status: status,
+		},
+	}
 }
 
 type Manager interface {
 	Group() Group
+	LegacyGroup() Group
 }
 
 type ResponseError struct {
-	Error string `json:"error"`
+	Error *Error `json:"error"`
 }
 
 type ResponseSuccess struct {
 	Success bool `json:"success"`
 }
 
-func (server Server) Handler() http.Handler {
+// Handler builds the router for every manager's Group behind
+// authentication. It fails if two routes would match the same
+// requests.
+func (server Server) Handler() (http.Handler, error) {
 	router := Routes{
-		"trip/": server.TripManager.Group(),
-		"user/": server.UserManager.Group(),
-		"room/": server.RoomManager.Group(),
-		"journey/": server.JourneyManager.Group(),
+		"trips/": server.TripManager.Group(),
+		"users/": server.UserManager.Group(),
+		"rooms/": server.RoomManager.Group(),
+		"journeys/": server.JourneyManager.Group(),
+		"robot/": server.RobotManager.Group(),
+		"outbox/": server.Outbox.Group(),
+		"map/": server.MapManager.Group(),
+		"migrations/": server.Migrations.Group(),
+		"route": Methods{
+			http.MethodGet: Route{Handler: server.MapManager.GetRoute},
+		},
+
+		"trip/": server.TripManager.LegacyGroup(),
+		"user/": server.UserManager.LegacyGroup(),
+		"room/": server.RoomManager.LegacyGroup(),
+		"journey/": server.JourneyManager.LegacyGroup(),
+	}
+	handler, err := router.Serve()
+	if err != nil {
+		return nil, err
 	}
-	return router.Serve()
+	// EventSource cannot set headers, so streams take the token in the
+	// query as well.
+	return server.Authenticate(handler, "/journeys/{journeyid}/events", "/journey/{journeyid}/events"), nil
 }
 
 func (server Server) MiddleEncoding(f http.HandlerFunc) http.HandlerFunc {
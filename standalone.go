@@ -0,0 +1,109 @@
+//go:build !appengine
+// +build !appengine
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// shutdownTimeout bounds how long in-flight requests may take
+// to finish once a shutdown signal has been received.
+const shutdownTimeout = 10 * time.Second
+
+func main() {
+	addr := flag.String("addr", defaultAddr(), "address to listen on")
+	issue := flag.String("issue-token", "", "print a token for `kind:subject`, e.g. robot:unicub, and exit")
+	ttl := flag.Duration("token-ttl", 24*time.Hour, "how long issued tokens are valid")
+	flag.Parse()
+
+	authConfig := AuthConfigFromEnv()
+	authenticator, err := NewAuthenticator(authConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *issue != "" {
+		issueToken(authenticator, *issue, *ttl)
+		return
+	}
+	if authConfig.Disabled {
+		log.Println("Backend authentication is disabled, tokens are not verified")
+	}
+
+	bus, err := NewBusFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	server := NewServer(NewMemoryStore(), bus, authenticator)
+	if err := bus.Subscribe(server.RobotManager.HandleMessage); err != nil {
+		log.Fatal(err)
+	}
+	outboxCtx, stopOutbox := context.WithCancel(context.Background())
+	defer stopOutbox()
+	go server.Outbox.Run(outboxCtx)
+	log.Println("Backend initializing...")
+	handler, err := server.Handler()
+	if err != nil {
+		log.Fatal(err)
+	}
+	httpServer := &http.Server{
+		Addr:    *addr,
+		Handler: handler,
+	}
+	// Shutdown waits for streaming requests, which only end once
+	// their updates stop.
+	httpServer.RegisterOnShutdown(server.JourneyManager.hub.Close)
+
+	done := make(chan struct{})
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-signals
+		log.Printf("Backend received %v, shutting down...", sig)
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := httpServer.Shutdown(ctx); err != nil {
+			log.Println(err)
+		}
+		close(done)
+	}()
+
+	log.Printf("Backend listening on %s", *addr)
+	if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-done
+	log.Println("Backend stopped")
+}
+
+// issueToken prints a token for the principal named as kind:subject.
+func issueToken(authenticator Authenticator, name string, ttl time.Duration) {
+	parts := strings.SplitN(name, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		log.Fatalf("issue-token: %q is not kind:subject", name)
+	}
+	principal := Principal{Kind: PrincipalKind(parts[0]), Subject: parts[1]}
+	token, err := authenticator.Issue(principal, ttl, time.Now())
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(token)
+}
+
+// defaultAddr honours the PORT variable set by most container
+// platforms and falls back to :8080.
+func defaultAddr() string {
+	if port := os.Getenv("PORT"); port != "" {
+		return ":" + port
+	}
+	return ":8080"
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+)
+
+type JourneyState string
+
+const (
+	JourneyPlanned   JourneyState = "planned"
+	JourneyActive    JourneyState = "active"
+	JourneyCompleted JourneyState = "completed"
+	JourneyAborted   JourneyState = "aborted"
+)
+
+type TripState string
+
+const (
+	TripPlanned    TripState = "planned"
+	TripInProgress TripState = "in_progress"
+	TripArrived    TripState = "arrived"
+	TripFailed     TripState = "failed"
+	TripCancelled  TripState = "cancelled"
+)
+
+// journeyTransitions lists the states each journey state may move to.
+// States without an entry are final.
+var journeyTransitions = map[JourneyState][]JourneyState{
+	JourneyPlanned: {JourneyActive, JourneyAborted},
+	JourneyActive:  {JourneyCompleted, JourneyAborted},
+}
+
+// tripTransitions lists the states each trip state may move to.
+// States without an entry are final.
+var tripTransitions = map[TripState][]TripState{
+	TripPlanned:    {TripInProgress, TripCancelled},
+	TripInProgress: {TripArrived, TripFailed, TripCancelled},
+}
+
+// CurrentState is the state of journey, deriving it from the legacy
+// fields for journeys stored before states existed.
+func (journey Journey) CurrentState() JourneyState {
+	switch {
+	case journey.State != "":
+		return journey.State
+	case journey.Finished:
+		return JourneyCompleted
+	case journey.StartAt != 0:
+		return JourneyActive
+	}
+	return JourneyPlanned
+}
+
+// Transition moves journey to the given state, or reports a conflict
+// if its lifecycle does not allow it.
+func (journey *Journey) Transition(to JourneyState) error {
+	from := journey.CurrentState()
+	for _, allowed := range journeyTransitions[from] {
+		if allowed == to {
+			journey.State = to
+			return nil
+		}
+	}
+	return illegalTransition("journey", journey.ID, string(from), string(to))
+}
+
+// CurrentState is the state of trip, deriving it from the legacy
+// fields for trips stored before states existed.
+func (trip Trip) CurrentState() TripState {
+	switch {
+	case trip.State != "":
+		return trip.State
+	case trip.Success:
+		return TripArrived
+	case trip.LeftAt != 0:
+		return TripInProgress
+	}
+	return TripPlanned
+}
+
+// Final reports whether trip has reached the end of its lifecycle.
+func (trip Trip) Final() bool {
+	_, ok := tripTransitions[trip.CurrentState()]
+	return !ok
+}
+
+// Transition moves trip to the given state, or reports a conflict
+// if its lifecycle does not allow it.
+func (trip *Trip) Transition(to TripState) error {
+	from := trip.CurrentState()
+	for _, allowed := range tripTransitions[from] {
+		if allowed == to {
+			trip.State = to
+			return nil
+		}
+	}
+	return illegalTransition("trip", trip.ID, string(from), string(to))
+}
+
+func illegalTransition(entity, id, from, to string) error {
+	return &Error{
+		Code:    CodeConflict,
+		Message: fmt.Sprintf("%s cannot go from %s to %s", entity, from, to),
+		Entity:  entity,
+		ID:      id,
+		Details: map[string]string{"from": from, "to": to},
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestJourneyTransition(t *testing.T) {
+	tests := []struct {
+		from, to JourneyState
+		ok       bool
+	}{
+		{JourneyPlanned, JourneyActive, true},
+		{JourneyPlanned, JourneyAborted, true},
+		{JourneyPlanned, JourneyCompleted, false},
+		{JourneyActive, JourneyCompleted, true},
+		{JourneyActive, JourneyAborted, true},
+		{JourneyActive, JourneyPlanned, false},
+		{JourneyCompleted, JourneyActive, false},
+		{JourneyCompleted, JourneyAborted, false},
+		{JourneyAborted, JourneyActive, false},
+	}
+	for _, test := range tests {
+		journey := Journey{ID: "j1", State: test.from}
+		err := journey.Transition(test.to)
+		switch {
+		case test.ok && err != nil:
+			t.Errorf("%s to %s: %v", test.from, test.to, err)
+		case test.ok && journey.State != test.to:
+			t.Errorf("%s to %s left the journey %s", test.from, test.to, journey.State)
+		case !test.ok && !isConflict(err):
+			t.Errorf("%s to %s = %v, want a conflict", test.from, test.to, err)
+		case !test.ok && journey.State != test.from:
+			t.Errorf("%s to %s moved the journey to %s despite failing", test.from, test.to, journey.State)
+		}
+	}
+}
+
+func TestTripTransition(t *testing.T) {
+	tests := []struct {
+		from, to TripState
+		ok       bool
+	}{
+		{TripPlanned, TripInProgress, true},
+		{TripPlanned, TripCancelled, true},
+		{TripPlanned, TripArrived, false},
+		{TripInProgress, TripArrived, true},
+		{TripInProgress, TripFailed, true},
+		{TripInProgress, TripCancelled, true},
+		{TripArrived, TripInProgress, false},
+		{TripFailed, TripCancelled, false},
+		{TripCancelled, TripPlanned, false},
+	}
+	for _, test := range tests {
+		trip := Trip{ID: "t1", State: test.from}
+		err := trip.Transition(test.to)
+		switch {
+		case test.ok && err != nil:
+			t.Errorf("%s to %s: %v", test.from, test.to, err)
+		case test.ok && trip.State != test.to:
+			t.Errorf("%s to %s left the trip %s", test.from, test.to, trip.State)
+		case !test.ok && !isConflict(err):
+			t.Errorf("%s to %s = %v, want a conflict", test.from, test.to, err)
+		}
+	}
+}
+
+func TestLegacyStates(t *testing.T) {
+	journeys := []struct {
+		journey Journey
+		want    JourneyState
+	}{
+		{Journey{}, JourneyPlanned},
+		{Journey{StartAt: 100}, JourneyActive},
+		{Journey{StartAt: 100, Finished: true}, JourneyCompleted},
+		{Journey{Finished: true, State: JourneyAborted}, JourneyAborted},
+	}
+	for _, test := range journeys {
+		if got := test.journey.CurrentState(); got != test.want {
+			t.Errorf("CurrentState of %+v = %s, want %s", test.journey, got, test.want)
+		}
+	}
+
+	trips := []struct {
+		trip  Trip
+		want  TripState
+		final bool
+	}{
+		{Trip{}, TripPlanned, false},
+		{Trip{LeftAt: 100}, TripInProgress, false},
+		{Trip{LeftAt: 100, Success: true}, TripArrived, true},
+		{Trip{State: TripCancelled}, TripCancelled, true},
+	}
+	for _, test := range trips {
+		if got := test.trip.CurrentState(); got != test.want {
+			t.Errorf("CurrentState of %+v = %s, want %s", test.trip, got, test.want)
+		}
+		if got := test.trip.Final(); got != test.final {
+			t.Errorf("Final of %+v = %v, want %v", test.trip, got, test.final)
+		}
+	}
+}
+
+func isConflict(err error) bool {
+	e, ok := err.(*Error)
+	return ok && e.Code == CodeConflict
+}
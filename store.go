@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+)
+
+// UserStore persists User entities. Get and Delete report
+// ErrUserMissing when no user has the given ID. List returns a page of
+// users and the cursor of the next one.
+type UserStore interface {
+	GetUser(ctx context.Context, id string) (User, error)
+	PutUser(ctx context.Context, user User) error
+	DeleteUser(ctx context.Context, id string) error
+	ListUsers(ctx context.Context, query ListQuery) ([]User, string, error)
+}
+
+// JourneyStore persists Journey entities. Get and Delete report
+// ErrJourneyMissing when no journey has the given ID. List returns a page of
+// journeys and the cursor of the next one.
+type JourneyStore interface {
+	GetJourney(ctx context.Context, id string) (Journey, error)
+	PutJourney(ctx context.Context, journey Journey) error
+	DeleteJourney(ctx context.Context, id string) error
+	ListJourneys(ctx context.Context, query ListQuery) ([]Journey, string, error)
+}
+
+// TripStore persists Trip entities. Get and Delete report
+// ErrTripMissing when no trip has the given ID. List returns a page of
+// trips and the cursor of the next one.
+type TripStore interface {
+	GetTrip(ctx context.Context, id string) (Trip, error)
+	PutTrip(ctx context.Context, trip Trip) error
+	DeleteTrip(ctx context.Context, id string) error
+	ListTrips(ctx context.Context, query ListQuery) ([]Trip, string, error)
+}
+
+// RoomStore persists Room entities. Get and Delete report
+// ErrRoomMissing when no room has the given ID. List returns a page of
+// rooms and the cursor of the next one.
+type RoomStore interface {
+	GetRoom(ctx context.Context, id string) (Room, error)
+	PutRoom(ctx context.Context, room Room) error
+	DeleteRoom(ctx context.Context, id string) error
+	ListRooms(ctx context.Context, query ListQuery) ([]Room, string, error)
+}
+
+// FloorStore persists the floors of the building map. Get and Delete
+// report ErrFloorMissing when no floor has the given ID. Floors
+// returns every floor, lowest first. Like Edges and Connectors, it
+// may be called in a transaction.
+type FloorStore interface {
+	GetFloor(ctx context.Context, id string) (Floor, error)
+	PutFloor(ctx context.Context, floor Floor) error
+	DeleteFloor(ctx context.Context, id string) error
+	Floors(ctx context.Context) ([]Floor, error)
+}
+
+// EdgeStore persists the edges between rooms. Get and Delete report
+// ErrEdgeMissing when no edge has the given ID.
+type EdgeStore interface {
+	GetEdge(ctx context.Context, id string) (Edge, error)
+	PutEdge(ctx context.Context, edge Edge) error
+	DeleteEdge(ctx context.Context, id string) error
+	Edges(ctx context.Context) ([]Edge, error)
+}
+
+// ConnectorStore persists the connectors between floors. Get and
+// Delete report ErrConnectorMissing when no connector has the given ID.
+type ConnectorStore interface {
+	GetConnector(ctx context.Context, id string) (Connector, error)
+	PutConnector(ctx context.Context, connector Connector) error
+	DeleteConnector(ctx context.Context, id string) error
+	Connectors(ctx context.Context) ([]Connector, error)
+}
+
+// CommandStore persists the outbox of robot commands. Get reports
+// ErrCommandMissing when no command has the given ID.
+type CommandStore interface {
+	GetCommand(ctx context.Context, id string) (Command, error)
+	PutCommand(ctx context.Context, command Command) error
+	// JourneyCommands lists the commands sent for a journey, oldest first.
+	JourneyCommands(ctx context.Context, journeyID string) ([]Command, error)
+	// DueCommands lists the pending commands whose next attempt is due
+	// at now, in Unix seconds.
+	DueCommands(ctx context.Context, now int64) ([]Command, error)
+}
+
+// EventStore keeps the append-only log of changes to journeys and
+// their trips.
+type EventStore interface {
+	AppendEvent(ctx context.Context, event Event) error
+	// JourneyEvents lists the events of a journey and its trips in
+	// the order of their Sequence.
+	JourneyEvents(ctx context.Context, journeyID string) ([]Event, error)
+}
+
+// Transactor runs f atomically: either every write f makes through
+// the stores with the context it is given is applied, or none is.
+// Transactions nested in f join the enclosing one.
+type Transactor interface {
+	RunInTransaction(ctx context.Context, f func(ctx context.Context) error) error
+}
+
+// Store is the full storage layer the managers are built on.
+type Store interface {
+	Transactor
+	UserStore
+	JourneyStore
+	TripStore
+	RoomStore
+	FloorStore
+	EdgeStore
+	ConnectorStore
+	CommandStore
+	EventStore
+}
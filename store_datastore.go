@@ -0,0 +1,335 @@
+//go:build appengine
+// +build appengine
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// transactionAttempts is how often a transaction is tried before
+// giving up on contention.
+const transactionAttempts = 5
+
+type appengineContextKey struct{}
+
+type datastoreTxKey struct{}
+
+// DatastoreStore is a Store backed by the App Engine datastore. Requests
+// must pass through WithAppengineContext before reaching a manager.
+type DatastoreStore struct{}
+
+// WithAppengineContext attaches the App Engine context of each request
+// to its context.Context so that DatastoreStore can reach the datastore.
+func WithAppengineContext(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), appengineContextKey{}, appengine.NewContext(r))
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func appengineContext(ctx context.Context) appengine.Context {
+	return ctx.Value(appengineContextKey{}).(appengine.Context)
+}
+
+// RunInTransaction runs f in a cross-group datastore transaction,
+// retrying it when it collides with a concurrent one.
+func (store DatastoreStore) RunInTransaction(ctx context.Context, f func(ctx context.Context) error) error {
+	if ctx.Value(datastoreTxKey{}) != nil {
+		return f(ctx)
+	}
+	options := &datastore.TransactionOptions{XG: true, Attempts: transactionAttempts}
+	return datastore.RunInTransaction(appengineContext(ctx), func(tc appengine.Context) error {
+		txCtx := context.WithValue(ctx, appengineContextKey{}, tc)
+		return f(context.WithValue(txCtx, datastoreTxKey{}, true))
+	}, options)
+}
+
+// mapKinds are the kinds of the building map. They share the entity
+// group of mapKey, so that they can be queried in transactions.
+var mapKinds = map[string]bool{"floor": true, "edge": true, "connector": true}
+
+// mapKey is the parent of every entity of the building map.
+func mapKey(c appengine.Context) *datastore.Key {
+	return datastore.NewKey(c, "map", "building", 0, nil)
+}
+
+// key is the key of the entity of kind with the given ID.
+func key(c appengine.Context, kind, id string) *datastore.Key {
+	var parent *datastore.Key
+	if mapKinds[kind] {
+		parent = mapKey(c)
+	}
+	return datastore.NewKey(c, kind, id, 0, parent)
+}
+
+func (store DatastoreStore) get(ctx context.Context, kind, id string, dst interface{}, missing error) error {
+	c := appengineContext(ctx)
+	dataErr := datastore.Get(c, key(c, kind, id), dst)
+	if dataErr == datastore.ErrNoSuchEntity {
+		return missing
+	}
+	return dataErr
+}
+
+func (store DatastoreStore) put(ctx context.Context, kind, id string, src interface{}) error {
+	c := appengineContext(ctx)
+	_, dataErr := datastore.Put(c, key(c, kind, id), src)
+	return dataErr
+}
+
+// delete removes the entity, first checking that it exists since
+// datastore.Delete succeeds silently on missing keys.
+func (store DatastoreStore) delete(ctx context.Context, kind, id string, dst interface{}, missing error) error {
+	if dataErr := store.get(ctx, kind, id, dst, missing); dataErr != nil {
+		return dataErr
+	}
+	c := appengineContext(ctx)
+	dataErr := datastore.Delete(c, key(c, kind, id))
+	if dataErr == datastore.ErrInvalidKey {
+		return missing
+	}
+	return dataErr
+}
+
+// list runs query on the entities of kind, appending the page it
+// selects to the slice dst points to, and returns the cursor of the
+// next page if there is one. Entities stored before a property
+// existed lack it and are left out of queries on it until they are
+// written again.
+func (store DatastoreStore) list(ctx context.Context, kind string, query ListQuery, dst interface{}) (string, error) {
+	c := appengineContext(ctx)
+	q := datastore.NewQuery(kind)
+	for _, filter := range query.Filters {
+		q = q.Filter(filter.Property+" =", filter.Value)
+	}
+	if query.Order != "" {
+		q = q.Order(query.Order)
+	}
+	if query.Cursor != "" {
+		cursor, err := datastore.DecodeCursor(query.Cursor)
+		if err != nil {
+			return "", ErrInvalidCursor
+		}
+		q = q.Start(cursor)
+	}
+	// One entity more than the page tells whether another page follows.
+	iterator := q.Limit(query.Limit + 1).Run(c)
+	slice := reflect.ValueOf(dst).Elem()
+	for i := 0; ; i++ {
+		if i == query.Limit {
+			cursor, err := iterator.Cursor()
+			if err != nil {
+				return "", err
+			}
+			if _, err := iterator.Next(reflect.New(slice.Type().Elem()).Interface()); err == datastore.Done {
+				return "", nil
+			} else if err != nil {
+				return "", err
+			}
+			return cursor.String(), nil
+		}
+		entity := reflect.New(slice.Type().Elem())
+		if _, err := iterator.Next(entity.Interface()); err == datastore.Done {
+			return "", nil
+		} else if err != nil {
+			return "", err
+		}
+		slice.Set(reflect.Append(slice, entity.Elem()))
+	}
+}
+
+func (store DatastoreStore) GetUser(ctx context.Context, id string) (User, error) {
+	user := User{}
+	dataErr := store.get(ctx, "user", id, &user, ErrUserMissing)
+	return user, dataErr
+}
+
+func (store DatastoreStore) PutUser(ctx context.Context, user User) error {
+	return store.put(ctx, "user", user.ID, &user)
+}
+
+func (store DatastoreStore) DeleteUser(ctx context.Context, id string) error {
+	return store.delete(ctx, "user", id, &User{}, ErrUserMissing)
+}
+
+func (store DatastoreStore) GetJourney(ctx context.Context, id string) (Journey, error) {
+	journey := Journey{}
+	dataErr := store.get(ctx, "journey", id, &journey, ErrJourneyMissing)
+	return journey, dataErr
+}
+
+func (store DatastoreStore) PutJourney(ctx context.Context, journey Journey) error {
+	return store.put(ctx, "journey", journey.ID, &journey)
+}
+
+func (store DatastoreStore) DeleteJourney(ctx context.Context, id string) error {
+	return store.delete(ctx, "journey", id, &Journey{}, ErrJourneyMissing)
+}
+
+func (store DatastoreStore) GetTrip(ctx context.Context, id string) (Trip, error) {
+	trip := Trip{}
+	dataErr := store.get(ctx, "trip", id, &trip, ErrTripMissing)
+	return trip, dataErr
+}
+
+func (store DatastoreStore) PutTrip(ctx context.Context, trip Trip) error {
+	return store.put(ctx, "trip", trip.ID, &trip)
+}
+
+func (store DatastoreStore) DeleteTrip(ctx context.Context, id string) error {
+	return store.delete(ctx, "trip", id, &Trip{}, ErrTripMissing)
+}
+
+func (store DatastoreStore) GetRoom(ctx context.Context, id string) (Room, error) {
+	room := Room{}
+	dataErr := store.get(ctx, "room", id, &room, ErrRoomMissing)
+	return room, dataErr
+}
+
+func (store DatastoreStore) PutRoom(ctx context.Context, room Room) error {
+	return store.put(ctx, "room", room.ID, &room)
+}
+
+func (store DatastoreStore) DeleteRoom(ctx context.Context, id string) error {
+	return store.delete(ctx, "room", id, &Room{}, ErrRoomMissing)
+}
+
+func (store DatastoreStore) GetFloor(ctx context.Context, id string) (Floor, error) {
+	floor := Floor{}
+	dataErr := store.get(ctx, "floor", id, &floor, ErrFloorMissing)
+	return floor, dataErr
+}
+
+func (store DatastoreStore) PutFloor(ctx context.Context, floor Floor) error {
+	return store.put(ctx, "floor", floor.ID, &floor)
+}
+
+func (store DatastoreStore) DeleteFloor(ctx context.Context, id string) error {
+	return store.delete(ctx, "floor", id, &Floor{}, ErrFloorMissing)
+}
+
+func (store DatastoreStore) Floors(ctx context.Context) ([]Floor, error) {
+	c := appengineContext(ctx)
+	floors := []Floor{}
+	_, dataErr := datastore.NewQuery("floor").Ancestor(mapKey(c)).Order("level").GetAll(c, &floors)
+	return floors, dataErr
+}
+
+func (store DatastoreStore) GetEdge(ctx context.Context, id string) (Edge, error) {
+	edge := Edge{}
+	dataErr := store.get(ctx, "edge", id, &edge, ErrEdgeMissing)
+	return edge, dataErr
+}
+
+func (store DatastoreStore) PutEdge(ctx context.Context, edge Edge) error {
+	return store.put(ctx, "edge", edge.ID, &edge)
+}
+
+func (store DatastoreStore) DeleteEdge(ctx context.Context, id string) error {
+	return store.delete(ctx, "edge", id, &Edge{}, ErrEdgeMissing)
+}
+
+func (store DatastoreStore) Edges(ctx context.Context) ([]Edge, error) {
+	c := appengineContext(ctx)
+	edges := []Edge{}
+	_, dataErr := datastore.NewQuery("edge").Ancestor(mapKey(c)).Order("id").GetAll(c, &edges)
+	return edges, dataErr
+}
+
+func (store DatastoreStore) GetConnector(ctx context.Context, id string) (Connector, error) {
+	connector := Connector{}
+	dataErr := store.get(ctx, "connector", id, &connector, ErrConnectorMissing)
+	return connector, dataErr
+}
+
+func (store DatastoreStore) PutConnector(ctx context.Context, connector Connector) error {
+	return store.put(ctx, "connector", connector.ID, &connector)
+}
+
+func (store DatastoreStore) DeleteConnector(ctx context.Context, id string) error {
+	return store.delete(ctx, "connector", id, &Connector{}, ErrConnectorMissing)
+}
+
+func (store DatastoreStore) Connectors(ctx context.Context) ([]Connector, error) {
+	c := appengineContext(ctx)
+	connectors := []Connector{}
+	_, dataErr := datastore.NewQuery("connector").Ancestor(mapKey(c)).Order("id").GetAll(c, &connectors)
+	return connectors, dataErr
+}
+
+func (store DatastoreStore) GetCommand(ctx context.Context, id string) (Command, error) {
+	command := Command{}
+	dataErr := store.get(ctx, "command", id, &command, ErrCommandMissing)
+	return command, dataErr
+}
+
+func (store DatastoreStore) PutCommand(ctx context.Context, command Command) error {
+	return store.put(ctx, "command", command.ID, &command)
+}
+
+// JourneyCommands needs the composite index on journey_id and
+// created_at declared in index.yaml.
+func (store DatastoreStore) JourneyCommands(ctx context.Context, journeyID string) ([]Command, error) {
+	commands := []Command{}
+	query := datastore.NewQuery("command").Filter("journey_id =", journeyID).Order("created_at")
+	_, dataErr := query.GetAll(appengineContext(ctx), &commands)
+	return commands, dataErr
+}
+
+// DueCommands needs the composite index on status and next_attempt_at
+// declared in index.yaml.
+func (store DatastoreStore) DueCommands(ctx context.Context, now int64) ([]Command, error) {
+	commands := []Command{}
+	query := datastore.NewQuery("command").Filter("status =", string(CommandPending)).Filter("next_attempt_at <=", now)
+	_, dataErr := query.GetAll(appengineContext(ctx), &commands)
+	return commands, dataErr
+}
+
+// AppendEvent stores event in the entity group of its journey, which
+// keeps transactions writing both within few groups.
+func (store DatastoreStore) AppendEvent(ctx context.Context, event Event) error {
+	c := appengineContext(ctx)
+	parent := datastore.NewKey(c, "journey", event.JourneyID, 0, nil)
+	_, dataErr := datastore.Put(c, datastore.NewKey(c, "event", event.ID, 0, parent), &event)
+	return dataErr
+}
+
+// JourneyEvents needs the ancestor index on sequence declared in
+// index.yaml.
+func (store DatastoreStore) JourneyEvents(ctx context.Context, journeyID string) ([]Event, error) {
+	c := appengineContext(ctx)
+	events := []Event{}
+	query := datastore.NewQuery("event").Ancestor(datastore.NewKey(c, "journey", journeyID, 0, nil)).Order("sequence")
+	_, dataErr := query.GetAll(c, &events)
+	return events, dataErr
+}
+
+func (store DatastoreStore) ListUsers(ctx context.Context, query ListQuery) ([]User, string, error) {
+	users := []User{}
+	next, dataErr := store.list(ctx, "user", query, &users)
+	return users, next, dataErr
+}
+
+func (store DatastoreStore) ListJourneys(ctx context.Context, query ListQuery) ([]Journey, string, error) {
+	journeys := []Journey{}
+	next, dataErr := store.list(ctx, "journey", query, &journeys)
+	return journeys, next, dataErr
+}
+
+func (store DatastoreStore) ListTrips(ctx context.Context, query ListQuery) ([]Trip, string, error) {
+	trips := []Trip{}
+	next, dataErr := store.list(ctx, "trip", query, &trips)
+	return trips, next, dataErr
+}
+
+func (store DatastoreStore) ListRooms(ctx context.Context, query ListQuery) ([]Room, string, error) {
+	rooms := []Room{}
+	next, dataErr := store.list(ctx, "room", query, &rooms)
+	return rooms, next, dataErr
+}
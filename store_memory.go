@@ -0,0 +1,511 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type memoryKey struct {
+	kind string
+	id   string
+}
+
+type memoryTxKey struct{}
+
+// memoryTx stages the writes of a transaction until it commits.
+// A nil value marks a deleted entity.
+type memoryTx struct {
+	writes map[memoryKey]interface{}
+}
+
+// MemoryStore is a Store that keeps every entity in process memory.
+// It is meant for running the API locally and in tests. Transactions
+// are serialized, so they never contend.
+type MemoryStore struct {
+	mu       sync.RWMutex
+	txMu     sync.Mutex
+	entities map[memoryKey]interface{}
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		entities: map[memoryKey]interface{}{},
+	}
+}
+
+func (store *MemoryStore) RunInTransaction(ctx context.Context, f func(ctx context.Context) error) error {
+	if _, ok := ctx.Value(memoryTxKey{}).(*memoryTx); ok {
+		return f(ctx)
+	}
+	store.txMu.Lock()
+	defer store.txMu.Unlock()
+	tx := &memoryTx{writes: map[memoryKey]interface{}{}}
+	if err := f(context.WithValue(ctx, memoryTxKey{}, tx)); err != nil {
+		return err
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	for key, value := range tx.writes {
+		if value == nil {
+			delete(store.entities, key)
+		} else {
+			store.entities[key] = value
+		}
+	}
+	return nil
+}
+
+func (store *MemoryStore) get(ctx context.Context, kind, id string) (interface{}, bool) {
+	key := memoryKey{kind, id}
+	if tx, ok := ctx.Value(memoryTxKey{}).(*memoryTx); ok {
+		if value, staged := tx.writes[key]; staged {
+			return value, value != nil
+		}
+	}
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	value, ok := store.entities[key]
+	return value, ok
+}
+
+func (store *MemoryStore) put(ctx context.Context, kind, id string, value interface{}) {
+	key := memoryKey{kind, id}
+	if tx, ok := ctx.Value(memoryTxKey{}).(*memoryTx); ok {
+		tx.writes[key] = value
+		return
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if value == nil {
+		delete(store.entities, key)
+	} else {
+		store.entities[key] = value
+	}
+}
+
+func (store *MemoryStore) delete(ctx context.Context, kind, id string, missing error) error {
+	if _, ok := store.get(ctx, kind, id); !ok {
+		return missing
+	}
+	store.put(ctx, kind, id, nil)
+	return nil
+}
+
+// list returns every committed entity of kind that keep accepts.
+// Like datastore queries, it does not see writes staged in a
+// transaction.
+func (store *MemoryStore) list(kind string, keep func(value interface{}) bool) []interface{} {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	values := []interface{}{}
+	for key, value := range store.entities {
+		if key.kind == kind && keep(value) {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// memoryCursor is the position after the last entity of a page: its
+// value of the sort property and its ID.
+type memoryCursor struct {
+	Value interface{} `json:"v"`
+	ID    string      `json:"id"`
+}
+
+// page selects the committed entities of kind that match query, in
+// its order with ties broken by ID, and returns the cursor of the
+// next page if there is one.
+func (store *MemoryStore) page(kind string, query ListQuery) ([]interface{}, string, error) {
+	property, desc := descending(query.Order)
+	before := func(a, b memoryCursor) bool {
+		if property == "" {
+			return a.ID < b.ID
+		}
+		if c := compareSortable(a.Value, b.Value); c != 0 {
+			return (c < 0) != desc
+		}
+		return a.ID < b.ID
+	}
+	position := func(value interface{}) memoryCursor {
+		cursor := memoryCursor{ID: propertyOf(value, "id").(string)}
+		if property != "" {
+			cursor.Value = propertyOf(value, property)
+		}
+		return cursor
+	}
+
+	var after *memoryCursor
+	if query.Cursor != "" {
+		decoded, err := decodeMemoryCursor(query.Cursor)
+		if err != nil {
+			return nil, "", ErrInvalidCursor
+		}
+		after = &decoded
+	}
+	values := store.list(kind, func(value interface{}) bool {
+		for _, filter := range query.Filters {
+			if compareSortable(propertyOf(value, filter.Property), sortable(filter.Value)) != 0 {
+				return false
+			}
+		}
+		return after == nil || before(*after, position(value))
+	})
+	sort.Slice(values, func(i, j int) bool {
+		return before(position(values[i]), position(values[j]))
+	})
+	if len(values) <= query.Limit {
+		return values, "", nil
+	}
+	values = values[:query.Limit]
+	encoded, err := json.Marshal(position(values[len(values)-1]))
+	if err != nil {
+		return nil, "", err
+	}
+	return values, base64.RawURLEncoding.EncodeToString(encoded), nil
+}
+
+func decodeMemoryCursor(cursor string) (memoryCursor, error) {
+	decoded := memoryCursor{}
+	encoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return decoded, err
+	}
+	decoder := json.NewDecoder(strings.NewReader(string(encoded)))
+	decoder.UseNumber()
+	if err := decoder.Decode(&decoded); err != nil {
+		return decoded, err
+	}
+	if number, ok := decoded.Value.(json.Number); ok {
+		if decoded.Value, err = number.Int64(); err != nil {
+			decoded.Value, err = number.Float64()
+		}
+	}
+	return decoded, err
+}
+
+// propertyOf returns the datastore property of entity with the given
+// name, following dots into nested structs, in sortable form.
+func propertyOf(entity interface{}, name string) interface{} {
+	value := reflect.ValueOf(entity)
+	for _, part := range strings.Split(name, ".") {
+		if value.Kind() != reflect.Struct {
+			return nil
+		}
+		field, ok := datastoreField(value.Type(), part)
+		if !ok {
+			return nil
+		}
+		value = value.FieldByIndex(field.Index)
+	}
+	return sortable(value.Interface())
+}
+
+func datastoreField(t reflect.Type, name string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := strings.Split(field.Tag.Get("datastore"), ",")[0]
+		if tag == name || tag == "" && field.Name == name {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// sortable converts v to int64, float64 or string, whichever of them
+// its kind corresponds to, so that values of named types compare.
+func sortable(v interface{}) interface{} {
+	value := reflect.ValueOf(v)
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return value.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(value.Uint())
+	case reflect.Float32, reflect.Float64:
+		return value.Float()
+	case reflect.String:
+		return value.String()
+	case reflect.Bool:
+		if value.Bool() {
+			return int64(1)
+		}
+		return int64(0)
+	}
+	return v
+}
+
+// compareSortable orders two sortable values, placing values of
+// different types by type.
+func compareSortable(a, b interface{}) int {
+	switch a := a.(type) {
+	case int64:
+		if b, ok := b.(int64); ok {
+			return compareOrdered(a < b, a > b)
+		}
+	case float64:
+		if b, ok := b.(float64); ok {
+			return compareOrdered(a < b, a > b)
+		}
+	case string:
+		if b, ok := b.(string); ok {
+			return compareOrdered(a < b, a > b)
+		}
+	}
+	return strings.Compare(reflect.TypeOf(a).String(), reflect.TypeOf(b).String())
+}
+
+func compareOrdered(less, greater bool) int {
+	switch {
+	case less:
+		return -1
+	case greater:
+		return 1
+	}
+	return 0
+}
+
+func (store *MemoryStore) GetUser(ctx context.Context, id string) (User, error) {
+	value, ok := store.get(ctx, "user", id)
+	if !ok {
+		return User{}, ErrUserMissing
+	}
+	return value.(User), nil
+}
+
+func (store *MemoryStore) PutUser(ctx context.Context, user User) error {
+	store.put(ctx, "user", user.ID, user)
+	return nil
+}
+
+func (store *MemoryStore) DeleteUser(ctx context.Context, id string) error {
+	return store.delete(ctx, "user", id, ErrUserMissing)
+}
+
+func (store *MemoryStore) GetJourney(ctx context.Context, id string) (Journey, error) {
+	value, ok := store.get(ctx, "journey", id)
+	if !ok {
+		return Journey{}, ErrJourneyMissing
+	}
+	return value.(Journey), nil
+}
+
+func (store *MemoryStore) PutJourney(ctx context.Context, journey Journey) error {
+	store.put(ctx, "journey", journey.ID, journey)
+	return nil
+}
+
+func (store *MemoryStore) DeleteJourney(ctx context.Context, id string) error {
+	return store.delete(ctx, "journey", id, ErrJourneyMissing)
+}
+
+func (store *MemoryStore) GetTrip(ctx context.Context, id string) (Trip, error) {
+	value, ok := store.get(ctx, "trip", id)
+	if !ok {
+		return Trip{}, ErrTripMissing
+	}
+	return value.(Trip), nil
+}
+
+func (store *MemoryStore) PutTrip(ctx context.Context, trip Trip) error {
+	store.put(ctx, "trip", trip.ID, trip)
+	return nil
+}
+
+func (store *MemoryStore) DeleteTrip(ctx context.Context, id string) error {
+	return store.delete(ctx, "trip", id, ErrTripMissing)
+}
+
+func (store *MemoryStore) GetRoom(ctx context.Context, id string) (Room, error) {
+	value, ok := store.get(ctx, "room", id)
+	if !ok {
+		return Room{}, ErrRoomMissing
+	}
+	return value.(Room), nil
+}
+
+func (store *MemoryStore) PutRoom(ctx context.Context, room Room) error {
+	store.put(ctx, "room", room.ID, room)
+	return nil
+}
+
+func (store *MemoryStore) DeleteRoom(ctx context.Context, id string) error {
+	return store.delete(ctx, "room", id, ErrRoomMissing)
+}
+
+func (store *MemoryStore) GetFloor(ctx context.Context, id string) (Floor, error) {
+	value, ok := store.get(ctx, "floor", id)
+	if !ok {
+		return Floor{}, ErrFloorMissing
+	}
+	return value.(Floor), nil
+}
+
+func (store *MemoryStore) PutFloor(ctx context.Context, floor Floor) error {
+	store.put(ctx, "floor", floor.ID, floor)
+	return nil
+}
+
+func (store *MemoryStore) DeleteFloor(ctx context.Context, id string) error {
+	return store.delete(ctx, "floor", id, ErrFloorMissing)
+}
+
+func (store *MemoryStore) GetEdge(ctx context.Context, id string) (Edge, error) {
+	value, ok := store.get(ctx, "edge", id)
+	if !ok {
+		return Edge{}, ErrEdgeMissing
+	}
+	return value.(Edge), nil
+}
+
+func (store *MemoryStore) PutEdge(ctx context.Context, edge Edge) error {
+	store.put(ctx, "edge", edge.ID, edge)
+	return nil
+}
+
+func (store *MemoryStore) DeleteEdge(ctx context.Context, id string) error {
+	return store.delete(ctx, "edge", id, ErrEdgeMissing)
+}
+
+func (store *MemoryStore) GetConnector(ctx context.Context, id string) (Connector, error) {
+	value, ok := store.get(ctx, "connector", id)
+	if !ok {
+		return Connector{}, ErrConnectorMissing
+	}
+	return value.(Connector), nil
+}
+
+func (store *MemoryStore) PutConnector(ctx context.Context, connector Connector) error {
+	store.put(ctx, "connector", connector.ID, connector)
+	return nil
+}
+
+func (store *MemoryStore) DeleteConnector(ctx context.Context, id string) error {
+	return store.delete(ctx, "connector", id, ErrConnectorMissing)
+}
+
+func (store *MemoryStore) Floors(ctx context.Context) ([]Floor, error) {
+	floors := []Floor{}
+	for _, value := range store.list("floor", all) {
+		floors = append(floors, value.(Floor))
+	}
+	sort.Slice(floors, func(i, j int) bool { return floors[i].Level < floors[j].Level })
+	return floors, nil
+}
+
+func (store *MemoryStore) Edges(ctx context.Context) ([]Edge, error) {
+	edges := []Edge{}
+	for _, value := range store.list("edge", all) {
+		edges = append(edges, value.(Edge))
+	}
+	sort.Slice(edges, func(i, j int) bool { return edges[i].ID < edges[j].ID })
+	return edges, nil
+}
+
+func (store *MemoryStore) Connectors(ctx context.Context) ([]Connector, error) {
+	connectors := []Connector{}
+	for _, value := range store.list("connector", all) {
+		connectors = append(connectors, value.(Connector))
+	}
+	sort.Slice(connectors, func(i, j int) bool { return connectors[i].ID < connectors[j].ID })
+	return connectors, nil
+}
+
+// all keeps every entity listed.
+func all(value interface{}) bool {
+	return true
+}
+
+func (store *MemoryStore) GetCommand(ctx context.Context, id string) (Command, error) {
+	value, ok := store.get(ctx, "command", id)
+	if !ok {
+		return Command{}, ErrCommandMissing
+	}
+	return value.(Command), nil
+}
+
+func (store *MemoryStore) PutCommand(ctx context.Context, command Command) error {
+	store.put(ctx, "command", command.ID, command)
+	return nil
+}
+
+func (store *MemoryStore) JourneyCommands(ctx context.Context, journeyID string) ([]Command, error) {
+	return store.commands(func(command Command) bool {
+		return command.JourneyID == journeyID
+	}), nil
+}
+
+func (store *MemoryStore) DueCommands(ctx context.Context, now int64) ([]Command, error) {
+	return store.commands(func(command Command) bool {
+		return command.Status == CommandPending && command.NextAttemptAt <= now
+	}), nil
+}
+
+// commands lists the commands keep accepts, oldest first.
+func (store *MemoryStore) commands(keep func(command Command) bool) []Command {
+	commands := []Command{}
+	for _, value := range store.list("command", func(value interface{}) bool { return keep(value.(Command)) }) {
+		commands = append(commands, value.(Command))
+	}
+	sort.Slice(commands, func(i, j int) bool {
+		if commands[i].CreatedAt != commands[j].CreatedAt {
+			return commands[i].CreatedAt < commands[j].CreatedAt
+		}
+		return commands[i].ID < commands[j].ID
+	})
+	return commands
+}
+
+func (store *MemoryStore) AppendEvent(ctx context.Context, event Event) error {
+	store.put(ctx, "event", event.ID, event)
+	return nil
+}
+
+func (store *MemoryStore) JourneyEvents(ctx context.Context, journeyID string) ([]Event, error) {
+	events := []Event{}
+	for _, value := range store.list("event", func(value interface{}) bool { return value.(Event).JourneyID == journeyID }) {
+		events = append(events, value.(Event))
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].Sequence < events[j].Sequence })
+	return events, nil
+}
+
+func (store *MemoryStore) ListUsers(ctx context.Context, query ListQuery) ([]User, string, error) {
+	values, next, err := store.page("user", query)
+	users := make([]User, len(values))
+	for i, value := range values {
+		users[i] = value.(User)
+	}
+	return users, next, err
+}
+
+func (store *MemoryStore) ListJourneys(ctx context.Context, query ListQuery) ([]Journey, string, error) {
+	values, next, err := store.page("journey", query)
+	journeys := make([]Journey, len(values))
+	for i, value := range values {
+		journeys[i] = value.(Journey)
+	}
+	return journeys, next, err
+}
+
+func (store *MemoryStore) ListTrips(ctx context.Context, query ListQuery) ([]Trip, string, error) {
+	values, next, err := store.page("trip", query)
+	trips := make([]Trip, len(values))
+	for i, value := range values {
+		trips[i] = value.(Trip)
+	}
+	return trips, next, err
+}
+
+func (store *MemoryStore) ListRooms(ctx context.Context, query ListQuery) ([]Room, string, error) {
+	values, next, err := store.page("room", query)
+	rooms := make([]Room, len(values))
+	for i, value := range values {
+		rooms[i] = value.(Room)
+	}
+	return rooms, next, err
+}
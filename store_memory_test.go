@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestMemoryStoreGetPutDelete(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+
+	if _, err := store.GetJourney(ctx, "j1"); err != ErrJourneyMissing {
+		t.Fatalf("GetJourney of a missing journey = %v, want ErrJourneyMissing", err)
+	}
+	journey := Journey{ID: "j1", User: "u1", Name: "Tour", State: JourneyPlanned}
+	if err := store.PutJourney(ctx, journey); err != nil {
+		t.Fatalf("PutJourney: %v", err)
+	}
+	got, err := store.GetJourney(ctx, "j1")
+	if err != nil {
+		t.Fatalf("GetJourney: %v", err)
+	}
+	if !reflect.DeepEqual(got, journey) {
+		t.Errorf("GetJourney = %+v, want %+v", got, journey)
+	}
+	if err := store.DeleteJourney(ctx, "j1"); err != nil {
+		t.Fatalf("DeleteJourney: %v", err)
+	}
+	if err := store.DeleteJourney(ctx, "j1"); err != ErrJourneyMissing {
+		t.Errorf("DeleteJourney of a deleted journey = %v, want ErrJourneyMissing", err)
+	}
+}
+
+func TestMemoryStoreTransactionCommits(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	store.PutTrip(ctx, Trip{ID: "gone", JourneyID: "j1"})
+
+	err := store.RunInTransaction(ctx, func(ctx context.Context) error {
+		store.PutTrip(ctx, Trip{ID: "t1", JourneyID: "j1"})
+		if _, err := store.GetTrip(ctx, "t1"); err != nil {
+			t.Errorf("GetTrip of a trip written in the transaction: %v", err)
+		}
+		if err := store.DeleteTrip(ctx, "gone"); err != nil {
+			t.Errorf("DeleteTrip: %v", err)
+		}
+		if _, err := store.GetTrip(ctx, "gone"); err != ErrTripMissing {
+			t.Errorf("GetTrip of a trip deleted in the transaction = %v, want ErrTripMissing", err)
+		}
+		if _, err := store.GetTrip(context.Background(), "t1"); err != ErrTripMissing {
+			t.Errorf("GetTrip outside the transaction = %v, want ErrTripMissing before commit", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("RunInTransaction: %v", err)
+	}
+	if _, err := store.GetTrip(ctx, "t1"); err != nil {
+		t.Errorf("GetTrip after commit: %v", err)
+	}
+	if _, err := store.GetTrip(ctx, "gone"); err != ErrTripMissing {
+		t.Errorf("GetTrip of a deleted trip after commit = %v, want ErrTripMissing", err)
+	}
+}
+
+func TestMemoryStoreTransactionRollsBack(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	store.PutRoom(ctx, Room{ID: "r1", Name: "Library"})
+	failure := errors.New("failure")
+
+	err := store.RunInTransaction(ctx, func(ctx context.Context) error {
+		store.PutRoom(ctx, Room{ID: "r1", Name: "Gym"})
+		store.PutRoom(ctx, Room{ID: "r2", Name: "Hall"})
+		return failure
+	})
+	if err != failure {
+		t.Fatalf("RunInTransaction = %v, want the error of f", err)
+	}
+	if room, _ := store.GetRoom(ctx, "r1"); room.Name != "Library" {
+		t.Errorf("room r1 is named %q after rollback, want Library", room.Name)
+	}
+	if _, err := store.GetRoom(ctx, "r2"); err != ErrRoomMissing {
+		t.Errorf("GetRoom of a room written in a failed transaction = %v, want ErrRoomMissing", err)
+	}
+}
+
+func TestMemoryStoreNestedTransactionJoins(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	failure := errors.New("failure")
+
+	err := store.RunInTransaction(ctx, func(ctx context.Context) error {
+		if err := store.RunInTransaction(ctx, func(ctx context.Context) error {
+			return store.PutUser(ctx, User{ID: "u1"})
+		}); err != nil {
+			return err
+		}
+		if _, err := store.GetUser(context.Background(), "u1"); err != ErrUserMissing {
+			t.Errorf("nested transaction committed before the outer one")
+		}
+		return failure
+	})
+	if err != failure {
+		t.Fatalf("RunInTransaction = %v, want the error of f", err)
+	}
+	if _, err := store.GetUser(ctx, "u1"); err != ErrUserMissing {
+		t.Errorf("GetUser = %v, want the nested write rolled back with the outer transaction", err)
+	}
+}
+
+func TestMemoryStoreListSkipsStagedWrites(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	store.PutTrip(ctx, Trip{ID: "t1", JourneyID: "j1"})
+
+	store.RunInTransaction(ctx, func(ctx context.Context) error {
+		store.PutTrip(ctx, Trip{ID: "t2", JourneyID: "j1"})
+		trips, _, err := store.ListTrips(ctx, ListQuery{
+			Filters: []ListFilter{{Property: "journey_id", Value: "j1"}},
+			Order:   "created_at",
+			Limit:   maxPageSize,
+		})
+		if err != nil {
+			t.Fatalf("ListTrips: %v", err)
+		}
+		if len(trips) != 1 || trips[0].ID != "t1" {
+			t.Errorf("ListTrips in a transaction = %+v, want only the committed trip t1", trips)
+		}
+		return nil
+	})
+}
+
+func TestMemoryStoreListPages(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	for i, id := range []string{"a", "b", "c", "d", "e"} {
+		user := "u1"
+		if id == "c" {
+			user = "u2"
+		}
+		store.PutJourney(ctx, Journey{ID: id, User: user, CreatedAt: int64(100 - i)})
+	}
+
+	query := ListQuery{
+		Filters: []ListFilter{{Property: "user_id", Value: "u1"}},
+		Order:   "created_at",
+		Limit:   2,
+	}
+	ids := []string{}
+	for page := 0; ; page++ {
+		if page > 3 {
+			t.Fatal("ListJourneys never ran out of pages")
+		}
+		journeys, next, err := store.ListJourneys(ctx, query)
+		if err != nil {
+			t.Fatalf("ListJourneys: %v", err)
+		}
+		for _, journey := range journeys {
+			ids = append(ids, journey.ID)
+		}
+		if next == "" {
+			break
+		}
+		query.Cursor = next
+	}
+	if want := []string{"e", "d", "b", "a"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("ListJourneys pages = %v, want %v", ids, want)
+	}
+
+	if _, _, err := store.ListJourneys(ctx, ListQuery{Order: "created_at", Limit: 2, Cursor: "not a cursor"}); err != ErrInvalidCursor {
+		t.Errorf("ListJourneys with a bad cursor = %v, want ErrInvalidCursor", err)
+	}
+}
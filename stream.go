@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// keepAliveInterval is how often an idle stream is written to so
+	// that proxies and clients do not give up on it.
+	keepAliveInterval = 15 * time.Second
+	// streamWriteTimeout bounds a single write to a WebSocket.
+	streamWriteTimeout = 10 * time.Second
+)
+
+var ErrStreamingUnsupported = &Error{Code: CodeInternal, Message: "streaming is not supported"}
+
+// upgrader accepts WebSockets from the origins listed in the
+// comma-separated STREAM_ORIGINS environment variable, or only from
+// pages served by the API's own host if it is unset.
+var upgrader = websocket.Upgrader{CheckOrigin: checkOrigin(os.Getenv("STREAM_ORIGINS"))}
+
+func checkOrigin(origins string) func(r *http.Request) bool {
+	allowed := map[string]bool{}
+	for _, origin := range strings.Split(origins, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			allowed[strings.ToLower(origin)] = true
+		}
+	}
+	if len(allowed) == 0 {
+		return sameOrigin
+	}
+	return func(r *http.Request) bool {
+		return allowed[strings.ToLower(r.Header.Get("Origin"))]
+	}
+}
+
+// sameOrigin accepts requests whose Origin is on the host they were
+// sent to, and those without one, which do not come from a browser.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// streamSSE writes first and then every update as Server-Sent Events
+// until the client goes away or updates is closed.
+func streamSSE(w http.ResponseWriter, r *http.Request, first Update, updates <-chan Update) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		WriteError(w, ErrStreamingUnsupported)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	write := func(update Update) error {
+		data, err := json.Marshal(update)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", update.Type, data)
+		flusher.Flush()
+		return err
+	}
+	if write(first) != nil {
+		return
+	}
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case update, ok := <-updates:
+			if !ok || write(update) != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// streamWebSocket upgrades the request and sends first and then every
+// update as a JSON text message until either side closes the socket
+// or updates is closed. Messages from the client are ignored.
+func streamWebSocket(w http.ResponseWriter, r *http.Request, first Update, updates <-chan Update) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already answered the request.
+		return
+	}
+	defer conn.Close()
+
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+	write := func(update Update) error {
+		conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+		return conn.WriteJSON(update)
+	}
+	if write(first) != nil {
+		return
+	}
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-closed:
+			return
+		case update, ok := <-updates:
+			if !ok {
+				conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "reconnect"), time.Now().Add(streamWriteTimeout))
+				return
+			}
+			if write(update) != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(streamWriteTimeout)) != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestCheckOrigin(t *testing.T) {
+	tests := []struct {
+		origins, origin string
+		ok              bool
+	}{
+		{"", "", true},
+		{"", "https://api.example.org", true},
+		{"", "https://API.example.org", true},
+		{"", "https://evil.example.com", false},
+		{"", "http://api.example.org:8080", false},
+		{"https://app.example.org, https://admin.example.org", "https://admin.example.org", true},
+		{"https://app.example.org", "https://api.example.org", false},
+		{"https://app.example.org", "", false},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "https://api.example.org/journeys/j1/stream", nil)
+		if test.origin != "" {
+			r.Header.Set("Origin", test.origin)
+		}
+		if ok := checkOrigin(test.origins)(r); ok != test.ok {
+			t.Errorf("checkOrigin(%q) of %q = %v, want %v", test.origins, test.origin, ok, test.ok)
+		}
+	}
+}
+
+func TestStreamSSE(t *testing.T) {
+	updates := make(chan Update, 2)
+	updates <- Update{Type: UpdateTrip, JourneyID: "j1", Data: "t1", Timestamp: 2}
+	close(updates)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/journeys/j1/stream", nil)
+	streamSSE(w, r, Update{Type: UpdateJourney, JourneyID: "j1", Data: "j1", Timestamp: 1}, updates)
+
+	if contentType := w.Header().Get("Content-Type"); contentType != "text/event-stream" {
+		t.Errorf("Content-Type = %q, want text/event-stream", contentType)
+	}
+	want := "event: journey\ndata: {\"type\":\"journey\",\"journey_id\":\"j1\",\"data\":\"j1\",\"timestamp\":1}\n\n" +
+		"event: trip\ndata: {\"type\":\"trip\",\"journey_id\":\"j1\",\"data\":\"t1\",\"timestamp\":2}\n\n"
+	if w.Body.String() != want {
+		t.Errorf("streamed %q, want %q", w.Body.String(), want)
+	}
+}
+
+func TestStreamWebSocket(t *testing.T) {
+	updates := make(chan Update, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		streamWebSocket(w, r, Update{Type: UpdateJourney, JourneyID: "j1", Data: "j1"}, updates)
+	}))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	update := Update{}
+	if err := conn.ReadJSON(&update); err != nil || update.Type != UpdateJourney {
+		t.Fatalf("first message = %+v, %v, want the journey", update, err)
+	}
+	updates <- Update{Type: UpdateTrip, JourneyID: "j1", Data: "t1"}
+	if err := conn.ReadJSON(&update); err != nil || update.Type != UpdateTrip {
+		t.Fatalf("second message = %+v, %v, want the trip", update, err)
+	}
+	close(updates)
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseTryAgainLater) {
+		t.Errorf("after the updates ended: %v, want a close asking to reconnect", err)
+	}
+}
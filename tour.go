@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+)
+
+// maxTourStops caps the rooms of a planned journey, since ordering
+// them plans a route between every pair. A tour has a trip per room,
+// so it stays within maxJourneyTrips.
+const maxTourStops = maxJourneyTrips
+
+// TourRequest asks for a journey visiting every room in Rooms, in
+// whatever order is fastest. The journey starts from Start if given,
+// and otherwise from the room nearest to where the robot last
+// reported being.
+type TourRequest struct {
+	User        string   `json:"user_id"`
+	Name        string   `json:"name"`
+	Start       string   `json:"start"`
+	Rooms       []string `json:"rooms"`
+	AutoAdvance bool     `json:"auto_advance"`
+}
+
+// ResponseTour is a planned journey, its trips in visiting order and
+// the estimated distance and duration of the whole tour.
+type ResponseTour struct {
+	Journey  Journey `json:"journey"`
+	Trips    []Trip  `json:"trips"`
+	Distance float64 `json:"distance"`
+	Duration float64 `json:"duration"`
+}
+
+// Validate reports every field of tour that is missing or out of range.
+func (tour TourRequest) Validate() FieldErrors {
+	errs := FieldErrors{}
+	if tour.User == "" {
+		errs.Add("user_id", "is required")
+	}
+	if len(tour.Rooms) < 1 || len(tour.Rooms) > maxTourStops {
+		errs.Add("rooms", fmt.Sprintf("must list between 1 and %d rooms", maxTourStops))
+	}
+	seen := map[string]bool{tour.Start: tour.Start != ""}
+	for i, room := range tour.Rooms {
+		field := fmt.Sprintf("rooms[%d]", i)
+		switch {
+		case room == "":
+			errs.Add(field, "is required")
+		case room == tour.Start:
+			errs.Add(field, "is the start")
+		case seen[room]:
+			errs.Add(field, "is listed twice")
+		}
+		seen[room] = true
+	}
+	return errs
+}
+
+// PlanJourney creates a journey visiting a set of rooms, with one trip
+// per leg, ordering the rooms to keep the tour short.
+func (manager JourneyManager) PlanJourney(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	encoder := json.NewEncoder(w)
+
+	tour := TourRequest{}
+	if bodyErr := decodeBody(r, &tour); bodyErr != nil {
+		WriteError(w, bodyErr)
+		return
+	}
+	if validErr := tour.Validate().Err(); validErr != nil {
+		WriteError(w, validErr)
+		return
+	}
+	journey := Journey{User: tour.User, Name: tour.Name, AutoAdvance: tour.AutoAdvance}
+	if validErr := manager.validate(ctx, journey); validErr != nil {
+		WriteError(w, validErr)
+		return
+	}
+
+	if resolveErr := manager.resolveTour(ctx, &tour); resolveErr != nil {
+		WriteError(w, resolveErr)
+		return
+	}
+	stops, legs, planErr := manager.orderTour(ctx, tour)
+	if planErr != nil {
+		WriteError(w, planErr)
+		return
+	}
+	response, buildErr := buildTour(journey, stops, legs, time.Now())
+	if buildErr != nil {
+		WriteError(w, buildErr)
+		return
+	}
+	if txErr := manager.transactor.RunInTransaction(ctx, func(ctx context.Context) error {
+		if dataErr := manager.createJourney(ctx, response.Journey); dataErr != nil {
+			return dataErr
+		}
+		// The journey already lists every trip, so it need not be
+		// stored again.
+		for _, trip := range response.Trips {
+			if err := addTrip(ctx, manager.trips, &response.Journey, trip); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); txErr != nil {
+		WriteError(w, txErr)
+		return
+	}
+	created(w, "/journeys/"+response.Journey.ID)
+	encoder.Encode(response)
+}
+
+// resolveTour reports every room of tour that does not exist and
+// fills in its start when omitted, dropping that room from the rooms
+// to visit since the robot is already there.
+func (manager JourneyManager) resolveTour(ctx context.Context, tour *TourRequest) error {
+	errs := FieldErrors{}
+	check := func(field, room string) error {
+		_, dataErr := manager.rooms.GetRoom(ctx, room)
+		if dataErr == ErrRoomMissing {
+			errs.Add(field, ErrRoomMissing.Message)
+			return nil
+		}
+		return dataErr
+	}
+	if tour.Start != "" {
+		if dataErr := check("start", tour.Start); dataErr != nil {
+			return dataErr
+		}
+	}
+	for i, room := range tour.Rooms {
+		if dataErr := check(fmt.Sprintf("rooms[%d]", i), room); dataErr != nil {
+			return dataErr
+		}
+	}
+	if len(errs) > 0 || tour.Start != "" {
+		return errs.Err()
+	}
+
+	pose := manager.robot.pose()
+	if pose == nil {
+		errs.Add("start", "is required until the robot reports its position")
+		return errs.Err()
+	}
+	start, dataErr := nearestRoom(ctx, manager.rooms, *pose)
+	if dataErr != nil {
+		return dataErr
+	}
+	if start == "" {
+		errs.Add("start", "is required when no room is on the robot's floor")
+		return errs.Err()
+	}
+	tour.Start, tour.Rooms = start, without(tour.Rooms, start)
+	if len(tour.Rooms) == 0 {
+		errs.Add("rooms", "only lists the room the robot is at")
+	}
+	return errs.Err()
+}
+
+// nearestRoom returns the ID of the room closest to pose on its floor,
+// or "" if no room is on that floor.
+func nearestRoom(ctx context.Context, rooms RoomStore, pose Pose) (string, error) {
+	all, dataErr := allRooms(ctx, rooms)
+	if dataErr != nil {
+		return "", dataErr
+	}
+	nearest, best := "", math.Inf(1)
+	for _, room := range all {
+		if room.Pose.Floor != pose.Floor {
+			continue
+		}
+		if distance := math.Hypot(float64(room.Pose.X-pose.X), float64(room.Pose.Y-pose.Y)); distance < best {
+			nearest, best = room.ID, distance
+		}
+	}
+	return nearest, nil
+}
+
+// orderTour plans the route from the start of tour and between every
+// pair of its rooms and returns the stops in visiting order, starting
+// with the start, along with the route of each leg.
+func (manager JourneyManager) orderTour(ctx context.Context, tour TourRequest) ([]string, []RoutePlan, error) {
+	nodes := append([]string{tour.Start}, tour.Rooms...)
+	graph, dataErr := manager.maps.graph(ctx)
+	if dataErr != nil {
+		return nil, nil, dataErr
+	}
+	plans := make([][]RoutePlan, len(nodes))
+	costs := make([][]float64, len(nodes))
+	for i := range nodes {
+		plans[i] = make([]RoutePlan, len(nodes))
+		costs[i] = make([]float64, len(nodes))
+	}
+	for i := range nodes {
+		for j := i + 1; j < len(nodes); j++ {
+			plan, planErr := graph.plan(ctx, nodes[i], nodes[j])
+			if planErr != nil {
+				return nil, nil, planErr
+			}
+			plans[i][j], plans[j][i] = plan, reversePlan(plan)
+			costs[i][j], costs[j][i] = plan.Duration, plan.Duration
+		}
+	}
+
+	order := visitOrder(costs)
+	stops := make([]string, len(order))
+	legs := make([]RoutePlan, 0, len(order)-1)
+	for k, i := range order {
+		stops[k] = nodes[i]
+		if k > 0 {
+			legs = append(legs, plans[order[k-1]][i])
+		}
+	}
+	return stops, legs, nil
+}
+
+// buildTour creates journey and a planned trip for each leg between
+// consecutive stops, minting their IDs.
+func buildTour(journey Journey, stops []string, legs []RoutePlan, now time.Time) (ResponseTour, error) {
+	journeyID, err := newULID(now)
+	if err != nil {
+		return ResponseTour{}, err
+	}
+	journey.ID = journeyID
+	journey.State = JourneyPlanned
+	journey.CreatedAt = now.UTC().Unix()
+	response := ResponseTour{Trips: []Trip{}}
+	for i, leg := range legs {
+		tripID, err := newULID(now)
+		if err != nil {
+			return ResponseTour{}, err
+		}
+		response.Trips = append(response.Trips, Trip{
+			ID:        tripID,
+			JourneyID: journey.ID,
+			StartRoom: stops[i],
+			EndRoom:   stops[i+1],
+			State:     TripPlanned,
+			CreatedAt: journey.CreatedAt,
+		})
+		journey.Trips = append(journey.Trips, tripID)
+		response.Distance += leg.Distance
+		response.Duration += leg.Duration
+	}
+	response.Journey = journey
+	return response, nil
+}
+
+// visitOrder finds a short open path from node 0 through every other
+// node given the cost between each pair. It takes the nearest
+// neighbour tour and improves it with 2-opt until no reversal of a
+// stretch helps.
+func visitOrder(costs [][]float64) []int {
+	return twoOpt(nearestNeighbour(costs, 0), costs)
+}
+
+func nearestNeighbour(costs [][]float64, start int) []int {
+	path := []int{start}
+	visited := map[int]bool{start: true}
+	for len(path) < len(costs) {
+		last, next := path[len(path)-1], -1
+		for i := range costs {
+			if !visited[i] && (next < 0 || costs[last][i] < costs[last][next]) {
+				next = i
+			}
+		}
+		path = append(path, next)
+		visited[next] = true
+	}
+	return path
+}
+
+// twoOpt leaves the first node of path in place.
+func twoOpt(path []int, costs [][]float64) []int {
+	for improved := true; improved; {
+		improved = false
+		for i := 1; i < len(path)-1; i++ {
+			for j := i + 1; j < len(path); j++ {
+				candidate := append([]int{}, path...)
+				for a, b := i, j; a < b; a, b = a+1, b-1 {
+					candidate[a], candidate[b] = candidate[b], candidate[a]
+				}
+				if pathCost(candidate, costs) < pathCost(path, costs) {
+					path, improved = candidate, true
+				}
+			}
+		}
+	}
+	return path
+}
+
+func pathCost(path []int, costs [][]float64) float64 {
+	total := 0.0
+	for k := 1; k < len(path); k++ {
+		total += costs[path[k-1]][path[k]]
+	}
+	return total
+}
+
+// reversePlan returns plan travelled the other way.
+func reversePlan(plan RoutePlan) RoutePlan {
+	reversed := RoutePlan{From: plan.To, To: plan.From, Distance: plan.Distance, Duration: plan.Duration}
+	for i := len(plan.Waypoints) - 1; i >= 0; i-- {
+		waypoint := Waypoint{RoomID: plan.Waypoints[i].RoomID, Pose: plan.Waypoints[i].Pose}
+		if i+1 < len(plan.Waypoints) {
+			waypoint.Via, waypoint.ViaKind = plan.Waypoints[i+1].Via, plan.Waypoints[i+1].ViaKind
+		}
+		reversed.Waypoints = append(reversed.Waypoints, waypoint)
+	}
+	return reversed
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// lineCosts is the cost between points at the given positions on a
+// line.
+func lineCosts(positions ...float64) [][]float64 {
+	costs := make([][]float64, len(positions))
+	for i, a := range positions {
+		costs[i] = make([]float64, len(positions))
+		for j, b := range positions {
+			if a > b {
+				costs[i][j] = a - b
+			} else {
+				costs[i][j] = b - a
+			}
+		}
+	}
+	return costs
+}
+
+func TestVisitOrder(t *testing.T) {
+	costs := lineCosts(0, 3, 1, 2, 10)
+	if order, want := visitOrder(costs), []int{0, 2, 3, 1, 4}; !reflect.DeepEqual(order, want) {
+		t.Errorf("visitOrder from 0 = %v, want %v", order, want)
+	}
+
+	// From the middle, the robot has to double back.
+	costs = lineCosts(5, 0, 4, 6, 15)
+	if order := visitOrder(costs); order[0] != 0 || pathCost(order, costs) != 20 {
+		t.Errorf("visitOrder from 0 = %v of cost %v, want a path from 0 of cost 20", order, pathCost(order, costs))
+	}
+
+	if order := visitOrder(lineCosts(0, 1)); !reflect.DeepEqual(order, []int{0, 1}) {
+		t.Errorf("visitOrder of two stops = %v, want [0 1]", order)
+	}
+}
+
+func TestTwoOptUncrosses(t *testing.T) {
+	// Corners of a unit square, visited crosswise.
+	costs := [][]float64{
+		{0, 1, 1.5, 1},
+		{1, 0, 1, 1.5},
+		{1.5, 1, 0, 1},
+		{1, 1.5, 1, 0},
+	}
+	if path := twoOpt([]int{0, 2, 1, 3}, costs); pathCost(path, costs) != 3 || path[0] != 0 {
+		t.Errorf("twoOpt = %v of cost %v, want a path from 0 of cost 3", path, pathCost(path, costs))
+	}
+}
+
+func TestBuildTour(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	legs := []RoutePlan{
+		{From: "a", To: "b", Distance: 10, Duration: 20},
+		{From: "b", To: "c", Distance: 5, Duration: 10},
+	}
+	response, err := buildTour(Journey{User: "u1", Name: "Tour"}, []string{"a", "b", "c"}, legs, now)
+	if err != nil {
+		t.Fatalf("buildTour: %v", err)
+	}
+	journey := response.Journey
+	if journey.ID == "" || journey.State != JourneyPlanned || journey.CreatedAt != now.Unix() {
+		t.Errorf("journey = %+v, want a planned journey with an ID", journey)
+	}
+	if len(response.Trips) != 2 {
+		t.Fatalf("buildTour made %d trips, want 2", len(response.Trips))
+	}
+	for i, trip := range response.Trips {
+		if trip.StartRoom != legs[i].From || trip.EndRoom != legs[i].To || trip.JourneyID != journey.ID || trip.State != TripPlanned {
+			t.Errorf("trip %d = %+v, want a planned trip of the journey from %s to %s", i, trip, legs[i].From, legs[i].To)
+		}
+		if journey.Trips[i] != trip.ID {
+			t.Errorf("journey lists trip %s at %d, want %s", journey.Trips[i], i, trip.ID)
+		}
+	}
+	if response.Distance != 15 || response.Duration != 30 {
+		t.Errorf("tour distance %v and duration %v, want 15 and 30", response.Distance, response.Duration)
+	}
+}
+
+func TestTourValidate(t *testing.T) {
+	tests := []struct {
+		tour   TourRequest
+		fields []string
+	}{
+		{TourRequest{User: "u1", Rooms: []string{"a"}}, []string{}},
+		{TourRequest{User: "u1", Start: "a", Rooms: []string{"b", "c"}}, []string{}},
+		{TourRequest{Rooms: []string{"a"}}, []string{"user_id"}},
+		{TourRequest{User: "u1"}, []string{"rooms"}},
+		{TourRequest{User: "u1", Start: "a", Rooms: []string{"a", "b", "b", ""}}, []string{"rooms[0]", "rooms[2]", "rooms[3]"}},
+	}
+	for _, test := range tests {
+		fields := []string{}
+		for _, err := range test.tour.Validate() {
+			fields = append(fields, err.Field)
+		}
+		if !reflect.DeepEqual(fields, test.fields) {
+			t.Errorf("Validate(%+v) rejects %v, want %v", test.tour, fields, test.fields)
+		}
+	}
+}
+
+func TestPlanJourney(t *testing.T) {
+	ctx := context.Background()
+	store, maps := testMap()
+	store.PutUser(ctx, User{ID: "u1"})
+	robot := &robotStatus{}
+	manager := JourneyManager{
+		transactor: store,
+		journeys:   store,
+		users:      store,
+		trips:      store,
+		rooms:      store,
+		maps:       maps,
+		robot:      robot,
+	}
+	plan := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		manager.PlanJourney(w, httptest.NewRequest(http.MethodPost, "/journeys/plan", strings.NewReader(body)))
+		return w
+	}
+
+	w := plan(`{"user_id": "u1", "rooms": ["b", "c"]}`)
+	if fields := fieldErrors(t, w); !reflect.DeepEqual(fields, []string{"start"}) {
+		t.Errorf("planning before the robot reports its position rejects %v, want [start]", fields)
+	}
+	w = plan(`{"user_id": "u1", "start": "a", "rooms": ["b", "nowhere"]}`)
+	if fields := fieldErrors(t, w); !reflect.DeepEqual(fields, []string{"rooms[1]"}) {
+		t.Errorf("planning through a missing room rejects %v, want [rooms[1]]", fields)
+	}
+
+	robot.update(func(status *RobotStatus) { status.Pose = &Pose{Floor: 0, X: 10, Y: 0} })
+	w = plan(`{"user_id": "u1", "rooms": ["e", "c", "b"]}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("PlanJourney answered %d: %s", w.Code, w.Body)
+	}
+	response := ResponseTour{}
+	json.NewDecoder(w.Body).Decode(&response)
+	stops := []string{}
+	for _, trip := range response.Trips {
+		stops = append(stops, trip.StartRoom+">"+trip.EndRoom)
+	}
+	if want := []string{"a>b", "b>c", "c>e"}; !reflect.DeepEqual(stops, want) {
+		t.Errorf("tour from the robot's position = %v, want %v", stops, want)
+	}
+
+	journey, err := store.GetJourney(ctx, response.Journey.ID)
+	if err != nil {
+		t.Fatalf("GetJourney: %v", err)
+	}
+	if !reflect.DeepEqual(journey.Trips, response.Journey.Trips) || len(journey.Trips) != 3 {
+		t.Errorf("stored journey lists %v, want %v", journey.Trips, response.Journey.Trips)
+	}
+	for _, id := range journey.Trips {
+		if _, err := store.GetTrip(ctx, id); err != nil {
+			t.Errorf("GetTrip(%s): %v", id, err)
+		}
+	}
+	if user, _ := store.GetUser(ctx, "u1"); !reflect.DeepEqual(user.Journeys, []string{journey.ID}) {
+		t.Errorf("user lists %v, want the planned journey", user.Journeys)
+	}
+
+	w = plan(`{"user_id": "u1", "rooms": ["a"]}`)
+	if fields := fieldErrors(t, w); !reflect.DeepEqual(fields, []string{"rooms"}) {
+		t.Errorf("planning a tour of the robot's room rejects %v, want [rooms]", fields)
+	}
+}
+
+// fieldErrors returns the fields an invalid request response rejects.
+func fieldErrors(t *testing.T, w *httptest.ResponseRecorder) []string {
+	t.Helper()
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("answered %d, want %d: %s", w.Code, http.StatusBadRequest, w.Body)
+	}
+	response := struct {
+		Error struct {
+			Details FieldErrors `json:"details"`
+		} `json:"error"`
+	}{}
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatalf("decoding the error: %v", err)
+	}
+	fields := []string{}
+	for _, err := range response.Error.Details {
+		fields = append(fields, err.Field)
+	}
+	return fields
+}
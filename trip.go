@@ -1,58 +1,142 @@
 package main
 
 import (
-	"reflect"
+	"context"
 	"net/http"
 	"github.com/gorilla/mux"
 	"encoding/json"
-	"appengine"
-	"appengine/datastore"
-	"errors"
 	"time"
+
+	"github.com/ros-nueva/backend/protocol"
 )
 
 var (
-	ErrTripAlreadyExists = errors.New("trip already exists")
-	ErrTripMissing = errors.New("trip does not exist")
+	ErrTripOngoing = &Error{Code: CodeConflict, Entity: "trip", Message: "another trip of the journey is in progress"}
+	ErrTripInProgress = &Error{Code: CodeConflict, Entity: "trip", Message: "trip is in progress"}
+	ErrTripAlreadyExists = &Error{Code: CodeConflict, Entity: "trip", Message: "trip already exists"}
+	ErrTripMissing = &Error{Code: CodeNotFound, Entity: "trip", Message: "trip does not exist"}
 )
 
 type TripManager struct {
-	manager *PubnubManager
+	outbox Outbox
+	transactor Transactor
+	trips TripStore
+	journeys JourneyStore
+	rooms RoomStore
 }
 
 type Trip struct {
 	ID string `datastore:"id" json:"id"`
 	JourneyID string `datastore:"journey_id" json:"journey_id"`
 	Description string `datastore:"description" json:"description"`
-	StartRoom string `datastore:"start_room" json:"start`
+	StartRoom string `datastore:"start_room" json:"start"`
 	EndRoom string `datastore:"end_room" json:"end"`
 	Success bool `datastore:"success" json:"success"`
 	LeftAt int64 `datastore:"left_at"`
 	ArrivedAt int64 `datastore:"arrived_at"`
+	State TripState `datastore:"state" json:"state"`
+	CreatedAt int64 `datastore:"created_at" json:"created_at"`
 }
 
+// TripPatchFields lists the fields of a Trip clients may change.
+// Everything else is maintained by the trip's lifecycle.
+var TripPatchFields = []string{"description", "start", "end"}
+
+// TripCreateFields lists the fields clients may set when creating a
+// Trip.
+var TripCreateFields = append([]string{"journey_id"}, TripPatchFields...)
+
 func (manager TripManager) Group() Group {
+	owner := Filters{AnyOf(IsAdmin, OwnsTrip(manager.trips, manager.journeys, "tripid"))}
+	creator := Filters{AnyOf(IsAdmin, OwnsJourneyInBody(manager.journeys, "journey_id"))}
+	robot := Filters{IsRobot}
+	return Group{
+		Paths: Routes{
+			"": Methods{
+				http.MethodGet: Route{
+					Handler: manager.ListTrips,
+					Allow: Filters{AnyOf(IsAdmin, OwnsJourneyInQuery(manager.journeys, "journey_id"))},
+				},
+				http.MethodPost: Route{
+					Handler: manager.CreateTrip,
+					Allow: creator,
+				},
+			},
+			"{tripid}": Methods{
+				http.MethodGet: Route{
+					Handler: manager.GetTrip,
+					Allow: owner,
+				},
+				http.MethodPut: Route{
+					Handler: manager.ReplaceTrip,
+					Allow: creator,
+				},
+				http.MethodPatch: Route{
+					Handler: manager.SetTrip,
+					Allow: owner,
+				},
+				http.MethodDelete: Route{
+					Handler: manager.DelTrip,
+					Allow: owner,
+				},
+			},
+			"{tripid}/start": Route{
+				Methods: []string{http.MethodPost},
+				Handler: manager.StartTrip,
+				Allow: owner,
+			},
+			"{tripid}/complete": Route{
+				Methods: []string{http.MethodPost},
+				Handler: manager.CompleteTrip,
+				Allow: robot,
+			},
+			"{tripid}/fail": Route{
+				Methods: []string{http.MethodPost},
+				Handler: manager.FailTrip,
+				Allow: robot,
+			},
+			"{tripid}/cancel": Route{
+				Methods: []string{http.MethodPost},
+				Handler: manager.CancelTrip,
+				Allow: owner,
+			},
+		},
+	}
+}
+
+// LegacyGroup serves the action-suffixed paths used by the existing
+// robot and app clients. Each of them answers to any method.
+func (manager TripManager) LegacyGroup() Group {
+	owner := Filters{AnyOf(IsAdmin, OwnsTrip(manager.trips, manager.journeys, "tripid"))}
+	creator := Filters{AnyOf(IsAdmin, OwnsJourneyInBody(manager.journeys, "journey_id"))}
+	robot := Filters{IsRobot}
 	return Group{
 		Paths: Routes{
 			"{tripid}/": Group{
 				Paths: Routes{
 					"get": Route{
 						Handler: manager.GetTrip,
+						Allow: owner,
 					},
 					"create": Route{
 						Handler: manager.CreateTrip,
+						Allow: creator,
 					},
-					"delete": Route{
+					"del": Route{
 						Handler: manager.DelTrip,
+						Allow: owner,
 					},
 					"set": Route{
 						Handler: manager.SetTrip,
+						Allow: owner,
 					},
 					"start": Route{
 						Handler: manager.StartTrip,
+						Allow: owner,
 					},
 					"complete": Route{
 						Handler: manager.CompleteTrip,
+						Allow: robot,
 					},
 				},
 			},
@@ -60,176 +144,535 @@ func (manager TripManager) Group() Group {
 	}
 }
 
+// tripListParams filter trips by journey or by room. Only one of them
+// may be given at a time.
+var tripListParams = []listParam{
+	stringParam("journey_id", "journey_id"),
+	stringParam("start", "start_room"),
+	stringParam("end", "end_room"),
+}
+
+// ListTrips serves a page of trips. Users may only list the trips of
+// their own journeys, by passing its ID as journey_id.
+func (manager TripManager) ListTrips(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	encoder := json.NewEncoder(w)
+
+	query, queryErr := parseListQuery(r, tripListParams)
+	if queryErr != nil {
+		WriteError(w, queryErr)
+		return
+	}
+	if len(query.Filters) > 1 {
+		errs := FieldErrors{}
+		given := false
+		for _, param := range tripListParams {
+			if r.URL.Query().Get(param.name) == "" {
+				continue
+			}
+			if given {
+				errs.Add(param.name, "cannot be combined with other filters")
+			}
+			given = true
+		}
+		WriteError(w, errs.Err())
+		return
+	}
+	trips, next, dataErr := manager.trips.ListTrips(ctx, query)
+	if dataErr != nil {
+		WriteError(w, dataErr)
+		return
+	}
+	encoder.Encode(ResponsePage{Items: trips, NextCursor: next})
+}
+
 func (manager TripManager) CreateTrip(w http.ResponseWriter, r *http.Request) {
-	ctx := appengine.NewContext(r)
-	tripID := mux.Vars(r)["tripid"]
+	ctx := r.Context()
 	encoder := json.NewEncoder(w)
-	decoder := json.NewDecoder(r.Body)
+
+	tripID, idErr := entityID(r, "tripid")
+	if idErr != nil {
+		WriteError(w, idErr)
+		return
+	}
 
 	trip := Trip{}
-	key := datastore.NewKey(ctx, "trip", tripID, 0, nil)
-	dataErr := datastore.Get(ctx, key, &trip)
-	if dataErr == nil {
-		encoder.Encode(ResponseError{Error: ErrTripAlreadyExists.Error()})
+	if bodyErr := readFields(r, &trip, TripCreateFields); bodyErr != nil {
+		WriteError(w, bodyErr)
 		return
-	} else if dataErr != datastore.ErrNoSuchEntity {
-		encoder.Encode(ResponseError{Error: dataErr.Error()})
+	}
+	if validErr := manager.validate(ctx, trip); validErr != nil {
+		WriteError(w, validErr)
 		return
 	}
-	decoder.Decode(&trip)
-	journey := &Journey{}
-	journeyKey := datastore.NewKey(ctx, "journey", trip.JourneyID, 0, nil)
-	journeyDataErr := datastore.Get(ctx, journeyKey, journey)
-	if journeyDataErr != nil {
-		if journeyDataErr != datastore.ErrNoSuchEntity {
-			encoder.Encode(ResponseError{Error: journeyDataErr.Error()})
-			return
+	trip.ID = tripID
+	trip.State = TripPlanned
+	trip.CreatedAt = time.Now().UTC().Unix()
+	if txErr := manager.transactor.RunInTransaction(ctx, func(ctx context.Context) error {
+		return manager.createTrip(ctx, trip)
+	}); txErr != nil {
+		WriteError(w, txErr)
+		return
+	}
+	created(w, "/trips/"+trip.ID)
+	encoder.Encode(trip)
+}
+
+// ReplaceTrip creates the trip with the ID in the path or, if there is
+// one, replaces every field clients may set, so that sending the same
+// body again changes nothing. A trip cannot move to another journey.
+func (manager TripManager) ReplaceTrip(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	tripID := mux.Vars(r)["tripid"]
+	encoder := json.NewEncoder(w)
+
+	patch, bodyErr := readReplacement(r, TripCreateFields)
+	if bodyErr != nil {
+		WriteError(w, bodyErr)
+		return
+	}
+	trip := Trip{}
+	isNew := false
+	if txErr := manager.transactor.RunInTransaction(ctx, func(ctx context.Context) error {
+		var dataErr error
+		trip, dataErr = manager.trips.GetTrip(ctx, tripID)
+		isNew = dataErr == ErrTripMissing
+		if isNew {
+			trip = Trip{ID: tripID, State: TripPlanned, CreatedAt: time.Now().UTC().Unix()}
+		} else if dataErr != nil {
+			return withID(dataErr, tripID)
+		} else if fixedErr := checkFixed(&trip, patch, "journey_id"); fixedErr != nil {
+			return fixedErr
+		}
+		if patchErr := applyPatch(&trip, patch); patchErr != nil {
+			return patchErr
 		}
-		encoder.Encode(ResponseError{Error: ErrJourneyMissing.Error()})
+		if validErr := manager.validate(ctx, trip); validErr != nil {
+			return validErr
+		}
+		if isNew {
+			return manager.createTrip(ctx, trip)
+		}
+		return manager.trips.PutTrip(ctx, trip)
+	}); txErr != nil {
+		WriteError(w, txErr)
 		return
 	}
-	trip.ID = tripID
-	journey.Trips = append(journey.Trips, trip.ID)
-	datastore.Put(ctx, key, trip)
-	datastore.Put(ctx, journeyKey, journey)
+	if isNew {
+		created(w, "/trips/"+trip.ID)
+	}
 	encoder.Encode(trip)
 }
 
+// createTrip stores trip and appends it to its journey.
+func (manager TripManager) createTrip(ctx context.Context, trip Trip) error {
+	journey, journeyDataErr := manager.journeys.GetJourney(ctx, trip.JourneyID)
+	if journeyDataErr != nil {
+		return withID(journeyDataErr, trip.JourneyID)
+	}
+	if err := addTrip(ctx, manager.trips, &journey, trip); err != nil {
+		return err
+	}
+	return manager.journeys.PutJourney(ctx, journey)
+}
+
+// addTrip stores trip and lists it on journey unless it already is,
+// leaving the caller to store journey. It refuses trips whose ID is
+// taken or whose journey has ended or is full.
+func addTrip(ctx context.Context, trips TripStore, journey *Journey, trip Trip) error {
+	_, dataErr := trips.GetTrip(ctx, trip.ID)
+	if dataErr == nil {
+		return withID(ErrTripAlreadyExists, trip.ID)
+	} else if dataErr != ErrTripMissing {
+		return dataErr
+	}
+	if state := journey.CurrentState(); state != JourneyPlanned && state != JourneyActive {
+		return withID(ErrJourneyEnded, journey.ID)
+	}
+	if !contains(journey.Trips, trip.ID) {
+		if len(journey.Trips) >= maxJourneyTrips {
+			return withID(ErrJourneyFull, journey.ID)
+		}
+		journey.Trips = append(journey.Trips, trip.ID)
+	}
+	return trips.PutTrip(ctx, trip)
+}
+
 func (manager TripManager) GetTrip(w http.ResponseWriter, r *http.Request) {
-	ctx := appengine.NewContext(r)
+	ctx := r.Context()
 	tripID := mux.Vars(r)["tripid"]
 	encoder := json.NewEncoder(w)
 
-	trip := Trip{}
-	key := datastore.NewKey(ctx, "trip", tripID, 0, nil)
-	dataErr := datastore.Get(ctx, key, &trip)
+	trip, dataErr := manager.trips.GetTrip(ctx, tripID)
 	if dataErr != nil {
-		if dataErr != datastore.ErrNoSuchEntity {
-			encoder.Encode(ResponseError{Error: dataErr.Error()})
-			return
-		}
-		encoder.Encode(ResponseError{Error: ErrTripMissing.Error()})
+		WriteError(w, withID(dataErr, tripID))
 		return
 	}
 	encoder.Encode(trip)
 }
 
 func (manager TripManager) DelTrip(w http.ResponseWriter, r *http.Request) {
-	ctx := appengine.NewContext(r)
+	ctx := r.Context()
 	tripID := mux.Vars(r)["tripid"]
 	encoder := json.NewEncoder(w)
 
-	key := datastore.NewKey(ctx, "trip", tripID, 0, nil)
-	dataErr := datastore.Delete(ctx, key)
-	if dataErr != nil {
-		if dataErr != datastore.ErrInvalidKey {
-			encoder.Encode(ResponseError{Error: dataErr.Error()})
-			return
-		}
-		encoder.Encode(ResponseError{Error: ErrTripMissing.Error()})
+	if _, txErr := manager.transact(ctx, tripID, manager.deleteTrip); txErr != nil {
+		WriteError(w, txErr)
 		return
 	}
 	encoder.Encode(ResponseSuccess{Success: true})
 }
 
+// deleteTrip removes the trip and unlists it from its journey. A trip
+// in progress has to be cancelled first, so the robot is stopped.
+func (manager TripManager) deleteTrip(ctx context.Context, tripID string) (Trip, error) {
+	trip, dataErr := manager.trips.GetTrip(ctx, tripID)
+	if dataErr != nil {
+		return trip, withID(dataErr, tripID)
+	}
+	if trip.CurrentState() == TripInProgress {
+		return trip, withID(ErrTripInProgress, tripID)
+	}
+	journey, journeyDataErr := manager.journeys.GetJourney(ctx, trip.JourneyID)
+	if journeyDataErr == nil {
+		journey.Trips = without(journey.Trips, tripID)
+		if journey.LatestTrip == tripID {
+			journey.LatestTrip = ""
+		}
+		if dataErr := manager.journeys.PutJourney(ctx, journey); dataErr != nil {
+			return trip, dataErr
+		}
+	} else if journeyDataErr != ErrJourneyMissing {
+		return trip, journeyDataErr
+	}
+	return trip, manager.trips.DeleteTrip(ctx, tripID)
+}
+
 func (manager TripManager) SetTrip(w http.ResponseWriter, r *http.Request) {
-	ctx := appengine.NewContext(r)
+	ctx := r.Context()
 	tripID := mux.Vars(r)["tripid"]
 	encoder := json.NewEncoder(w)
-	decoder := json.NewDecoder(r.Body)
 
-	trip := &Trip{}
-	key := datastore.NewKey(ctx, "trip", tripID, 0, nil)
-	dataErr := datastore.Get(ctx, key, trip)
-	if dataErr != nil {
-		if dataErr != datastore.ErrNoSuchEntity {
-			encoder.Encode(ResponseError{Error: dataErr.Error()})
-			return
+	patch, bodyErr := readPatch(r, TripPatchFields)
+	if bodyErr != nil {
+		WriteError(w, bodyErr)
+		return
+	}
+	trip := Trip{}
+	if txErr := manager.transactor.RunInTransaction(ctx, func(ctx context.Context) error {
+		var dataErr error
+		if trip, dataErr = manager.trips.GetTrip(ctx, tripID); dataErr != nil {
+			return withID(dataErr, tripID)
+		}
+		if patchErr := applyPatch(&trip, patch); patchErr != nil {
+			return patchErr
 		}
-		encoder.Encode(ResponseError{Error: ErrTripMissing.Error()})
+		if validErr := manager.validate(ctx, trip); validErr != nil {
+			return validErr
+		}
+		return manager.trips.PutTrip(ctx, trip)
+	}); txErr != nil {
+		WriteError(w, txErr)
 		return
 	}
-	updatedTrip := Trip{}
-	decoder.Decode(updatedTrip)
-	trip.MergeInPlace(updatedTrip)
-	datastore.Put(ctx, key, trip)
-	encoder.Encode(*trip)
+	encoder.Encode(trip)
 }
 
 func (manager TripManager) StartTrip(w http.ResponseWriter, r *http.Request) {
-	ctx := appengine.NewContext(r)
-	tripID := mux.Vars(r)["tripid"]
-	encoder := json.NewEncoder(w)
+	if trip, ok := manager.runTransition(w, r, manager.startTrip); ok {
+		manager.outbox.flush(r.Context())
+		json.NewEncoder(w).Encode(trip)
+	}
+}
 
-	trip := &Trip{}
-	key := datastore.NewKey(ctx, "trip", tripID, 0, nil)
-	dataErr := datastore.Get(ctx, key, trip)
+// startTrip sets off on the trip, sending the robot to its end room,
+// and makes it the latest trip of its journey. The journey must be
+// active and no other trip of it in progress.
+func (manager TripManager) startTrip(ctx context.Context, tripID string) (Trip, error) {
+	trip, dataErr := manager.trips.GetTrip(ctx, tripID)
 	if dataErr != nil {
-		if dataErr != datastore.ErrNoSuchEntity {
-			encoder.Encode(ResponseError{Error: dataErr.Error()})
-			return
-		}
-		encoder.Encode(ResponseError{Error: ErrTripMissing.Error()})
-		return
+		return trip, withID(dataErr, tripID)
 	}
-	journey := &Journey{}
-	journeyKey := datastore.NewKey(ctx, "journey", trip.JourneyID, 0, nil)
-	journeyDataErr := datastore.Get(ctx, journeyKey, journey)
+	journey, journeyDataErr := manager.journeys.GetJourney(ctx, trip.JourneyID)
 	if journeyDataErr != nil {
-		if journeyDataErr != datastore.ErrNoSuchEntity {
-			encoder.Encode(ResponseError{Error: journeyDataErr.Error()})
-			return
+		return trip, withID(journeyDataErr, trip.JourneyID)
+	}
+	if journey.CurrentState() != JourneyActive {
+		return trip, withID(ErrJourneyNotActive, journey.ID)
+	}
+	if journey.LatestTrip != "" && journey.LatestTrip != trip.ID {
+		latest, latestDataErr := manager.trips.GetTrip(ctx, journey.LatestTrip)
+		if latestDataErr != nil && latestDataErr != ErrTripMissing {
+			return trip, latestDataErr
 		}
-		encoder.Encode(ResponseError{Error: ErrJourneyMissing.Error()})
-		return
+		if latestDataErr == nil && latest.CurrentState() == TripInProgress {
+			return trip, withID(ErrTripOngoing, latest.ID)
+		}
+	}
+	if transErr := trip.Transition(TripInProgress); transErr != nil {
+		return trip, transErr
 	}
 	journey.LatestTrip = trip.ID
 	trip.LeftAt = time.Now().UTC().Unix()
-	datastore.Put(ctx, key, *trip)
-	datastore.Put(ctx, journeyKey, *journey)
-	encoder.Encode(*trip)
+	if dataErr := manager.trips.PutTrip(ctx, trip); dataErr != nil {
+		return trip, dataErr
+	}
+	if sendErr := sendRobot(ctx, manager.outbox, manager.rooms, trip); sendErr != nil {
+		return trip, sendErr
+	}
+	return trip, manager.journeys.PutJourney(ctx, journey)
 }
 
 func (manager TripManager) CompleteTrip(w http.ResponseWriter, r *http.Request) {
-	ctx := appengine.NewContext(r)
 	tripID := mux.Vars(r)["tripid"]
-	encoder := json.NewEncoder(w)
+	trip, arriveErr := manager.arrive(r.Context(), tripID)
+	if arriveErr != nil {
+		WriteError(w, arriveErr)
+		return
+	}
+	json.NewEncoder(w).Encode(trip)
+}
+
+// arrive completes the trip and delivers the command sending the
+// robot on to the next trip, if that was started.
+func (manager TripManager) arrive(ctx context.Context, tripID string) (Trip, error) {
+	trip, txErr := manager.transact(ctx, tripID, manager.completeTrip)
+	if txErr != nil {
+		return trip, txErr
+	}
+	manager.outbox.flush(ctx)
+	return trip, nil
+}
 
-	trip := &Trip{}
-	key := datastore.NewKey(ctx, "trip", tripID, 0, nil)
-	dataErr := datastore.Get(ctx, key, trip)
+// completeTrip marks the trip as arrived and moves its journey on to
+// the next trip that has not ended, starting it if the journey
+// advances automatically. Without a next trip the journey is
+// completed.
+func (manager TripManager) completeTrip(ctx context.Context, tripID string) (Trip, error) {
+	trip, dataErr := manager.trips.GetTrip(ctx, tripID)
 	if dataErr != nil {
-		if dataErr != datastore.ErrNoSuchEntity {
-			encoder.Encode(ResponseError{Error: dataErr.Error()})
-			return
-		}
-		encoder.Encode(ResponseError{Error: ErrTripMissing.Error()})
-		return
+		return trip, withID(dataErr, tripID)
 	}
-	journey := &Journey{}
-	journeyKey := datastore.NewKey(ctx, "journey", trip.JourneyID, 0, nil)
-	journeyDataErr := datastore.Get(ctx, journeyKey, journey)
+	journey, journeyDataErr := manager.journeys.GetJourney(ctx, trip.JourneyID)
 	if journeyDataErr != nil {
-		if journeyDataErr != datastore.ErrNoSuchEntity {
-			encoder.Encode(ResponseError{Error: journeyDataErr.Error()})
-			return
-		}
-		encoder.Encode(ResponseError{Error: ErrJourneyMissing.Error()})
-		return
+		return trip, withID(journeyDataErr, trip.JourneyID)
 	}
-	if trip.ID == journey.Trips[len(journey.Trips) - 1] {
-		journey.Finished = true
+	if transErr := trip.Transition(TripArrived); transErr != nil {
+		return trip, transErr
 	}
-	trip.ArrivedAt = time.Now().UTC().Unix()
+	now := time.Now().UTC().Unix()
+	trip.ArrivedAt = now
 	trip.Success = true
-	datastore.Put(ctx, key, *trip)
-	encoder.Encode(*trip)
+	if dataErr := manager.trips.PutTrip(ctx, trip); dataErr != nil {
+		return trip, dataErr
+	}
+
+	next, nextErr := manager.nextTrip(ctx, journey, trip.ID)
+	if nextErr != nil {
+		return trip, nextErr
+	}
+	if next == nil {
+		if transErr := journey.Transition(JourneyCompleted); transErr != nil {
+			return trip, transErr
+		}
+		journey.Finished = true
+		journey.FinishedAt = now
+	} else {
+		journey.LatestTrip = next.ID
+		if journey.AutoAdvance && journey.CurrentState() == JourneyActive {
+			if transErr := next.Transition(TripInProgress); transErr != nil {
+				return trip, transErr
+			}
+			next.LeftAt = now
+			if dataErr := manager.trips.PutTrip(ctx, *next); dataErr != nil {
+				return trip, dataErr
+			}
+			if sendErr := sendRobot(ctx, manager.outbox, manager.rooms, *next); sendErr != nil {
+				return trip, sendErr
+			}
+		}
+	}
+	return trip, manager.journeys.PutJourney(ctx, journey)
 }
 
-func (old *Trip) MergeInPlace(new Trip) {
-	for ii := 0; ii < reflect.TypeOf(old).Elem().NumField(); ii++ {
-		if x := reflect.ValueOf(&new).Elem().Field(ii); !x.IsNil() {
-			reflect.ValueOf(old).Elem().Field(ii).Set(x)
+// nextTrip finds the first trip after tripID in journey that has not
+// ended yet, or nil if there is none.
+func (manager TripManager) nextTrip(ctx context.Context, journey Journey, tripID string) (*Trip, error) {
+	after := false
+	for _, id := range journey.Trips {
+		if !after {
+			after = id == tripID
+			continue
+		}
+		next, dataErr := manager.trips.GetTrip(ctx, id)
+		if dataErr != nil {
+			return nil, withID(dataErr, id)
+		}
+		if next.JourneyID == journey.ID && !next.Final() {
+			return &next, nil
 		}
 	}
-}
\ No newline at end of file
+	return nil, nil
+}
+
+// sendRobot queues the command sending the robot to the destination
+// of trip.
+func sendRobot(ctx context.Context, outbox Outbox, rooms RoomStore, trip Trip) error {
+	room, dataErr := rooms.GetRoom(ctx, trip.EndRoom)
+	if dataErr != nil {
+		return withID(dataErr, trip.EndRoom)
+	}
+	_, err := outbox.Enqueue(ctx, trip.JourneyID, trip.ID, protocol.CommandStartTrip, protocol.StartTrip{
+		JourneyID: trip.JourneyID,
+		TripID: trip.ID,
+		RoomID: room.ID,
+		Target: protocol.Pose(room.Pose),
+	})
+	return err
+}
+
+// stopRobot queues the command cancelling trip.
+func stopRobot(ctx context.Context, outbox Outbox, trip Trip) error {
+	_, err := outbox.Enqueue(ctx, trip.JourneyID, trip.ID, protocol.CommandCancel, protocol.Cancel{TripID: trip.ID})
+	return err
+}
+
+func (manager TripManager) FailTrip(w http.ResponseWriter, r *http.Request) {
+	if trip, ok := manager.runTransition(w, r, manager.failTrip); ok {
+		json.NewEncoder(w).Encode(trip)
+	}
+}
+
+// failTrip records that the trip could not reach its destination and
+// aborts its journey.
+func (manager TripManager) failTrip(ctx context.Context, tripID string) (Trip, error) {
+	return abandonTrip(ctx, manager.outbox, manager.trips, manager.journeys, tripID)
+}
+
+// abandonTrip fails the trip in progress with the given ID and aborts
+// its journey, cancelling the trips left, since the robot gave up on
+// the way.
+func abandonTrip(ctx context.Context, outbox Outbox, trips TripStore, journeys JourneyStore, tripID string) (Trip, error) {
+	trip, dataErr := trips.GetTrip(ctx, tripID)
+	if dataErr != nil {
+		return trip, withID(dataErr, tripID)
+	}
+	if transErr := trip.Transition(TripFailed); transErr != nil {
+		return trip, transErr
+	}
+	if dataErr := trips.PutTrip(ctx, trip); dataErr != nil {
+		return trip, dataErr
+	}
+	journey, journeyDataErr := journeys.GetJourney(ctx, trip.JourneyID)
+	if journeyDataErr == ErrJourneyMissing {
+		return trip, nil
+	} else if journeyDataErr != nil {
+		return trip, journeyDataErr
+	}
+	if journey.CurrentState() != JourneyActive {
+		return trip, nil
+	}
+	if transErr := journey.Transition(JourneyAborted); transErr != nil {
+		return trip, transErr
+	}
+	if cancelErr := cancelTrips(ctx, outbox, trips, journey, trip.ID); cancelErr != nil {
+		return trip, cancelErr
+	}
+	journey.Finished = true
+	journey.FinishedAt = time.Now().UTC().Unix()
+	return trip, journeys.PutJourney(ctx, journey)
+}
+
+func (manager TripManager) CancelTrip(w http.ResponseWriter, r *http.Request) {
+	if trip, ok := manager.runTransition(w, r, manager.cancelTrip); ok {
+		manager.outbox.flush(r.Context())
+		json.NewEncoder(w).Encode(trip)
+	}
+}
+
+// cancelTrip calls off a trip that has not ended yet, stopping the
+// robot if it is under way.
+func (manager TripManager) cancelTrip(ctx context.Context, tripID string) (Trip, error) {
+	trip, dataErr := manager.trips.GetTrip(ctx, tripID)
+	interrupted := dataErr == nil && trip.CurrentState() == TripInProgress
+	trip, endErr := manager.endTrip(ctx, tripID, TripCancelled)
+	if endErr != nil || !interrupted {
+		return trip, endErr
+	}
+	return trip, stopRobot(ctx, manager.outbox, trip)
+}
+
+// endTrip moves the trip into a final state other than arrived.
+func (manager TripManager) endTrip(ctx context.Context, tripID string, state TripState) (Trip, error) {
+	trip, dataErr := manager.trips.GetTrip(ctx, tripID)
+	if dataErr != nil {
+		return trip, withID(dataErr, tripID)
+	}
+	if transErr := trip.Transition(state); transErr != nil {
+		return trip, transErr
+	}
+	return trip, manager.trips.PutTrip(ctx, trip)
+}
+
+// runTransition runs f on the trip named in r in a transaction,
+// writing the error if it fails.
+func (manager TripManager) runTransition(w http.ResponseWriter, r *http.Request, f func(ctx context.Context, tripID string) (Trip, error)) (Trip, bool) {
+	trip, txErr := manager.transact(r.Context(), mux.Vars(r)["tripid"], f)
+	if txErr != nil {
+		WriteError(w, txErr)
+		return trip, false
+	}
+	return trip, true
+}
+
+// transact runs f on the trip with the given ID in a transaction.
+func (manager TripManager) transact(ctx context.Context, tripID string, f func(ctx context.Context, tripID string) (Trip, error)) (Trip, error) {
+	trip := Trip{}
+	txErr := manager.transactor.RunInTransaction(ctx, func(ctx context.Context) error {
+		var err error
+		trip, err = f(ctx, tripID)
+		return err
+	})
+	return trip, txErr
+}
+
+// Validate reports every field of trip that is missing or inconsistent.
+func (trip Trip) Validate() FieldErrors {
+	errs := FieldErrors{}
+	if trip.JourneyID == "" {
+		errs.Add("journey_id", "is required")
+	}
+	if trip.StartRoom == "" {
+		errs.Add("start", "is required")
+	}
+	if trip.EndRoom == "" {
+		errs.Add("end", "is required")
+	} else if trip.EndRoom == trip.StartRoom {
+		errs.Add("end", "must differ from start")
+	}
+	return errs
+}
+
+// validate checks trip and that the journey and rooms it refers to exist.
+func (manager TripManager) validate(ctx context.Context, trip Trip) error {
+	errs := trip.Validate()
+	if trip.JourneyID != "" {
+		if _, dataErr := manager.journeys.GetJourney(ctx, trip.JourneyID); dataErr == ErrJourneyMissing {
+			errs.Add("journey_id", ErrJourneyMissing.Message)
+		} else if dataErr != nil {
+			return dataErr
+		}
+	}
+	rooms := []struct{ field, id string }{{"start", trip.StartRoom}, {"end", trip.EndRoom}}
+	for _, room := range rooms {
+		if room.id == "" {
+			continue
+		}
+		if _, dataErr := manager.rooms.GetRoom(ctx, room.id); dataErr == ErrRoomMissing {
+			errs.Add(room.field, ErrRoomMissing.Message)
+		} else if dataErr != nil {
+			return dataErr
+		}
+	}
+	return errs.Err()
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// updateBuffer is how many updates a subscriber may fall behind
+// before it is dropped.
+const updateBuffer = 64
+
+// Kinds of Update.
+const (
+	UpdateJourney        = "journey"
+	UpdateTrip           = "trip"
+	UpdateJourneyDeleted = "journey.deleted"
+	UpdateTripDeleted    = "trip.deleted"
+	UpdatePosition       = "position"
+)
+
+// Update is a change pushed to clients following a journey. Data is
+// the Journey or Trip as it was committed, the ID of a deleted one,
+// or the robot's Pose.
+// Updates without a JourneyID concern every journey.
+type Update struct {
+	Type      string      `json:"type"`
+	JourneyID string      `json:"journey_id,omitempty"`
+	Data      interface{} `json:"data"`
+	Timestamp int64       `json:"timestamp"`
+}
+
+// Hub fans updates out to the clients following them. It only reaches
+// clients connected to the same process.
+type Hub struct {
+	mu          sync.Mutex
+	subscribers map[*subscription]struct{}
+	closed      bool
+}
+
+type subscription struct {
+	journeyID string
+	updates   chan Update
+}
+
+func NewHub() *Hub {
+	return &Hub{
+		subscribers: map[*subscription]struct{}{},
+	}
+}
+
+// Subscribe follows the updates of the journey with the given ID
+// until cancel is called. The channel is closed when the subscriber
+// falls too far behind, so that it can reconnect and start over from
+// the current state.
+func (hub *Hub) Subscribe(journeyID string) (updates <-chan Update, cancel func()) {
+	s := &subscription{journeyID: journeyID, updates: make(chan Update, updateBuffer)}
+	hub.mu.Lock()
+	if hub.closed {
+		close(s.updates)
+	} else {
+		hub.subscribers[s] = struct{}{}
+	}
+	hub.mu.Unlock()
+	return s.updates, func() {
+		hub.mu.Lock()
+		defer hub.mu.Unlock()
+		hub.remove(s)
+	}
+}
+
+// Publish sends update to every subscriber it concerns without
+// waiting for any of them.
+func (hub *Hub) Publish(update Update) {
+	if update.Timestamp == 0 {
+		update.Timestamp = time.Now().UTC().Unix()
+	}
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	for s := range hub.subscribers {
+		if update.JourneyID != "" && update.JourneyID != s.journeyID {
+			continue
+		}
+		select {
+		case s.updates <- update:
+		default:
+			hub.remove(s)
+		}
+	}
+}
+
+// Close closes the channel of every subscriber, and of those still to
+// come, so that streams end when the server shuts down.
+func (hub *Hub) Close() {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	hub.closed = true
+	for s := range hub.subscribers {
+		hub.remove(s)
+	}
+}
+
+// remove drops s, which must be done holding mu.
+func (hub *Hub) remove(s *subscription) {
+	if _, ok := hub.subscribers[s]; ok {
+		delete(hub.subscribers, s)
+		close(s.updates)
+	}
+}
+
+type hubTxKey struct{}
+
+// hubTx holds the updates of a transaction until it commits.
+type hubTx struct {
+	updates []Update
+}
+
+// hubStore publishes every journey and trip written through it on hub
+// once the write has been committed.
+type hubStore struct {
+	Store
+	hub *Hub
+}
+
+func (store hubStore) RunInTransaction(ctx context.Context, f func(ctx context.Context) error) error {
+	if _, ok := ctx.Value(hubTxKey{}).(*hubTx); ok {
+		return store.Store.RunInTransaction(ctx, f)
+	}
+	tx := &hubTx{}
+	if txErr := store.Store.RunInTransaction(ctx, func(ctx context.Context) error {
+		// A retried transaction starts over.
+		tx.updates = nil
+		return f(context.WithValue(ctx, hubTxKey{}, tx))
+	}); txErr != nil {
+		return txErr
+	}
+	for _, update := range tx.updates {
+		store.hub.Publish(update)
+	}
+	return nil
+}
+
+func (store hubStore) publish(ctx context.Context, update Update) {
+	if tx, ok := ctx.Value(hubTxKey{}).(*hubTx); ok {
+		tx.updates = append(tx.updates, update)
+		return
+	}
+	store.hub.Publish(update)
+}
+
+func (store hubStore) PutJourney(ctx context.Context, journey Journey) error {
+	if dataErr := store.Store.PutJourney(ctx, journey); dataErr != nil {
+		return dataErr
+	}
+	store.publish(ctx, Update{Type: UpdateJourney, JourneyID: journey.ID, Data: journey})
+	return nil
+}
+
+func (store hubStore) PutTrip(ctx context.Context, trip Trip) error {
+	if dataErr := store.Store.PutTrip(ctx, trip); dataErr != nil {
+		return dataErr
+	}
+	store.publish(ctx, Update{Type: UpdateTrip, JourneyID: trip.JourneyID, Data: trip})
+	return nil
+}
+
+func (store hubStore) DeleteJourney(ctx context.Context, id string) error {
+	if dataErr := store.Store.DeleteJourney(ctx, id); dataErr != nil {
+		return dataErr
+	}
+	store.publish(ctx, Update{Type: UpdateJourneyDeleted, JourneyID: id, Data: id})
+	return nil
+}
+
+func (store hubStore) DeleteTrip(ctx context.Context, id string) error {
+	trip, dataErr := store.Store.GetTrip(ctx, id)
+	if dataErr != nil {
+		return dataErr
+	}
+	if dataErr := store.Store.DeleteTrip(ctx, id); dataErr != nil {
+		return dataErr
+	}
+	store.publish(ctx, Update{Type: UpdateTripDeleted, JourneyID: trip.JourneyID, Data: id})
+	return nil
+}
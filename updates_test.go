@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// drain returns the updates waiting on updates without blocking.
+func drain(updates <-chan Update) []Update {
+	got := []Update{}
+	for {
+		select {
+		case update, ok := <-updates:
+			if !ok {
+				return got
+			}
+			got = append(got, update)
+		default:
+			return got
+		}
+	}
+}
+
+func TestHubPublish(t *testing.T) {
+	hub := NewHub()
+	j1, cancel1 := hub.Subscribe("j1")
+	defer cancel1()
+	j2, cancel2 := hub.Subscribe("j2")
+	defer cancel2()
+
+	hub.Publish(Update{Type: UpdateTrip, JourneyID: "j1", Data: "t1"})
+	hub.Publish(Update{Type: UpdatePosition, Data: Pose{X: 1}})
+
+	if got := drain(j1); len(got) != 2 || got[0].Type != UpdateTrip || got[1].Type != UpdatePosition {
+		t.Errorf("j1 got %+v, want its trip and the position", got)
+	} else if got[0].Timestamp == 0 {
+		t.Error("published update has no timestamp")
+	}
+	if got := drain(j2); len(got) != 1 || got[0].Type != UpdatePosition {
+		t.Errorf("j2 got %+v, want only the position", got)
+	}
+}
+
+func TestHubDropsSlowSubscribers(t *testing.T) {
+	hub := NewHub()
+	updates, cancel := hub.Subscribe("j1")
+	defer cancel()
+	for i := 0; i <= updateBuffer; i++ {
+		hub.Publish(Update{Type: UpdateJourney, JourneyID: "j1"})
+	}
+	if got := len(drain(updates)); got != updateBuffer {
+		t.Errorf("slow subscriber got %d updates, want %d", got, updateBuffer)
+	}
+	if _, ok := <-updates; ok {
+		t.Error("slow subscriber is still subscribed")
+	}
+}
+
+func TestHubClose(t *testing.T) {
+	hub := NewHub()
+	before, cancel := hub.Subscribe("j1")
+	hub.Close()
+	cancel()
+	if _, ok := <-before; ok {
+		t.Error("Close left a subscriber open")
+	}
+	after, cancel := hub.Subscribe("j1")
+	defer cancel()
+	if _, ok := <-after; ok {
+		t.Error("subscribing to a closed hub left the channel open")
+	}
+}
+
+func TestHubStorePublishesOnCommit(t *testing.T) {
+	ctx := context.Background()
+	hub := NewHub()
+	store := hubStore{Store: NewMemoryStore(), hub: hub}
+	updates, cancel := hub.Subscribe("j1")
+	defer cancel()
+
+	failed := errors.New("failed")
+	store.RunInTransaction(ctx, func(ctx context.Context) error {
+		store.PutJourney(ctx, Journey{ID: "j1", Name: "Lost"})
+		return failed
+	})
+	if got := drain(updates); len(got) != 0 {
+		t.Errorf("a rolled back transaction published %+v", got)
+	}
+
+	store.RunInTransaction(ctx, func(ctx context.Context) error {
+		if err := store.PutJourney(ctx, Journey{ID: "j1", Name: "Tour"}); err != nil {
+			return err
+		}
+		if err := store.PutTrip(ctx, Trip{ID: "t1", JourneyID: "j1"}); err != nil {
+			return err
+		}
+		if got := drain(updates); len(got) != 0 {
+			t.Errorf("published %+v before the commit", got)
+		}
+		return nil
+	})
+	got := drain(updates)
+	if len(got) != 2 || got[0].Type != UpdateJourney || got[1].Type != UpdateTrip {
+		t.Fatalf("committing published %+v, want the journey and then the trip", got)
+	}
+
+	if err := store.DeleteTrip(ctx, "t1"); err != nil {
+		t.Fatalf("DeleteTrip: %v", err)
+	}
+	if got := drain(updates); len(got) != 1 || got[0].Type != UpdateTripDeleted || got[0].JourneyID != "j1" {
+		t.Errorf("deleting the trip published %+v, want its deletion on j1", got)
+	}
+}
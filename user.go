@@ -1,23 +1,26 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
-	"errors"
 	"net/http"
-	"reflect"
+	"time"
 
 	"github.com/gorilla/mux"
-
-	"appengine"
-	"appengine/datastore"
 )
 
 var (
-	ErrUserAlreadyExists = errors.New("user already exists")
-	ErrUserMissing       = errors.New("user does not exist")
+	ErrUserAlreadyExists = &Error{Code: CodeConflict, Entity: "user", Message: "user already exists"}
+	ErrUserMissing       = &Error{Code: CodeNotFound, Entity: "user", Message: "user does not exist"}
 )
 
-type UserManager struct{}
+type UserManager struct {
+	transactor Transactor
+	users UserStore
+	journeys JourneyStore
+	trips TripStore
+	rooms RoomStore
+}
 
 type User struct {
 	ID            string   `datastore:"id" json:"id"`
@@ -28,24 +31,77 @@ type User struct {
 	Grade         int      `datastore:"grade" json:"grade"`
 	Journeys      []string `datastore:"journeys" json:"journeys"`
 	LatestJourney string   `datastore:"latest_journey" json:"latest_journey"`
+	CreatedAt     int64    `datastore:"created_at" json:"created_at"`
 }
 
+// UserPatchFields lists the fields of a User clients may change, which
+// are also the only ones they may set when creating one.
+var UserPatchFields = []string{"first_name", "last_name", "description", "likes", "grade"}
+
 func (manager UserManager) Group() Group {
+	self := Filters{AnyOf(IsAdmin, IsSelf("userid"))}
+	return Group{
+		Paths: Routes{
+			"": Methods{
+				http.MethodGet: Route{
+					Handler: manager.ListUsers,
+					Allow: Filters{IsAdmin},
+				},
+				http.MethodPost: Route{
+					Handler: manager.CreateUser,
+					Allow: Filters{IsAdmin},
+				},
+			},
+			"{userid}": Methods{
+				http.MethodGet: Route{
+					Handler: manager.GetUser,
+					Allow: self,
+				},
+				http.MethodPut: Route{
+					Handler: manager.ReplaceUser,
+					Allow: self,
+				},
+				http.MethodPatch: Route{
+					Handler: manager.SetUser,
+					Allow: self,
+				},
+				http.MethodDelete: Route{
+					Handler: manager.DelUser,
+					Allow: self,
+				},
+			},
+			"{userid}/recommended-rooms": Route{
+				Methods: []string{http.MethodGet},
+				Handler: manager.RecommendRooms,
+				Allow: self,
+			},
+		},
+	}
+}
+
+// LegacyGroup serves the action-suffixed paths used by the existing
+// robot and app clients. Each of them answers to any method.
+func (manager UserManager) LegacyGroup() Group {
+	self := Filters{AnyOf(IsAdmin, IsSelf("userid"))}
 	return Group{
 		Paths: Routes{
 			"{userid}/": Group{
 				Paths: Routes{
 					"get": Route{
 						Handler: manager.GetUser,
+						Allow: self,
 					},
 					"create": Route{
 						Handler: manager.CreateUser,
+						Allow: self,
 					},
-					"delete": Route{
+					"del": Route{
 						Handler: manager.DelUser,
+						Allow: self,
 					},
 					"set": Route{
 						Handler: manager.SetUser,
+						Allow: self,
 					},
 				},
 			},
@@ -54,93 +110,168 @@ func (manager UserManager) Group() Group {
 }
 
 func (manager UserManager) CreateUser(w http.ResponseWriter, r *http.Request) {
-	ctx := appengine.NewContext(r)
-	userID := mux.Vars(r)["userid"]
+	ctx := r.Context()
 	encoder := json.NewEncoder(w)
-	decoder := json.NewDecoder(r.Body)
 
+	userID, idErr := entityID(r, "userid")
+	if idErr != nil {
+		WriteError(w, idErr)
+		return
+	}
 	user := User{}
-	key := datastore.NewKey(ctx, "user", userID, 0, nil)
-	dataErr := datastore.Get(ctx, key, &user)
-	if dataErr == nil {
-		encoder.Encode(ResponseError{Error: ErrUserAlreadyExists.Error()})
+	if bodyErr := readFields(r, &user, UserPatchFields); bodyErr != nil {
+		WriteError(w, bodyErr)
 		return
-	} else if dataErr != datastore.ErrNoSuchEntity {
-		encoder.Encode(ResponseError{Error: dataErr.Error()})
+	}
+	if validErr := user.Validate().Err(); validErr != nil {
+		WriteError(w, validErr)
 		return
 	}
-	decoder.Decode(&user)
 	user.ID = userID
-	datastore.Put(ctx, key, user)
+	user.CreatedAt = time.Now().UTC().Unix()
+	if txErr := manager.transactor.RunInTransaction(ctx, func(ctx context.Context) error {
+		return manager.createUser(ctx, user)
+	}); txErr != nil {
+		WriteError(w, txErr)
+		return
+	}
+	created(w, "/users/"+user.ID)
 	encoder.Encode(user)
 }
 
-func (manager UserManager) GetUser(w http.ResponseWriter, r *http.Request) {
-	ctx := appengine.NewContext(r)
+// createUser stores user unless its ID is taken.
+func (manager UserManager) createUser(ctx context.Context, user User) error {
+	_, dataErr := manager.users.GetUser(ctx, user.ID)
+	if dataErr == nil {
+		return withID(ErrUserAlreadyExists, user.ID)
+	} else if dataErr != ErrUserMissing {
+		return withID(dataErr, user.ID)
+	}
+	return manager.users.PutUser(ctx, user)
+}
+
+// ReplaceUser creates the user with the ID in the path or, if there is
+// one, replaces every field clients may set, so that sending the same
+// body again changes nothing.
+func (manager UserManager) ReplaceUser(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
 	userID := mux.Vars(r)["userid"]
 	encoder := json.NewEncoder(w)
-	decoder := json.NewDecoder(r.Body)
 
+	patch, bodyErr := readReplacement(r, UserPatchFields)
+	if bodyErr != nil {
+		WriteError(w, bodyErr)
+		return
+	}
 	user := User{}
-	key := datastore.NewKey(ctx, "user", userID, 0, nil)
-	dataErr := datastore.Get(ctx, key, &user)
-	if dataErr != nil {
-		if dataErr != datastore.ErrNoSuchEntity {
-			encoder.Encode(ResponseError{Error: dataErr.Error()})
-			return
+	isNew := false
+	if txErr := manager.transactor.RunInTransaction(ctx, func(ctx context.Context) error {
+		var dataErr error
+		user, dataErr = manager.users.GetUser(ctx, userID)
+		isNew = dataErr == ErrUserMissing
+		if isNew {
+			user = User{ID: userID, CreatedAt: time.Now().UTC().Unix()}
+		} else if dataErr != nil {
+			return withID(dataErr, userID)
 		}
-		encoder.Encode(ResponseError{Error: ErrUserMissing.Error()})
+		if patchErr := applyPatch(&user, patch); patchErr != nil {
+			return patchErr
+		}
+		if validErr := user.Validate().Err(); validErr != nil {
+			return validErr
+		}
+		return manager.users.PutUser(ctx, user)
+	}); txErr != nil {
+		WriteError(w, txErr)
 		return
 	}
-	decoder.Decode(&user)
+	if isNew {
+		created(w, "/users/"+user.ID)
+	}
 	encoder.Encode(user)
 }
 
-func (manager UserManager) DelUser(w http.ResponseWriter, r *http.Request) {
-	ctx := appengine.NewContext(r)
+// ListUsers serves a page of every user.
+func (manager UserManager) ListUsers(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	encoder := json.NewEncoder(w)
+
+	query, queryErr := parseListQuery(r, nil)
+	if queryErr != nil {
+		WriteError(w, queryErr)
+		return
+	}
+	users, next, dataErr := manager.users.ListUsers(ctx, query)
+	if dataErr != nil {
+		WriteError(w, dataErr)
+		return
+	}
+	encoder.Encode(ResponsePage{Items: users, NextCursor: next})
+}
+
+func (manager UserManager) GetUser(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
 	userID := mux.Vars(r)["userid"]
 	encoder := json.NewEncoder(w)
 
-	key := datastore.NewKey(ctx, "user", userID, 0, nil)
-	dataErr := datastore.Delete(ctx, key)
+	user, dataErr := manager.users.GetUser(ctx, userID)
 	if dataErr != nil {
-		if dataErr != datastore.ErrInvalidKey {
-			encoder.Encode(ResponseError{Error: dataErr.Error()})
-			return
-		}
-		encoder.Encode(ResponseError{Error: ErrUserMissing.Error()})
+		WriteError(w, withID(dataErr, userID))
+		return
+	}
+	encoder.Encode(user)
+}
+
+func (manager UserManager) DelUser(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := mux.Vars(r)["userid"]
+	encoder := json.NewEncoder(w)
+
+	if dataErr := manager.users.DeleteUser(ctx, userID); dataErr != nil {
+		WriteError(w, withID(dataErr, userID))
+		return
 	}
 	encoder.Encode(ResponseSuccess{Success: true})
 }
 
 func (manager UserManager) SetUser(w http.ResponseWriter, r *http.Request) {
-	ctx := appengine.NewContext(r)
-	userID := mux.Vars(r)["userID"]
+	ctx := r.Context()
+	userID := mux.Vars(r)["userid"]
 	encoder := json.NewEncoder(w)
-	decoder := json.NewDecoder(r.Body)
 
+	patch, bodyErr := readPatch(r, UserPatchFields)
+	if bodyErr != nil {
+		WriteError(w, bodyErr)
+		return
+	}
 	user := User{}
-	key := datastore.NewKey(ctx, "user", userID, 0, nil)
-	dataErr := datastore.Get(ctx, key, &user)
-	if dataErr != nil {
-		if dataErr != datastore.ErrNoSuchEntity {
-			encoder.Encode(ResponseError{Error: dataErr.Error()})
-			return
+	if txErr := manager.transactor.RunInTransaction(ctx, func(ctx context.Context) error {
+		var dataErr error
+		if user, dataErr = manager.users.GetUser(ctx, userID); dataErr != nil {
+			return withID(dataErr, userID)
 		}
-		encoder.Encode(ResponseError{Error: ErrUserMissing.Error()})
+		if patchErr := applyPatch(&user, patch); patchErr != nil {
+			return patchErr
+		}
+		if validErr := user.Validate().Err(); validErr != nil {
+			return validErr
+		}
+		return manager.users.PutUser(ctx, user)
+	}); txErr != nil {
+		WriteError(w, txErr)
 		return
 	}
-	updatedUser := User{}
-	decoder.Decode(&updatedUser)
-	user.MergeInPlace(updatedUser)
-	datastore.Put(ctx, key, user)
 	encoder.Encode(user)
 }
 
-func (old *User) MergeInPlace(new User) {
-	for ii := 0; ii < reflect.TypeOf(old).Elem().NumField(); ii++ {
-		if x := reflect.ValueOf(&new).Elem().Field(ii); !x.IsNil() {
-			reflect.ValueOf(old).Elem().Field(ii).Set(x)
-		}
+// Validate reports every field of user that is missing or out of range.
+func (user User) Validate() FieldErrors {
+	errs := FieldErrors{}
+	if user.FirstName == "" {
+		errs.Add("first_name", "is required")
+	}
+	if user.Grade < 0 {
+		errs.Add("grade", "must not be negative")
 	}
+	return errs
 }
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+var ErrMalformedBody = &Error{Code: CodeInvalid, Message: "malformed request body"}
+
+// FieldError describes a single invalid field of a request body,
+// named as it appears in JSON.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// FieldErrors collects every problem with a request body so that
+// they can be reported together.
+type FieldErrors []FieldError
+
+func (errs *FieldErrors) Add(field, message string) {
+	*errs = append(*errs, FieldError{Field: field, Message: message})
+}
+
+// Err returns nil if errs is empty and an invalid request Error
+// listing every field error otherwise.
+func (errs FieldErrors) Err() error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return &Error{Code: CodeInvalid, Message: "invalid request body", Details: errs}
+}
+
+// decodeBody decodes the JSON body of r into v, reporting
+// malformed or empty bodies as ErrMalformedBody.
+func decodeBody(r *http.Request, v interface{}) error {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return malformed(err)
+	}
+	return nil
+}
+
+// malformed reports a body that could not be decoded, with the
+// decoding error as detail.
+func malformed(err error) error {
+	e := *ErrMalformedBody
+	e.Details = err.Error()
+	return &e
+}